@@ -38,6 +38,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/webapi.Message"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Retries with the same key replay the first response",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -53,6 +59,18 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "409": {
+                        "description": "idempotency key is used for another request or in progress",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "499": {
+                        "description": "request cancelled",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "server error",
                         "schema": {
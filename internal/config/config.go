@@ -1,16 +1,125 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
+// Redis deployments of API.CacheMode.
+const (
+	CacheStandalone = "standalone"
+	CacheSentinel   = "sentinel"
+	CacheCluster    = "cluster"
+)
+
+// ErrInvalidConfig is returned by GetConfig for invalid settings.
+var ErrInvalidConfig = errors.New("invalid config")
+
 // API contains api settings.
 type API struct {
 	Bind      string `mapstructure:"bind"`
 	CacheAddr string `mapstructure:"cache_addr"`
+	// CacheMode is the Redis deployment: standalone at CacheAddr, sentinel with the sentinels at CacheAddrs
+	// monitoring CacheMasterName, or cluster with the seed nodes at CacheAddrs.
+	CacheMode       string   `mapstructure:"cache_mode"`
+	CacheAddrs      []string `mapstructure:"cache_addrs"`
+	CacheMasterName string   `mapstructure:"cache_master_name"`
+	// CacheUsername and CachePassword authenticate to Redis. The password may be read from
+	// CachePasswordFile instead, so that it is not kept in the configuration.
+	CacheUsername     string `mapstructure:"cache_username"`
+	CachePassword     string `mapstructure:"cache_password"`
+	CachePasswordFile string `mapstructure:"cache_password_file"`
+	CacheDB           int    `mapstructure:"cache_db"`
+	// CacheTLS connects to Redis over TLS, the server is verified with CacheTLSCAFile or the system roots.
+	CacheTLS       bool   `mapstructure:"cache_tls"`
+	CacheTLSCAFile string `mapstructure:"cache_tls_ca_file"`
+	// CachePoolSize and CacheMinIdleConns size the connection pool, zero keeps the client defaults
+	// as do zero timeouts.
+	CachePoolSize     int           `mapstructure:"cache_pool_size"`
+	CacheMinIdleConns int           `mapstructure:"cache_min_idle_conns"`
+	CacheDialTimeout  time.Duration `mapstructure:"cache_dial_timeout"`
+	CacheReadTimeout  time.Duration `mapstructure:"cache_read_timeout"`
+	CacheWriteTimeout time.Duration `mapstructure:"cache_write_timeout"`
+	// CacheStore is where responses and jobs are kept: redis, memory or disk. Events, scheduled requests
+	// and the durable queue need redis.
+	CacheStore string `mapstructure:"cache_store"`
+	// CacheDir is the directory of the disk store.
+	CacheDir string `mapstructure:"cache_dir"`
+	// CacheMemoryMaxSize limits the memory store in bytes, the least recently used records are evicted.
+	CacheMemoryMaxSize int `mapstructure:"cache_memory_max_size"`
+	// ResultRetention is how long background results are kept in the cache, zero keeps them forever.
+	ResultRetention time.Duration `mapstructure:"result_retention"`
+	// ResultMaxRetention limits the retention requested with x-background-retention, zero limits it to
+	// ResultRetention or the retention of the route.
+	ResultMaxRetention time.Duration `mapstructure:"result_max_retention"`
+	// ResultReadMode is consume to remove results once read or keep to keep them until acknowledged.
+	ResultReadMode string `mapstructure:"result_read_mode"`
+	// Results with bodies above ResultCompressThreshold bytes are compressed and stored in chunks of
+	// ResultChunkSize bytes, stored bodies are limited to ResultMaxSize bytes.
+	ResultCompressThreshold int `mapstructure:"result_compress_threshold"`
+	ResultChunkSize         int `mapstructure:"result_chunk_size"`
+	ResultMaxSize           int `mapstructure:"result_max_size"`
+	// ResultFormat is binary to write results in the versioned binary envelope, or json, the default, to write
+	// plain JSON readable by releases before the envelope while they are replaced.
+	ResultFormat string `mapstructure:"result_format"`
+	// ResultEncryptionKeys encrypt stored results when set, the first key encrypts and all of them decrypt.
+	ResultEncryptionKeys []EncryptionKey `mapstructure:"result_encryption_keys"`
+	// CallbackSecret signs x-background-callback payloads, callbacks are disabled when it is empty.
+	CallbackSecret      string        `mapstructure:"callback_secret"`
+	CallbackMaxAttempts int           `mapstructure:"callback_max_attempts"`
+	CallbackBackoff     time.Duration `mapstructure:"callback_backoff"`
+	// CallbackWorkers and CallbackQueueSize bound the delivery of callbacks, apart from the background workers.
+	CallbackWorkers   int `mapstructure:"callback_workers"`
+	CallbackQueueSize int `mapstructure:"callback_queue_size"`
+	// CallbackAllowedHosts restricts callbacks to these hosts when set. Callbacks to loopback, private and
+	// link-local addresses are refused unless CallbackAllowPrivate is set.
+	CallbackAllowedHosts []string `mapstructure:"callback_allowed_hosts"`
+	CallbackAllowPrivate bool     `mapstructure:"callback_allow_private"`
+	// BackgroundWorkers and BackgroundQueueSize bound the execution of background requests.
+	BackgroundWorkers    int           `mapstructure:"background_workers"`
+	BackgroundQueueSize  int           `mapstructure:"background_queue_size"`
+	BackgroundRetryAfter time.Duration `mapstructure:"background_retry_after"`
+	// BackgroundMaxBodySize limits the body of background requests in bytes, they are buffered in memory.
+	BackgroundMaxBodySize int64 `mapstructure:"background_max_body_size"`
+	// BackgroundMode is local to execute background requests in the instance which accepted them, or queue
+	// to hand them over to the durable queue executed by worker processes.
+	BackgroundMode string `mapstructure:"background_mode"`
+	// QueueClaimIdle is how long a queued request may go without a heartbeat before another worker claims it.
+	QueueClaimIdle time.Duration `mapstructure:"queue_claim_idle"`
+	// BackgroundPriorities are the allowed values of x-background-priority from the highest priority,
+	// requests without the header get BackgroundDefaultPriority.
+	BackgroundPriorities      []string `mapstructure:"background_priorities"`
+	BackgroundDefaultPriority string   `mapstructure:"background_default_priority"`
+	// BackgroundPriorityCaps limit the priority of callers, they are lowered to the cap.
+	BackgroundPriorityCaps []PriorityCap `mapstructure:"background_priority_caps"`
+	// AdminCallers are the caller identities allowed to use the operator endpoints.
+	AdminCallers []string `mapstructure:"admin_callers"`
+	// JWTSecret verifies bearer JWTs signed with HS256, their sub claim identifies the caller. Bearer tokens
+	// are ignored when it is empty.
+	JWTSecret string `mapstructure:"jwt_secret"`
+	// SchedulerInterval is how often scheduled requests are checked for being due.
+	SchedulerInterval time.Duration `mapstructure:"scheduler_interval"`
+	// IdempotencyTTL is how long responses of requests with an Idempotency-Key are replayed.
+	IdempotencyTTL time.Duration `mapstructure:"idempotency_ttl"`
+}
+
+// EncryptionKey is a base64 encoded 32 byte key, given in Key or read from KeyFile. The ID is stored with
+// the records it encrypts and must not be reused for another key.
+type EncryptionKey struct {
+	ID      string `mapstructure:"id"`
+	Key     string `mapstructure:"key"`
+	KeyFile string `mapstructure:"key_file"`
+}
+
+// PriorityCap is the highest background priority the caller may use.
+type PriorityCap struct {
+	Caller   string `mapstructure:"caller"`
+	Priority string `mapstructure:"priority"`
 }
 
 type Service struct {
@@ -42,6 +151,114 @@ func GetConfig() (*Config, error) {
 	if err := viper.Unmarshal(config); err != nil {
 		return nil, fmt.Errorf("unable to decode into struct, %w", err)
 	}
+	if config.App == nil {
+		return nil, fmt.Errorf("%w: app_api is missing", ErrInvalidConfig)
+	}
+	if err := config.App.validateCache(); err != nil {
+		return nil, err
+	}
+	if err := config.App.loadCachePassword(); err != nil {
+		return nil, err
+	}
+	if err := config.App.loadEncryptionKeys(); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
+
+// validateCache checks the settings of the Redis connection.
+func (a *API) validateCache() error {
+	switch a.CacheMode {
+	case "", CacheStandalone:
+		if a.CacheMasterName != "" {
+			return invalidSetting("cache_master_name", "requires the sentinel cache_mode")
+		}
+	case CacheSentinel:
+		if a.CacheMasterName == "" {
+			return invalidSetting("cache_master_name", "is required by the sentinel cache_mode")
+		}
+		if len(a.CacheAddrs) == 0 {
+			return invalidSetting("cache_addrs", "is required by the sentinel cache_mode")
+		}
+	case CacheCluster:
+		if len(a.CacheAddrs) == 0 {
+			return invalidSetting("cache_addrs", "is required by the cluster cache_mode")
+		}
+		if a.CacheDB != 0 {
+			return invalidSetting("cache_db", "must be 0 in the cluster cache_mode")
+		}
+		if a.CacheMasterName != "" {
+			return invalidSetting("cache_master_name", "requires the sentinel cache_mode")
+		}
+	default:
+		return invalidSetting("cache_mode", fmt.Sprintf("%q is unknown", a.CacheMode))
+	}
+	switch {
+	case a.CacheDB < 0:
+		return invalidSetting("cache_db", "must not be negative")
+	case a.CachePassword != "" && a.CachePasswordFile != "":
+		return invalidSetting("cache_password_file", "must not be set with cache_password")
+	case a.CacheTLSCAFile != "" && !a.CacheTLS:
+		return invalidSetting("cache_tls_ca_file", "requires cache_tls")
+	case a.CachePoolSize < 0:
+		return invalidSetting("cache_pool_size", "must not be negative")
+	case a.CacheMinIdleConns < 0:
+		return invalidSetting("cache_min_idle_conns", "must not be negative")
+	case a.CachePoolSize > 0 && a.CacheMinIdleConns > a.CachePoolSize:
+		return invalidSetting("cache_min_idle_conns", "must not exceed cache_pool_size")
+	case a.CacheDialTimeout < 0:
+		return invalidSetting("cache_dial_timeout", "must not be negative")
+	case a.CacheReadTimeout < 0:
+		return invalidSetting("cache_read_timeout", "must not be negative")
+	case a.CacheWriteTimeout < 0:
+		return invalidSetting("cache_write_timeout", "must not be negative")
+	}
+	return nil
+}
+
+// loadCachePassword reads the password from CachePasswordFile, trailing line breaks are dropped.
+func (a *API) loadCachePassword() error {
+	if a.CachePasswordFile == "" {
+		return nil
+	}
+	password, err := ioutil.ReadFile(a.CachePasswordFile)
+	if err != nil {
+		return invalidSetting("cache_password_file", err.Error())
+	}
+	a.CachePassword = strings.TrimRight(string(password), "\r\n")
+	return nil
+}
+
+// loadEncryptionKeys checks the encryption keys and reads those given in files.
+func (a *API) loadEncryptionKeys() error {
+	if len(a.ResultEncryptionKeys) > 0 && a.ResultFormat != "binary" {
+		return invalidSetting("result_encryption_keys", "requires the binary result_format")
+	}
+	ids := make(map[string]bool, len(a.ResultEncryptionKeys))
+	for i := range a.ResultEncryptionKeys {
+		key := &a.ResultEncryptionKeys[i]
+		name := fmt.Sprintf("result_encryption_keys[%d]", i)
+		switch {
+		case key.ID == "":
+			return invalidSetting(name+".id", "is required")
+		case ids[key.ID]:
+			return invalidSetting(name+".id", fmt.Sprintf("%q is used twice", key.ID))
+		case (key.Key == "") == (key.KeyFile == ""):
+			return invalidSetting(name, "needs either key or key_file")
+		}
+		ids[key.ID] = true
+		if key.KeyFile != "" {
+			secret, err := ioutil.ReadFile(key.KeyFile)
+			if err != nil {
+				return invalidSetting(name+".key_file", err.Error())
+			}
+			key.Key = strings.TrimSpace(string(secret))
+		}
+	}
+	return nil
+}
+
+func invalidSetting(name, reason string) error {
+	return fmt.Errorf("%w: app_api.%s %s", ErrInvalidConfig, name, reason)
+}
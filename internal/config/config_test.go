@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPI_ValidateCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		api     API
+		setting string
+	}{
+		{name: "valid", api: API{CacheDB: 2, CachePoolSize: 10, CacheMinIdleConns: 10, CacheReadTimeout: time.Second}},
+		{name: "negative db", api: API{CacheDB: -1}, setting: "app_api.cache_db"},
+		{
+			name:    "password twice",
+			api:     API{CachePassword: "secret", CachePasswordFile: "/run/secrets/redis"},
+			setting: "app_api.cache_password_file",
+		},
+		{name: "CA without TLS", api: API{CacheTLSCAFile: "/etc/ca.pem"}, setting: "app_api.cache_tls_ca_file"},
+		{
+			name:    "idle above pool",
+			api:     API{CachePoolSize: 2, CacheMinIdleConns: 3},
+			setting: "app_api.cache_min_idle_conns",
+		},
+		{name: "unknown mode", api: API{CacheMode: "replicated"}, setting: "app_api.cache_mode"},
+		{
+			name: "sentinel",
+			api:  API{CacheMode: CacheSentinel, CacheMasterName: "mymaster", CacheAddrs: []string{"sentinel:26379"}},
+		},
+		{
+			name:    "sentinel without master",
+			api:     API{CacheMode: CacheSentinel, CacheAddrs: []string{"sentinel:26379"}},
+			setting: "app_api.cache_master_name",
+		},
+		{name: "cluster without nodes", api: API{CacheMode: CacheCluster}, setting: "app_api.cache_addrs"},
+		{
+			name:    "cluster db",
+			api:     API{CacheMode: CacheCluster, CacheAddrs: []string{"node:6379"}, CacheDB: 1},
+			setting: "app_api.cache_db",
+		},
+		{name: "negative timeout", api: API{CacheWriteTimeout: -time.Second}, setting: "app_api.cache_write_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.api.validateCache()
+			if tt.setting == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+			assert.Contains(t, err.Error(), tt.setting)
+		})
+	}
+}
+
+func TestAPI_LoadCachePassword(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "redis-password")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0o600))
+
+	api := &API{CachePasswordFile: passwordFile}
+	assert.NoError(t, api.loadCachePassword())
+	assert.Equal(t, "secret", api.CachePassword)
+
+	api = &API{CachePasswordFile: passwordFile + ".missing"}
+	err := api.loadCachePassword()
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	assert.Contains(t, err.Error(), "app_api.cache_password_file")
+}
+
+func TestAPI_LoadEncryptionKeys(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "result-key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("c2VjcmV0\n"), 0o600))
+
+	api := &API{
+		ResultFormat:         "binary",
+		ResultEncryptionKeys: []EncryptionKey{{ID: "2022-06", KeyFile: keyFile}, {ID: "2022-01", Key: "b2xk"}},
+	}
+	assert.NoError(t, api.loadEncryptionKeys())
+	assert.Equal(t, "c2VjcmV0", api.ResultEncryptionKeys[0].Key)
+
+	tests := []struct {
+		name    string
+		api     API
+		setting string
+	}{
+		{
+			name:    "json format",
+			api:     API{ResultFormat: "json", ResultEncryptionKeys: []EncryptionKey{{ID: "k", Key: "b2xk"}}},
+			setting: "app_api.result_encryption_keys",
+		},
+		{
+			name:    "default format",
+			api:     API{ResultEncryptionKeys: []EncryptionKey{{ID: "k", Key: "b2xk"}}},
+			setting: "app_api.result_encryption_keys",
+		},
+		{
+			name: "missing id",
+			api: API{
+				ResultFormat:         "binary",
+				ResultEncryptionKeys: []EncryptionKey{{Key: "b2xk"}},
+			},
+			setting: "app_api.result_encryption_keys[0].id",
+		},
+		{
+			name: "duplicate id",
+			api: API{
+				ResultFormat:         "binary",
+				ResultEncryptionKeys: []EncryptionKey{{ID: "k", Key: "b2xk"}, {ID: "k", Key: "b2xk"}},
+			},
+			setting: "app_api.result_encryption_keys[1].id",
+		},
+		{
+			name: "key twice",
+			api: API{
+				ResultFormat:         "binary",
+				ResultEncryptionKeys: []EncryptionKey{{ID: "k", Key: "b2xk", KeyFile: keyFile}},
+			},
+			setting: "app_api.result_encryption_keys[0]",
+		},
+		{
+			name: "missing file",
+			api: API{
+				ResultFormat:         "binary",
+				ResultEncryptionKeys: []EncryptionKey{{ID: "k", KeyFile: keyFile + ".missing"}},
+			},
+			setting: "app_api.result_encryption_keys[0].key_file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.api.loadEncryptionKeys()
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+			assert.Contains(t, err.Error(), tt.setting)
+		})
+	}
+}
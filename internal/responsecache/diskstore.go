@@ -0,0 +1,288 @@
+package responsecache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tempFilePrefix marks files which are being written, they are not records.
+	tempFilePrefix = "."
+	// hashedFilePrefix marks files named by the hash of their key, whose encoding is too long for a file name.
+	// It is not part of the encoding alphabet, the key is then read from the record.
+	hashedFilePrefix = "~"
+	maxFileName      = 255
+)
+
+// DiskStore keeps the records in files of a local directory, one per key, so they survive restarts of
+// a single instance. Expired records are removed once they are accessed.
+type DiskStore struct {
+	mu  sync.Mutex
+	dir string
+	now func() time.Time
+}
+
+type diskRecord struct {
+	Key       string     `json:"key"`
+	Value     []byte     `json:"value,omitempty"`
+	Chunks    [][]byte   `json:"chunks,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// NewDiskStore returns a store which keeps the records in dir, it is created if it does not exist.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create store directory: %w", err)
+	}
+	return &DiskStore{
+		dir: dir,
+		now: time.Now,
+	}, nil
+}
+
+func (d *DiskStore) Save(_ context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration) error {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.put(key, &diskRecord{Value: data}, ttl)
+}
+
+func (d *DiskStore) SaveNew(_ context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration,
+) (bool, error) {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return false, fmt.Errorf("marshal %s: %w", key, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = d.read(key)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	return true, d.put(key, &diskRecord{Value: data}, ttl)
+}
+
+func (d *DiskStore) SaveExisting(_ context.Context, key string, value encoding.BinaryMarshaler,
+	ttl time.Duration,
+) (bool, error) {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return false, fmt.Errorf("marshal %s: %w", key, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err = d.read(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, d.put(key, &diskRecord{Value: data}, ttl)
+}
+
+func (d *DiskStore) Get(_ context.Context, key string, value encoding.BinaryUnmarshaler) error {
+	d.mu.Lock()
+	record, err := d.read(key)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if record.Chunks != nil {
+		return ErrNotFound
+	}
+	return value.UnmarshalBinary(record.Value)
+}
+
+func (d *DiskStore) Exists(_ context.Context, key string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := d.read(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *DiskStore) Delete(_ context.Context, keys ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (d *DiskStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	record, err := d.read(key)
+	if err != nil {
+		return 0, err
+	}
+	if record.ExpiresAt == nil {
+		return -1, nil
+	}
+	return record.ExpiresAt.Sub(d.now()), nil
+}
+
+// List pages through the keys in lexical order of the file names, cursor is the offset of the page.
+func (d *DiskStore) List(_ context.Context, prefix string, cursor uint64, count int64,
+) ([]Record, uint64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list store directory: %w", err)
+	}
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempFilePrefix) {
+			continue
+		}
+		key, ok := d.fileKey(file.Name())
+		if ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, end, next := page(len(keys), cursor, count)
+	records := make([]Record, 0, end-start)
+	for _, key := range keys[start:end] {
+		record, errRead := d.read(key)
+		if errors.Is(errRead, ErrNotFound) {
+			continue
+		}
+		if errRead != nil {
+			return nil, 0, errRead
+		}
+		if record.Chunks == nil {
+			records = append(records, Record{Key: key, Value: record.Value})
+		}
+	}
+	return records, next, nil
+}
+
+func (d *DiskStore) SaveChunks(_ context.Context, key string, chunks [][]byte, ttl time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.put(key, &diskRecord{Chunks: chunks}, ttl)
+}
+
+func (d *DiskStore) GetChunk(_ context.Context, key string, n int) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	record, err := d.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if n >= len(record.Chunks) {
+		return nil, ErrNotFound
+	}
+	return record.Chunks[n], nil
+}
+
+// path is the file of the key, keys are encoded so that any key is a valid file name.
+func (d *DiskStore) path(key string) string {
+	name := base64.RawURLEncoding.EncodeToString([]byte(key))
+	if len(name) > maxFileName {
+		hash := sha256.Sum256([]byte(key))
+		name = hashedFilePrefix + hex.EncodeToString(hash[:])
+	}
+	return filepath.Join(d.dir, name)
+}
+
+// fileKey returns the key stored in the file. It must be called with mu held.
+func (d *DiskStore) fileKey(name string) (string, bool) {
+	if !strings.HasPrefix(name, hashedFilePrefix) {
+		key, err := base64.RawURLEncoding.DecodeString(name)
+		return string(key), err == nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return "", false
+	}
+	record := new(diskRecord)
+	if err = json.Unmarshal(data, record); err != nil {
+		return "", false
+	}
+	return record.Key, record.Key != ""
+}
+
+// read returns the record of the key, ErrNotFound if it is missing or expired. It must be called with mu held.
+func (d *DiskStore) read(key string) (*diskRecord, error) {
+	data, err := ioutil.ReadFile(d.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", key, err)
+	}
+	record := new(diskRecord)
+	if err = json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", key, err)
+	}
+	if record.ExpiresAt != nil && !d.now().Before(*record.ExpiresAt) {
+		_ = os.Remove(d.path(key))
+		return nil, ErrNotFound
+	}
+	return record, nil
+}
+
+// put replaces the record of the key. The file is written aside and renamed, so readers never see
+// a partial record. It must be called with mu held.
+func (d *DiskStore) put(key string, record *diskRecord, ttl time.Duration) error {
+	switch {
+	case ttl == KeepTTL:
+		if previous, err := d.read(key); err == nil {
+			record.ExpiresAt = previous.ExpiresAt
+		}
+	case ttl > 0:
+		expiresAt := d.now().Add(ttl)
+		record.ExpiresAt = &expiresAt
+	}
+	record.Key = key
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", key, err)
+	}
+	tempFile, err := ioutil.TempFile(d.dir, tempFilePrefix)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	defer func() {
+		_ = os.Remove(tempFile.Name())
+	}()
+	if _, err = tempFile.Write(data); err != nil {
+		_ = tempFile.Close()
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	if err = tempFile.Close(); err != nil {
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	if err = os.Rename(tempFile.Name(), d.path(key)); err != nil {
+		return fmt.Errorf("write %s: %w", key, err)
+	}
+	return nil
+}
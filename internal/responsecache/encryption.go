@@ -0,0 +1,206 @@
+package responsecache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// codecSealed is the codec of encrypted responses. The payload is the ID of the key, the nonce and the
+// AES-GCM ciphertext of the response in its own envelope.
+const codecSealed byte = 3
+
+// KeySize is the size of encryption keys, they are AES-256 keys.
+const KeySize = 32
+
+var (
+	ErrInvalidKey = errors.New("invalid encryption key")
+	// ErrUnknownKey is returned for records encrypted with a key which is not configured.
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrDecrypt is returned for records which fail authentication, they were altered or moved to
+	// another key.
+	ErrDecrypt = errors.New("decrypt record failed")
+	// ErrNotEncrypted is returned for records stored in clear by a cache which has keys, unless it allows
+	// plaintext while they are migrated.
+	ErrNotEncrypted = errors.New("record is not encrypted")
+)
+
+// Key is an encryption key and its ID, which is stored with the records it encrypts.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Keyring encrypts records with its primary key and decrypts them with any of its keys, so keys can be
+// rotated: a new key is added as the primary one and the previous keys are kept until the records they
+// encrypt expire.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring with the keys, the first one is the primary key.
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKey)
+	}
+	keyring := &Keyring{
+		primary: keys[0].ID,
+		aeads:   make(map[string]cipher.AEAD, len(keys)),
+	}
+	for _, key := range keys {
+		if key.ID == "" || len(key.ID) > math.MaxUint8 {
+			return nil, fmt.Errorf("%w: the ID must have 1 to %d bytes", ErrInvalidKey, math.MaxUint8)
+		}
+		if _, ok := keyring.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("%w: duplicate ID %q", ErrInvalidKey, key.ID)
+		}
+		if len(key.Secret) != KeySize {
+			return nil, fmt.Errorf("%w: key %q must have %d bytes", ErrInvalidKey, key.ID, KeySize)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %s", ErrInvalidKey, key.ID, err.Error())
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %q: %s", ErrInvalidKey, key.ID, err.Error())
+		}
+		keyring.aeads[key.ID] = aead
+	}
+	return keyring, nil
+}
+
+// seal appends the key ID, the nonce and the ciphertext of plaintext to header. The header, the key ID
+// and recordKey are authenticated, so a record can not be moved to another key.
+func (r *Keyring) seal(header, plaintext []byte, recordKey string) ([]byte, error) {
+	aead := r.aeads[r.primary]
+	sealed := make([]byte, 0, len(header)+1+len(r.primary)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	sealed = append(sealed, header...)
+	sealed = append(sealed, byte(len(r.primary)))
+	sealed = append(sealed, r.primary...)
+	aad := append(append([]byte(nil), sealed...), recordKey...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, aad), nil
+}
+
+// open returns the plaintext of a record sealed after a header of headerSize bytes.
+func (r *Keyring) open(sealed []byte, headerSize int, recordKey string) ([]byte, error) {
+	if len(sealed) <= headerSize {
+		return nil, fmt.Errorf("%w: truncated record", ErrDecrypt)
+	}
+	idEnd := headerSize + 1 + int(sealed[headerSize])
+	if len(sealed) < idEnd {
+		return nil, fmt.Errorf("%w: truncated record", ErrDecrypt)
+	}
+	id := string(sealed[headerSize+1 : idEnd])
+	if r == nil {
+		return nil, fmt.Errorf("%w: %q, encryption is not configured", ErrUnknownKey, id)
+	}
+	aead, ok := r.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	if len(sealed) < idEnd+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated record", ErrDecrypt)
+	}
+	aad := append(append([]byte(nil), sealed[:idEnd]...), recordKey...)
+	nonce, ciphertext := sealed[idEnd:idEnd+aead.NonceSize()], sealed[idEnd+aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q", ErrDecrypt, id)
+	}
+	return plaintext, nil
+}
+
+// sealResponse returns resp encrypted in an envelope for the record recordKey.
+func (c *Cache) sealResponse(resp *HTTPResponse, recordKey string) ([]byte, error) {
+	plaintext, err := resp.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(envelopeMagic), envelopeVersion, codecSealed)
+	return c.Keys.seal(header, plaintext, recordKey)
+}
+
+// decodeResponse reads a response stored under recordKey into resp. Encrypted responses which can not be
+// decrypted are errors, they are never read as missing, and so are responses stored in clear when the cache
+// has keys.
+func (c *Cache) decodeResponse(data []byte, recordKey string, resp *HTTPResponse) error {
+	if !isEnvelope(data) || len(data) < envelopeHeader || data[len(envelopeMagic)+1] != codecSealed {
+		if !c.plaintextAllowed() {
+			return fmt.Errorf("%w: response %s", ErrNotEncrypted, recordKey)
+		}
+		return resp.UnmarshalBinary(data)
+	}
+	plaintext, err := c.Keys.open(data, envelopeHeader, recordKey)
+	if err != nil {
+		return err
+	}
+	return resp.UnmarshalBinary(plaintext)
+}
+
+// sealedResponse saves a response encrypted.
+type sealedResponse struct {
+	c         *Cache
+	resp      *HTTPResponse
+	recordKey string
+}
+
+func (s sealedResponse) MarshalBinary() ([]byte, error) {
+	return s.c.sealResponse(s.resp, s.recordKey)
+}
+
+// chunkKey is the record key authenticated with chunk n of chunksKey.
+func chunkKey(chunksKey string, n int) string {
+	return fmt.Sprintf("%s/%d", chunksKey, n)
+}
+
+// plaintextAllowed reports whether records stored in clear are read.
+func (c *Cache) plaintextAllowed() bool {
+	return c.Keys == nil || c.AllowPlaintext
+}
+
+// storedBodyKey is the record key authenticated with the body of the stored request id.
+func storedBodyKey(id string) string {
+	return "stored-body:" + id
+}
+
+// sealRequest returns req with its body encrypted if the cache has keys, req is not changed.
+func (c *Cache) sealRequest(req *StoredRequest) (*StoredRequest, error) {
+	if c.Keys == nil {
+		return req, nil
+	}
+	sealed, err := c.Keys.seal(nil, req.Body, storedBodyKey(req.ID))
+	if err != nil {
+		return nil, err
+	}
+	stored := *req
+	stored.Body, stored.SealedBody = nil, sealed
+	return &stored, nil
+}
+
+// OpenStoredRequest decrypts the body of a request read from the schedule or the queue. A request stored in
+// clear is an error when the cache has keys.
+func OpenStoredRequest(c *Cache, req *StoredRequest) error {
+	if req.SealedBody == nil {
+		if !c.plaintextAllowed() {
+			return fmt.Errorf("%w: stored request %s", ErrNotEncrypted, req.ID)
+		}
+		return nil
+	}
+	body, err := c.Keys.open(req.SealedBody, 0, storedBodyKey(req.ID))
+	if err != nil {
+		return err
+	}
+	req.Body, req.SealedBody = body, nil
+	return nil
+}
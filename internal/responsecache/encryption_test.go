@@ -0,0 +1,253 @@
+package responsecache
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+// storedRecord saves the bytes as they are.
+type storedRecord []byte
+
+func (s storedRecord) MarshalBinary() ([]byte, error) {
+	return s, nil
+}
+
+func testKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	keys := make([]Key, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, Key{ID: id, Secret: bytes.Repeat([]byte(id[:1]), KeySize)})
+	}
+	keyring, err := NewKeyring(keys...)
+	assert.NoError(t, err)
+	return keyring
+}
+
+func TestNewKeyring(t *testing.T) {
+	_, err := NewKeyring()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = NewKeyring(Key{ID: "short", Secret: make([]byte, 16)})
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = NewKeyring(Key{ID: "k1", Secret: make([]byte, KeySize)}, Key{ID: "k1", Secret: make([]byte, KeySize)})
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestGetResponse_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	resp := &HTTPResponse{Code: http.StatusOK, Body: []byte("user name and order label")}
+	previous := &Cache{Store: store, Keys: testKeyring(t, "2022-01")}
+	assert.NoError(t, SaveResponse(ctx, previous, "uniq_id", resp, 0))
+
+	var raw rawRecord
+	assert.NoError(t, store.Get(ctx, "uniq_id", &raw))
+	assert.NotContains(t, string(raw), "user name")
+
+	// the key was rotated, the previous key still decrypts
+	rotated := &Cache{Store: store, Keys: testKeyring(t, "2022-06", "2022-01")}
+	got, err := GetResponse(ctx, rotated, "uniq_id")
+	assert.NoError(t, err)
+	assert.Equal(t, resp, got)
+
+	_, err = GetResponse(ctx, &Cache{Store: store, Keys: testKeyring(t, "2022-06")}, "uniq_id")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	_, err = GetResponse(ctx, &Cache{Store: store}, "uniq_id")
+	assert.ErrorIs(t, err, ErrUnknownKey, "encrypted responses are not read without keys")
+
+	// a response moved to another key fails authentication
+	assert.NoError(t, store.Save(ctx, "other_id", storedRecord(raw), 0))
+	_, err = GetResponse(ctx, rotated, "other_id")
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	raw[len(raw)-1] ^= 1
+	assert.NoError(t, store.Save(ctx, "uniq_id", storedRecord(raw), 0))
+	_, err = GetResponse(ctx, rotated, "uniq_id")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestOpenBody_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	cache := &Cache{
+		Store:   store,
+		Storage: Storage{CompressThreshold: 8, ChunkSize: 16},
+		Keys:    testKeyring(t, "2022-01"),
+	}
+	body := bytes.Repeat([]byte("a long time ago in a galaxy far, far away. "), 10)
+	assert.NoError(t, SaveResponse(ctx, cache, "uniq_id", &HTTPResponse{Code: http.StatusOK, Body: body}, 0))
+
+	resp, err := GetResponse(ctx, cache, "uniq_id")
+	assert.NoError(t, err)
+	assert.True(t, resp.Encrypted)
+	reader, err := OpenBody(ctx, cache, "uniq_id", resp)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, body, got)
+
+	// swapped chunks fail authentication
+	first, err := store.GetChunk(ctx, ChunksKey("uniq_id"), 0)
+	assert.NoError(t, err)
+	second, err := store.GetChunk(ctx, ChunksKey("uniq_id"), 1)
+	assert.NoError(t, err)
+	assert.NoError(t, store.SaveChunks(ctx, ChunksKey("uniq_id"), [][]byte{second, first}, 0))
+	reader, err = OpenBody(ctx, cache, "uniq_id", resp)
+	if err == nil {
+		_, err = ioutil.ReadAll(reader)
+	}
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestIdempotencyRecord_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	cache := &Cache{Store: store, Keys: testKeyring(t, "2022-01")}
+	record := &IdempotencyRecord{
+		Fingerprint: "abc",
+		Response:    &HTTPResponse{Code: http.StatusOK, Body: []byte("secret")},
+	}
+
+	assert.NoError(t, SaveIdempotencyRecord(ctx, cache, "key", record, 0))
+
+	assert.NotNil(t, record.Response, "the record of the caller is not changed")
+	var raw rawRecord
+	assert.NoError(t, store.Get(ctx, IdempotencyKey("key"), &raw))
+	assert.NotContains(t, string(raw), "c2VjcmV0", "the body is not stored in clear")
+	got, err := GetIdempotencyRecord(ctx, cache, "key")
+	assert.NoError(t, err)
+	assert.Equal(t, record, got)
+}
+
+func TestGetResponse_Plaintext(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	assert.NoError(t, SaveResponse(ctx, &Cache{Store: store}, "uniq_id", &HTTPResponse{Code: http.StatusOK}, 0))
+	assert.NoError(t, SaveIdempotencyRecord(ctx, &Cache{Store: store}, "key", &IdempotencyRecord{
+		Response: &HTTPResponse{Code: http.StatusOK},
+	}, 0))
+	cache := &Cache{Store: store, Keys: testKeyring(t, "2022-01")}
+
+	_, err := GetResponse(ctx, cache, "uniq_id")
+	assert.ErrorIs(t, err, ErrNotEncrypted, "a response stored in clear is refused")
+	_, err = GetIdempotencyRecord(ctx, cache, "key")
+	assert.ErrorIs(t, err, ErrNotEncrypted)
+
+	cache.AllowPlaintext = true
+	resp, err := GetResponse(ctx, cache, "uniq_id")
+	assert.NoError(t, err, "it is read while it is migrated")
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestOpenStoredRequest(t *testing.T) {
+	cache := &Cache{Keys: testKeyring(t, "2022-01")}
+	req := &StoredRequest{ID: "uniq_id", Body: []byte(`{"name":"John"}`)}
+
+	sealed, err := cache.sealRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"John"}`, string(req.Body), "the request of the caller is not changed")
+	assert.Nil(t, sealed.Body)
+	raw, err := sealed.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "John")
+
+	stored := new(StoredRequest)
+	assert.NoError(t, stored.UnmarshalBinary(raw))
+	assert.NoError(t, OpenStoredRequest(cache, stored))
+	assert.Equal(t, req, stored)
+
+	assert.ErrorIs(t, OpenStoredRequest(cache, &StoredRequest{ID: "uniq_id", Body: []byte("{}")}), ErrNotEncrypted)
+	moved := *sealed
+	moved.ID = "other_id"
+	assert.ErrorIs(t, OpenStoredRequest(cache, &moved), ErrDecrypt)
+}
+
+func TestOpenEvent(t *testing.T) {
+	ctx := context.Background()
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{Client: redisClient, Keys: testKeyring(t, "2022-01")}
+	event := &Event{
+		Type:         EventCompleted,
+		BackgroundID: "uniq_id",
+		Response:     &HTTPResponse{Code: http.StatusOK, Body: []byte("secret")},
+	}
+	var published []byte
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		data, err := actual[2].(encoding.BinaryMarshaler).MarshalBinary()
+		published = data
+		return err
+	}).ExpectPublish(EventChannel("uniq_id"), nil).SetVal(1)
+
+	assert.NoError(t, PublishEvent(ctx, cache, event))
+	assert.NotContains(t, string(published), "c2VjcmV0", "the body is not sent in clear")
+	assert.NotNil(t, event.Response, "the event of the caller is not changed")
+
+	received := new(Event)
+	assert.NoError(t, received.UnmarshalBinary(published))
+	assert.NoError(t, OpenEvent(cache, received))
+	assert.Equal(t, event, received)
+
+	assert.ErrorIs(t, OpenEvent(cache, &Event{BackgroundID: "uniq_id", Response: &HTTPResponse{}}), ErrNotEncrypted)
+}
+
+func TestMigrateResponses_Encrypt(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	cache := &Cache{Store: store, Format: FormatBinary, Keys: testKeyring(t, "2022-01")}
+	plain := &Cache{Store: store, Storage: Storage{CompressThreshold: 8, ChunkSize: 16}}
+	body := bytes.Repeat([]byte("a long time ago in a galaxy far, far away. "), 10)
+	assert.NoError(t, SaveJob(ctx, cache, &Job{ID: "uniq_id", Status: JobSucceeded}, 0))
+	assert.NoError(t, SaveResponse(ctx, plain, "uniq_id", &HTTPResponse{Code: http.StatusOK}, 0))
+	assert.NoError(t, SaveJob(ctx, cache, &Job{ID: "chunked_id", Status: JobSucceeded}, 0))
+	assert.NoError(t, SaveResponse(ctx, plain, "chunked_id", &HTTPResponse{Code: http.StatusOK, Body: body}, 0))
+
+	_, err := MigrateResponses(ctx, cache)
+	assert.ErrorIs(t, err, ErrNotEncrypted, "responses stored in clear are read only when allowed")
+
+	cache.AllowPlaintext = true
+	migrated, err := MigrateResponses(ctx, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+	_, err = GetResponse(ctx, &Cache{Store: store}, "uniq_id")
+	assert.ErrorIs(t, err, ErrUnknownKey, "the response is encrypted")
+
+	cache.AllowPlaintext = false
+	resp, err := GetResponse(ctx, cache, "chunked_id")
+	assert.NoError(t, err)
+	reader, err := OpenBody(ctx, cache, "chunked_id", resp)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err, "the chunks are encrypted")
+	assert.Equal(t, body, got)
+
+	migrated, err = MigrateResponses(ctx, cache)
+	assert.NoError(t, err)
+	assert.Zero(t, migrated)
+}
+
+func TestMigrateScheduledRequests(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	req := &StoredRequest{ID: "uniq_id", Body: []byte(`{"name":"John"}`)}
+	assert.NoError(t, store.Save(ctx, ScheduledRequestKey("uniq_id"), req, 0))
+	cache := &Cache{Store: store, Keys: testKeyring(t, "2022-01")}
+
+	migrated, err := MigrateScheduledRequests(ctx, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+	stored := new(StoredRequest)
+	assert.NoError(t, store.Get(ctx, ScheduledRequestKey("uniq_id"), stored))
+	assert.Nil(t, stored.Body, "the body is encrypted")
+	assert.NoError(t, OpenStoredRequest(cache, stored))
+	assert.Equal(t, req, stored)
+
+	migrated, err = MigrateScheduledRequests(ctx, cache)
+	assert.NoError(t, err)
+	assert.Zero(t, migrated)
+}
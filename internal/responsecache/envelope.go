@@ -0,0 +1,363 @@
+package responsecache
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Stored responses are wrapped in an envelope: envelopeMagic, the version of the format and the codec of
+// the payload. Responses written before the envelope are plain JSON, they are read as version 0.
+const (
+	// envelopeMagic starts with a NUL byte, which never starts a JSON document.
+	envelopeMagic   = "\x00rc"
+	envelopeVersion = 1
+	envelopeHeader  = len(envelopeMagic) + 2
+)
+
+// Codecs of the envelope payload.
+const (
+	codecProto byte = 1
+	codecJSON  byte = 2
+)
+
+// Fields of the protobuf wire encoding of HTTPResponse. Numbers are never reused, readers skip the fields
+// they do not know, so fields may be added without a new version.
+const (
+	fieldCode      protowire.Number = 1
+	fieldHeader    protowire.Number = 2
+	fieldBody      protowire.Number = 3
+	fieldOwner     protowire.Number = 4
+	fieldEncoding  protowire.Number = 5
+	fieldChunks    protowire.Number = 6
+	fieldSize      protowire.Number = 7
+	fieldEncrypted protowire.Number = 8
+
+	fieldHeaderName  protowire.Number = 1
+	fieldHeaderValue protowire.Number = 2
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported response format version")
+	ErrInvalidResponse    = errors.New("invalid stored response")
+)
+
+// ResponseFormat is how responses are written. Every format is read regardless of it.
+type ResponseFormat string
+
+const (
+	// FormatBinary writes the current envelope with the binary codec. It is set once no replica released
+	// before the envelope is left.
+	FormatBinary ResponseFormat = "binary"
+	// FormatJSON writes plain JSON, which replicas released before the envelope can read. It is the format
+	// of a Cache without one, so that rolling deploys from those releases keep their results readable.
+	FormatJSON ResponseFormat = "json"
+)
+
+var ErrInvalidResponseFormat = errors.New("invalid response format")
+
+// ParseResponseFormat returns the format named by raw. An empty format is FormatJSON, so that a deploy
+// from a release without the envelope keeps writing results those replicas read.
+func ParseResponseFormat(raw string) (ResponseFormat, error) {
+	switch format := ResponseFormat(raw); format {
+	case "":
+		return FormatJSON, nil
+	case FormatBinary, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidResponseFormat, raw)
+	}
+}
+
+// migrateBatch is how many jobs MigrateResponses scans at once.
+const migrateBatch = 100
+
+// legacyResponse writes the response as plain JSON.
+type legacyResponse struct {
+	*HTTPResponse
+}
+
+func (l legacyResponse) MarshalBinary() ([]byte, error) {
+	return json.Marshal(l.HTTPResponse)
+}
+
+// encodeResponse returns resp as it is saved under k in the format of the cache, encrypted if the cache
+// has keys.
+func (c *Cache) encodeResponse(k string, resp *HTTPResponse) encoding.BinaryMarshaler {
+	if c.Keys != nil {
+		return sealedResponse{c: c, resp: resp, recordKey: k}
+	}
+	if c.Format != FormatBinary {
+		return legacyResponse{resp}
+	}
+	return resp
+}
+
+// MarshalBinary writes the response in the current envelope with the binary codec.
+func (h *HTTPResponse) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 0, envelopeHeader+len(h.Body)+64)
+	data = append(data, envelopeMagic...)
+	data = append(data, envelopeVersion, codecProto)
+	return h.appendProto(data), nil
+}
+
+// UnmarshalBinary reads a response of any version up to the current one.
+func (h *HTTPResponse) UnmarshalBinary(data []byte) error {
+	if !isEnvelope(data) {
+		return json.Unmarshal(data, h)
+	}
+	if len(data) < envelopeHeader {
+		return fmt.Errorf("%w: truncated envelope", ErrInvalidResponse)
+	}
+	version, codec, payload := data[len(envelopeMagic)], data[len(envelopeMagic)+1], data[envelopeHeader:]
+	if version > envelopeVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	switch codec {
+	case codecProto:
+		return h.consumeProto(payload)
+	case codecJSON:
+		return json.Unmarshal(payload, h)
+	case codecSealed:
+		return fmt.Errorf("%w: the response is encrypted", ErrUnknownKey)
+	default:
+		return fmt.Errorf("%w: unknown codec %d", ErrInvalidResponse, codec)
+	}
+}
+
+func isEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(envelopeMagic))
+}
+
+func (h *HTTPResponse) appendProto(b []byte) []byte {
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, fieldCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	names := make([]string, 0, len(h.Headers))
+	for name := range h.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		header := protowire.AppendTag(nil, fieldHeaderName, protowire.BytesType)
+		header = protowire.AppendString(header, name)
+		for _, value := range h.Headers[name] {
+			header = protowire.AppendTag(header, fieldHeaderValue, protowire.BytesType)
+			header = protowire.AppendString(header, value)
+		}
+		b = protowire.AppendTag(b, fieldHeader, protowire.BytesType)
+		b = protowire.AppendBytes(b, header)
+	}
+	if len(h.Body) > 0 {
+		b = protowire.AppendTag(b, fieldBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, h.Body)
+	}
+	for _, field := range []struct {
+		num   protowire.Number
+		value string
+	}{{fieldOwner, h.Owner}, {fieldEncoding, h.Encoding}} {
+		if field.value != "" {
+			b = protowire.AppendTag(b, field.num, protowire.BytesType)
+			b = protowire.AppendString(b, field.value)
+		}
+	}
+	if h.Chunks != 0 {
+		b = protowire.AppendTag(b, fieldChunks, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Chunks))
+	}
+	if h.Size != 0 {
+		b = protowire.AppendTag(b, fieldSize, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Size))
+	}
+	if h.Encrypted {
+		b = protowire.AppendTag(b, fieldEncrypted, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(h.Encrypted))
+	}
+	return b
+}
+
+func (h *HTTPResponse) consumeProto(b []byte) error {
+	*h = HTTPResponse{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidResponse, protowire.ParseError(n))
+		}
+		b = b[n:]
+		var (
+			value []byte
+			raw   uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			raw, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %s", ErrInvalidResponse, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case fieldCode:
+			h.Code = int(raw)
+		case fieldHeader:
+			name, values, err := consumeHeader(value)
+			if err != nil {
+				return err
+			}
+			if h.Headers == nil {
+				h.Headers = make(http.Header)
+			}
+			h.Headers[name] = append(h.Headers[name], values...)
+		case fieldBody:
+			h.Body = append([]byte(nil), value...)
+		case fieldOwner:
+			h.Owner = string(value)
+		case fieldEncoding:
+			h.Encoding = string(value)
+		case fieldChunks:
+			h.Chunks = int(raw)
+		case fieldSize:
+			h.Size = int(raw)
+		case fieldEncrypted:
+			h.Encrypted = protowire.DecodeBool(raw)
+		}
+	}
+	return nil
+}
+
+func consumeHeader(b []byte) (string, []string, error) {
+	var (
+		name   string
+		values []string
+	)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", nil, fmt.Errorf("%w: header: %s", ErrInvalidResponse, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", nil, fmt.Errorf("%w: header: %s", ErrInvalidResponse, protowire.ParseError(n))
+			}
+			b = b[n:]
+			continue
+		}
+		value, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return "", nil, fmt.Errorf("%w: header: %s", ErrInvalidResponse, protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch num {
+		case fieldHeaderName:
+			name = value
+		case fieldHeaderValue:
+			values = append(values, value)
+		}
+	}
+	return name, values, nil
+}
+
+// rawRecord keeps a record as it is stored.
+type rawRecord []byte
+
+func (r *rawRecord) UnmarshalBinary(data []byte) error {
+	*r = append((*r)[:0], data...)
+	return nil
+}
+
+// MigrateResponses rewrites the responses of the jobs which are stored as plain JSON in the binary envelope,
+// and encrypts the responses stored in clear with their body chunks if the cache has keys, keeping their
+// expiration. It returns the number of rewritten responses. Responses which are removed meanwhile are not
+// written again. The cache must write FormatBinary and allow plaintext to read the responses stored in clear.
+func MigrateResponses(ctx context.Context, c *Cache) (int, error) {
+	if c.Format != FormatBinary {
+		return 0, fmt.Errorf("%w: responses are migrated to %s, not %q", ErrInvalidResponseFormat, FormatBinary,
+			c.Format)
+	}
+	var (
+		migrated int
+		cursor   uint64
+	)
+	for {
+		jobs, next, err := ScanJobs(ctx, c, cursor, migrateBatch)
+		if err != nil {
+			return migrated, err
+		}
+		for _, job := range jobs {
+			ok, errMigrate := migrateResponse(ctx, c, job.ID)
+			if errMigrate != nil {
+				return migrated, errMigrate
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if next == 0 {
+			return migrated, nil
+		}
+		cursor = next
+	}
+}
+
+func migrateResponse(ctx context.Context, c *Cache, k string) (bool, error) {
+	var raw rawRecord
+	err := c.store().Get(ctx, k, &raw)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sealed := isEnvelope(raw) && len(raw) >= envelopeHeader && raw[len(envelopeMagic)+1] == codecSealed
+	if sealed || (isEnvelope(raw) && c.Keys == nil) {
+		return false, nil
+	}
+	resp := new(HTTPResponse)
+	if err = c.decodeResponse(raw, k, resp); err != nil {
+		return false, fmt.Errorf("decode response %s: %w", k, err)
+	}
+	if c.Keys != nil && resp.Chunks > 0 && !resp.Encrypted {
+		if err = sealChunks(ctx, c, k, resp.Chunks); err != nil {
+			return false, fmt.Errorf("encrypt chunks of %s: %w", k, err)
+		}
+		resp.Encrypted = true
+	}
+	return c.store().SaveExisting(ctx, k, c.encodeResponse(k, resp), KeepTTL)
+}
+
+// sealChunks encrypts the body chunks of the response stored in clear under k, keeping their expiration.
+func sealChunks(ctx context.Context, c *Cache, k string, count int) error {
+	ttl, err := c.store().TTL(ctx, ChunksKey(k))
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	chunks := make([][]byte, 0, count)
+	for n := 0; n < count; n++ {
+		chunk, errChunk := c.store().GetChunk(ctx, ChunksKey(k), n)
+		if errChunk != nil {
+			return errChunk
+		}
+		if chunk, errChunk = c.Keys.seal(nil, chunk, chunkKey(ChunksKey(k), n)); errChunk != nil {
+			return errChunk
+		}
+		chunks = append(chunks, chunk)
+	}
+	return c.store().SaveChunks(ctx, ChunksKey(k), chunks, ttl)
+}
@@ -0,0 +1,125 @@
+package responsecache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestHTTPResponse_Envelope(t *testing.T) {
+	resp := &HTTPResponse{
+		Code:     http.StatusCreated,
+		Headers:  http.Header{"Content-Type": {"application/json"}, "X-Multi": {"a", "b"}},
+		Body:     []byte(`{"id":1}`),
+		Owner:    "user-1",
+		Encoding: encodingGzip,
+		Chunks:   3,
+		Size:     1500,
+	}
+
+	data, err := resp.MarshalBinary()
+	assert.NoError(t, err)
+	assert.True(t, isEnvelope(data))
+	legacy, err := json.Marshal(resp)
+	assert.NoError(t, err)
+	assert.Less(t, len(data), len(legacy), "the binary codec is more compact than JSON")
+
+	got := new(HTTPResponse)
+	assert.NoError(t, got.UnmarshalBinary(data))
+	assert.Equal(t, resp, got)
+}
+
+func TestHTTPResponse_UnmarshalBinary(t *testing.T) {
+	envelope := func(version, codec byte, payload []byte) []byte {
+		return append([]byte{0, 'r', 'c', version, codec}, payload...)
+	}
+	unknownField := protowire.AppendTag(nil, 99, protowire.BytesType)
+	unknownField = protowire.AppendString(unknownField, "added later")
+	code := protowire.AppendTag(nil, fieldCode, protowire.VarintType)
+	code = protowire.AppendVarint(code, http.StatusOK)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected *HTTPResponse
+		err      error
+	}{
+		{
+			name:     "legacy json",
+			data:     []byte(`{"code":200,"headers":null,"body":"b2s="}`),
+			expected: &HTTPResponse{Code: http.StatusOK, Body: []byte("ok")},
+		},
+		{
+			name:     "json codec",
+			data:     envelope(1, codecJSON, []byte(`{"code":200}`)),
+			expected: &HTTPResponse{Code: http.StatusOK},
+		},
+		{
+			name:     "unknown field",
+			data:     envelope(1, codecProto, append(unknownField, code...)),
+			expected: &HTTPResponse{Code: http.StatusOK},
+		},
+		{name: "newer version", data: envelope(2, codecProto, code), err: ErrUnsupportedVersion},
+		{name: "unknown codec", data: envelope(1, 9, code), err: ErrInvalidResponse},
+		{name: "truncated", data: envelope(1, codecProto, code[:1]), err: ErrInvalidResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := new(HTTPResponse)
+			err := got.UnmarshalBinary(tt.data)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestSaveResponse_FormatJSON(t *testing.T) {
+	ctx := context.Background()
+	for _, format := range []ResponseFormat{FormatJSON, ""} {
+		store := NewMemoryStore(0)
+		cache := &Cache{Store: store, Format: format}
+
+		assert.NoError(t, SaveResponse(ctx, cache, "uniq_id", &HTTPResponse{Code: http.StatusOK}, 0))
+
+		var raw rawRecord
+		assert.NoError(t, store.Get(ctx, "uniq_id", &raw))
+		assert.JSONEq(t, `{"code":200,"headers":null,"body":null}`, string(raw), "format %q", format)
+	}
+}
+
+func TestMigrateResponses(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	legacy := &Cache{Store: store, Format: FormatJSON}
+	cache := &Cache{Store: store, Format: FormatBinary}
+	_, err := MigrateResponses(ctx, legacy)
+	assert.ErrorIs(t, err, ErrInvalidResponseFormat, "responses are migrated to the binary format")
+	for _, id := range []string{"legacy", "current", "consumed"} {
+		assert.NoError(t, SaveJob(ctx, cache, &Job{ID: id, Status: JobSucceeded}, 0))
+	}
+	assert.NoError(t, SaveResponse(ctx, legacy, "legacy", &HTTPResponse{Code: http.StatusOK}, time.Hour))
+	assert.NoError(t, SaveResponse(ctx, cache, "current", &HTTPResponse{Code: http.StatusOK}, time.Hour))
+
+	migrated, err := MigrateResponses(ctx, cache)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+	var raw rawRecord
+	assert.NoError(t, store.Get(ctx, "legacy", &raw))
+	assert.True(t, isEnvelope(raw))
+	ttl, err := store.TTL(ctx, "legacy")
+	assert.NoError(t, err)
+	assert.Greater(t, ttl, time.Duration(0), "the expiration is kept")
+	exists, err := store.Exists(ctx, "consumed")
+	assert.NoError(t, err)
+	assert.False(t, exists, "missing responses are not written")
+}
@@ -0,0 +1,100 @@
+package responsecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const eventChannelPrefix = "bg-events:"
+
+type EventType string
+
+const (
+	// EventStatus is a snapshot of the job sent to a new subscriber.
+	EventStatus   EventType = "status"
+	EventAccepted EventType = "accepted"
+	EventRunning  EventType = "running"
+	// EventProgress is published by handlers, Stage describes the step they reached.
+	EventProgress EventType = "progress"
+	// EventRetrying is published when a failed attempt is going to be retried.
+	EventRetrying  EventType = "retrying"
+	EventCompleted EventType = "completed"
+)
+
+// Event is a state change of a background job.
+type Event struct {
+	Type         EventType     `json:"type"`
+	BackgroundID string        `json:"background_id"`
+	Time         time.Time     `json:"time"`
+	Stage        string        `json:"stage,omitempty"`
+	Job          *Job          `json:"job,omitempty"`
+	Response     *HTTPResponse `json:"response,omitempty"`
+	// SealedResponse holds Response encrypted when the cache has keys, see OpenEvent.
+	SealedResponse []byte `json:"sealed_response,omitempty"`
+}
+
+func (e *Event) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, e)
+}
+
+func (e *Event) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(e)
+}
+
+// EventChannel is the pub/sub channel with events of the job id.
+func EventChannel(id string) string {
+	return eventChannelPrefix + id
+}
+
+// PublishEvent sends the event to subscribers of all instances, its response is encrypted if the cache has
+// keys. It does nothing when the cache does not use Redis, there are no subscribers then.
+func PublishEvent(ctx context.Context, c *Cache, event *Event) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return nil
+	}
+	if c.Keys != nil && event.Response != nil {
+		sealed, errSeal := c.sealResponse(event.Response, EventChannel(event.BackgroundID))
+		if errSeal != nil {
+			return errSeal
+		}
+		published := *event
+		published.Response, published.SealedResponse = nil, sealed
+		event = &published
+	}
+	return client.Publish(ctx, EventChannel(event.BackgroundID), event).Err()
+}
+
+// OpenEvent decrypts the response of a received event. A response sent in clear is an error when the cache
+// has keys.
+func OpenEvent(c *Cache, event *Event) error {
+	if event.SealedResponse == nil {
+		if event.Response != nil && !c.plaintextAllowed() {
+			return fmt.Errorf("%w: event of %s", ErrNotEncrypted, event.BackgroundID)
+		}
+		return nil
+	}
+	event.Response = new(HTTPResponse)
+	err := c.decodeResponse(event.SealedResponse, EventChannel(event.BackgroundID), event.Response)
+	event.SealedResponse = nil
+	return err
+}
+
+// SubscribeEvents subscribes to events of the job id. The subscription is confirmed on return,
+// so events published after it are not missed. It returns ErrNotSupported when the cache does not use Redis.
+func SubscribeEvents(ctx context.Context, c *Cache, id string) (*redis.PubSub, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return nil, err
+	}
+	pubsub := client.Subscribe(ctx, EventChannel(id))
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+	return pubsub, nil
+}
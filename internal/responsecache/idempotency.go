@@ -0,0 +1,83 @@
+package responsecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const idempotencyKeyPrefix = "idempotency:"
+
+// IdempotencyRecord is the outcome of the first request made with an Idempotency-Key.
+// A record without Response and BackgroundID belongs to a request which is still in progress.
+type IdempotencyRecord struct {
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"created_at"`
+	// BackgroundID and Retention are set once the request was detached into the background.
+	BackgroundID string        `json:"background_id,omitempty"`
+	Retention    time.Duration `json:"retention,omitempty"`
+	// Response is the response replayed for retries.
+	Response *HTTPResponse `json:"response,omitempty"`
+	// SealedResponse holds Response encrypted when the cache has keys.
+	SealedResponse []byte `json:"sealed_response,omitempty"`
+}
+
+func (i *IdempotencyRecord) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, i)
+}
+
+func (i *IdempotencyRecord) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(i)
+}
+
+func IdempotencyKey(key string) string {
+	return idempotencyKeyPrefix + key
+}
+
+// ReserveIdempotencyKey stores the record unless the key is already used. It reports whether the record was stored.
+func ReserveIdempotencyKey(ctx context.Context, c *Cache, key string, record *IdempotencyRecord,
+	ttl time.Duration,
+) (bool, error) {
+	return c.store().SaveNew(ctx, IdempotencyKey(key), record, ttl)
+}
+
+// SaveIdempotencyRecord overwrites the record of the key. The key expires after ttl, zero ttl keeps it forever.
+func SaveIdempotencyRecord(ctx context.Context, c *Cache, key string, record *IdempotencyRecord,
+	ttl time.Duration,
+) error {
+	if c.Keys != nil && record.Response != nil {
+		sealed, err := c.sealResponse(record.Response, IdempotencyKey(key))
+		if err != nil {
+			return err
+		}
+		stored := *record
+		stored.Response, stored.SealedResponse = nil, sealed
+		record = &stored
+	}
+	return c.store().Save(ctx, IdempotencyKey(key), record, ttl)
+}
+
+// GetIdempotencyRecord returns the record of the key. A response stored in clear is an error when the cache
+// has keys.
+func GetIdempotencyRecord(ctx context.Context, c *Cache, key string) (*IdempotencyRecord, error) {
+	record := new(IdempotencyRecord)
+	err := c.store().Get(ctx, IdempotencyKey(key), record)
+	if err != nil {
+		return record, err
+	}
+	if record.SealedResponse == nil {
+		if record.Response != nil && !c.plaintextAllowed() {
+			return record, fmt.Errorf("%w: idempotency record %s", ErrNotEncrypted, key)
+		}
+		return record, nil
+	}
+	record.Response = new(HTTPResponse)
+	err = c.decodeResponse(record.SealedResponse, IdempotencyKey(key), record.Response)
+	record.SealedResponse = nil
+	return record, err
+}
+
+func DeleteIdempotencyRecord(ctx context.Context, c *Cache, key string) error {
+	return c.store().Delete(ctx, IdempotencyKey(key))
+}
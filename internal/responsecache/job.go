@@ -0,0 +1,196 @@
+package responsecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	jobKeyPrefix    = "job:"
+	cancelKeyPrefix = "cancel:"
+)
+
+type JobStatus string
+
+const (
+	// JobScheduled is a job which waits for the time it was scheduled at.
+	JobScheduled JobStatus = "scheduled"
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+	// JobInterrupted is a job which was stopped by the server shutdown.
+	JobInterrupted JobStatus = "interrupted"
+)
+
+// Finished reports whether the job is in a final state.
+func (s JobStatus) Finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCancelled || s == JobInterrupted
+}
+
+// Job describes a request which was detached into the background.
+type Job struct {
+	ID         string     `json:"id"`
+	Status     JobStatus  `json:"status"`
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	Code       int        `json:"code,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	// ScheduledAt is the time a scheduled job is due at.
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+	// AcknowledgedAt is set once the client acknowledged the result, it is removed from the cache then.
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	// Owner is the identity of the caller who created the job.
+	Owner string `json:"owner,omitempty"`
+	// TraceID is the trace of the request which created the job.
+	TraceID string `json:"trace_id,omitempty"`
+	// Priority is the x-background-priority class the job was accepted with.
+	Priority string `json:"priority,omitempty"`
+	// Attempts are the executions of the request, there are several when failed executions were retried.
+	Attempts []Attempt `json:"attempts,omitempty"`
+	// Callback is the outcome of the webhook delivery, nil when no callback was requested.
+	Callback *CallbackDelivery `json:"callback,omitempty"`
+}
+
+// Attempt is one execution of a background request.
+type Attempt struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Code       int       `json:"code"`
+	// Error and GRPCCode describe the upstream error reported by the handler.
+	Error    string `json:"error,omitempty"`
+	GRPCCode string `json:"grpc_code,omitempty"`
+}
+
+// CallbackDelivery describes how the result of a job was delivered to the client's webhook.
+type CallbackDelivery struct {
+	URL         string     `json:"url"`
+	Delivered   bool       `json:"delivered"`
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+func (j *Job) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, j)
+}
+
+func (j *Job) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(j)
+}
+
+// JobKey is the key of a job record, its hash tag is the job id.
+func JobKey(id string) string {
+	return jobKeyPrefix + "{" + id + "}"
+}
+
+// SaveJob stores the job record. The key expires after ttl, zero ttl keeps it forever
+// and KeepTTL keeps the current expiration.
+func SaveJob(ctx context.Context, c *Cache, job *Job, ttl time.Duration) error {
+	return c.store().Save(ctx, JobKey(job.ID), job, ttl)
+}
+
+// DeleteJob removes the job record.
+func DeleteJob(ctx context.Context, c *Cache, id string) error {
+	return c.store().Delete(ctx, JobKey(id))
+}
+
+// legacyJobKey is the key of job records written before JobKey got its hash tag.
+func legacyJobKey(id string) string {
+	return jobKeyPrefix + id
+}
+
+// GetJob reads the job record. A record which is only found under its legacy key is moved to JobKey first.
+func GetJob(ctx context.Context, c *Cache, id string) (*Job, error) {
+	job := new(Job)
+	err := c.store().Get(ctx, JobKey(id), job)
+	if errors.Is(err, ErrNotFound) {
+		return getLegacyJob(ctx, c, id)
+	}
+	return job, err
+}
+
+// getLegacyJob reads the job record from its legacy key and moves it to JobKey with its expiration, so that
+// the updates which keep the expiration of the record apply to it.
+func getLegacyJob(ctx context.Context, c *Cache, id string) (*Job, error) {
+	store := c.store()
+	legacyKey := legacyJobKey(id)
+	job := new(Job)
+	if err := store.Get(ctx, legacyKey, job); err != nil {
+		return job, err
+	}
+	ttl, err := store.TTL(ctx, legacyKey)
+	if err != nil {
+		return job, err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	saved, err := store.SaveNew(ctx, JobKey(id), job, ttl)
+	if err != nil {
+		return job, err
+	}
+	if err = store.Delete(ctx, legacyKey); err != nil {
+		return job, err
+	}
+	if !saved {
+		// the job was saved under JobKey meanwhile
+		job = new(Job)
+		err = store.Get(ctx, JobKey(id), job)
+	}
+	return job, err
+}
+
+// CancelRequest asks the process which executes a job to cancel it, the job may run in another process
+// than the one the cancel was requested from.
+type CancelRequest struct {
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+func (r *CancelRequest) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, r)
+}
+
+func (r *CancelRequest) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(r)
+}
+
+// CancelKey is the key of the cancel request of a job, it shares the hash tag of the job record.
+func CancelKey(id string) string {
+	return cancelKeyPrefix + "{" + id + "}"
+}
+
+// RequestCancel records a cancel request for the job, the request expires after ttl.
+func RequestCancel(ctx context.Context, c *Cache, id string, ttl time.Duration) error {
+	return c.store().Save(ctx, CancelKey(id), &CancelRequest{RequestedAt: time.Now().UTC()}, ttl)
+}
+
+// CancelRequested reports whether a cancel was requested for the job.
+func CancelRequested(ctx context.Context, c *Cache, id string) (bool, error) {
+	return c.store().Exists(ctx, CancelKey(id))
+}
+
+// ScanJobs returns a page of job records iterated from cursor. The page may hold fewer than count jobs,
+// the iteration is complete when the returned cursor is zero.
+func ScanJobs(ctx context.Context, c *Cache, cursor uint64, count int64) ([]*Job, uint64, error) {
+	records, next, err := c.store().List(ctx, jobKeyPrefix, cursor, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	jobs := make([]*Job, 0, len(records))
+	for _, record := range records {
+		job := new(Job)
+		if err = job.UnmarshalBinary(record.Value); err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, next, nil
+}
@@ -0,0 +1,39 @@
+package responsecache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJob_Legacy(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryStore(0)
+	store.now = func() time.Time {
+		return now
+	}
+	cache := &Cache{Store: store}
+	legacy := &Job{ID: "uniq_id", Status: JobSucceeded, Owner: "jwt:user"}
+	assert.NoError(t, store.Save(ctx, "job:uniq_id", legacy, time.Hour))
+
+	job, err := GetJob(ctx, cache, "uniq_id")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, job)
+
+	exists, err := store.Exists(ctx, "job:uniq_id")
+	assert.NoError(t, err)
+	assert.False(t, exists, "the legacy record is moved")
+	ttl, err := store.TTL(ctx, JobKey("uniq_id"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, ttl, "the expiration is kept")
+
+	job, err = GetJob(ctx, cache, "uniq_id")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, job)
+
+	_, err = GetJob(ctx, cache, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
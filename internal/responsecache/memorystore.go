@@ -0,0 +1,234 @@
+package responsecache
+
+import (
+	"container/list"
+	"context"
+	"encoding"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the records in the memory of the process, it suits local development and tests.
+// Expired records are removed once they are accessed. When the records exceed the size limit the least
+// recently used ones are evicted.
+type MemoryStore struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	records map[string]*list.Element
+	// lru holds the records from the most recently used one.
+	lru *list.List
+	now func() time.Time
+}
+
+type memoryRecord struct {
+	key       string
+	value     []byte
+	chunks    [][]byte
+	expiresAt time.Time
+}
+
+func (r *memoryRecord) size() int {
+	size := len(r.key) + len(r.value)
+	for _, chunk := range r.chunks {
+		size += len(chunk)
+	}
+	return size
+}
+
+// NewMemoryStore returns a store which holds up to maxSize bytes of keys and values, zero means no limit.
+func NewMemoryStore(maxSize int) *MemoryStore {
+	return &MemoryStore{
+		maxSize: maxSize,
+		records: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryStore) Save(_ context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration) error {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", key, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(&memoryRecord{key: key, value: data}, ttl)
+	return nil
+}
+
+func (m *MemoryStore) SaveNew(_ context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration,
+) (bool, error) {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return false, fmt.Errorf("marshal %s: %w", key, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookup(key) != nil {
+		return false, nil
+	}
+	m.put(&memoryRecord{key: key, value: data}, ttl)
+	return true, nil
+}
+
+func (m *MemoryStore) SaveExisting(_ context.Context, key string, value encoding.BinaryMarshaler,
+	ttl time.Duration,
+) (bool, error) {
+	data, err := value.MarshalBinary()
+	if err != nil {
+		return false, fmt.Errorf("marshal %s: %w", key, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookup(key) == nil {
+		return false, nil
+	}
+	m.put(&memoryRecord{key: key, value: data}, ttl)
+	return true, nil
+}
+
+func (m *MemoryStore) Get(_ context.Context, key string, value encoding.BinaryUnmarshaler) error {
+	m.mu.Lock()
+	record := m.lookup(key)
+	m.mu.Unlock()
+	if record == nil || record.chunks != nil {
+		return ErrNotFound
+	}
+	return value.UnmarshalBinary(record.value)
+}
+
+func (m *MemoryStore) Exists(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lookup(key) != nil, nil
+}
+
+func (m *MemoryStore) Delete(_ context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		if elem, ok := m.records[key]; ok {
+			m.remove(elem)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record := m.lookup(key)
+	if record == nil {
+		return 0, ErrNotFound
+	}
+	if record.expiresAt.IsZero() {
+		return -1, nil
+	}
+	return record.expiresAt.Sub(m.now()), nil
+}
+
+// List pages through the keys in lexical order, cursor is the offset of the page.
+func (m *MemoryStore) List(_ context.Context, prefix string, cursor uint64, count int64,
+) ([]Record, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	matched := make([]*memoryRecord, 0)
+	for key, elem := range m.records {
+		record, _ := elem.Value.(*memoryRecord)
+		expired := !record.expiresAt.IsZero() && !now.Before(record.expiresAt)
+		if strings.HasPrefix(key, prefix) && record.chunks == nil && !expired {
+			matched = append(matched, record)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].key < matched[j].key
+	})
+	start, end, next := page(len(matched), cursor, count)
+	records := make([]Record, 0, end-start)
+	for _, record := range matched[start:end] {
+		records = append(records, Record{Key: record.key, Value: record.value})
+	}
+	return records, next, nil
+}
+
+func (m *MemoryStore) SaveChunks(_ context.Context, key string, chunks [][]byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(&memoryRecord{key: key, chunks: chunks}, ttl)
+	return nil
+}
+
+func (m *MemoryStore) GetChunk(_ context.Context, key string, n int) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record := m.lookup(key)
+	if record == nil || n >= len(record.chunks) {
+		return nil, ErrNotFound
+	}
+	return record.chunks[n], nil
+}
+
+// lookup returns the record of the key, nil if it is missing or expired. It must be called with mu held.
+func (m *MemoryStore) lookup(key string) *memoryRecord {
+	elem, ok := m.records[key]
+	if !ok {
+		return nil
+	}
+	record, _ := elem.Value.(*memoryRecord)
+	if !record.expiresAt.IsZero() && !m.now().Before(record.expiresAt) {
+		m.remove(elem)
+		return nil
+	}
+	m.lru.MoveToFront(elem)
+	return record
+}
+
+// put replaces the record of its key and evicts the least recently used records while the store exceeds
+// its size. It must be called with mu held.
+func (m *MemoryStore) put(record *memoryRecord, ttl time.Duration) {
+	previous := m.lookup(record.key)
+	switch {
+	case ttl == KeepTTL && previous != nil:
+		record.expiresAt = previous.expiresAt
+	case ttl > 0:
+		record.expiresAt = m.now().Add(ttl)
+	}
+	if previous != nil {
+		m.remove(m.records[record.key])
+	}
+	m.records[record.key] = m.lru.PushFront(record)
+	m.size += record.size()
+	for m.maxSize > 0 && m.size > m.maxSize && m.lru.Len() > 1 {
+		m.remove(m.lru.Back())
+	}
+}
+
+// remove drops the record of elem, it must be called with mu held.
+func (m *MemoryStore) remove(elem *list.Element) {
+	record, _ := elem.Value.(*memoryRecord)
+	m.lru.Remove(elem)
+	delete(m.records, record.key)
+	m.size -= record.size()
+}
+
+// page returns the bounds of the page of count items starting at cursor out of total items, and the cursor
+// of the next page, zero if it is the last one.
+func page(total int, cursor uint64, count int64) (int, int, uint64) {
+	start := int(cursor)
+	if start > total {
+		start = total
+	}
+	end := start + int(count)
+	if count <= 0 || end > total {
+		end = total
+	}
+	if end == total {
+		return start, end, 0
+	}
+	return start, end, uint64(end)
+}
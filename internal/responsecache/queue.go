@@ -0,0 +1,276 @@
+package responsecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// queueStreamPrefix prefixes the streams of queued background requests, there is one per priority.
+	// queueGroup is the consumer group of the workers.
+	queueStreamPrefix = "{bg-queue}:"
+	queueGroup        = "bg-workers"
+	queueRequestField = "request"
+	// queuePendingScan limits how many pending entries are inspected when stale ones are claimed.
+	queuePendingScan = 100
+)
+
+var ErrInvalidStreamReply = errors.New("invalid stream reply")
+
+// QueueEntry is a queued request delivered to a worker. Request is nil if the entry can not be decoded,
+// such entries are acknowledged without being executed. The body of Request is opened with OpenStoredRequest.
+type QueueEntry struct {
+	ID       string
+	Priority string
+	Request  *StoredRequest
+	// Deliveries counts how many times the entry was delivered to a worker, including this delivery.
+	Deliveries int64
+}
+
+// QueueStream is the stream of queued requests with the priority. The streams share a hash tag, so that
+// in a cluster they are in the same slot and are read with one XREADGROUP.
+func QueueStream(priority string) string {
+	return queueStreamPrefix + priority
+}
+
+// CreateQueue creates the queue of the priority and the consumer group of the workers unless they exist.
+func CreateQueue(ctx context.Context, c *Cache, priority string) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	err = client.XGroupCreateMkStream(ctx, QueueStream(priority), queueGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// EnqueueRequest stores the job record, then queues the request with its priority. The queue is in another
+// slot of a cluster, so the job record is written first; it is left as it is if the request can not be queued.
+func EnqueueRequest(ctx context.Context, c *Cache, job *Job, req *StoredRequest) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	stored, err := c.sealRequest(req)
+	if err != nil {
+		return err
+	}
+	if err = client.Set(ctx, JobKey(job.ID), job, 0).Err(); err != nil {
+		return err
+	}
+	return client.XAdd(ctx, &redis.XAddArgs{
+		Stream: QueueStream(req.Priority),
+		Values: map[string]interface{}{queueRequestField: stored},
+	}).Err()
+}
+
+// readScript reads up to ARGV[3] new entries of the first stream of KEYS which has some, KEYS are ordered by
+// priority. It returns the stream and its entries, or nil if every stream is empty.
+var readScript = redis.NewScript(`
+redis.replicate_commands()
+for _, stream in ipairs(KEYS) do
+	local reply = redis.call("XREADGROUP", "GROUP", ARGV[1], ARGV[2], "COUNT", ARGV[3], "STREAMS", stream, ">")
+	if reply then
+		return reply[1]
+	end
+end
+return nil
+`)
+
+// ReadQueue returns up to count new entries of the highest priority which has some for the consumer. When
+// the queue is empty it waits up to block for entries of any priority, they are ordered like priorities then
+// and a consumer may get up to count entries of each priority. An entry is pending until it is acknowledged,
+// if the consumer dies it is claimed by another one.
+func ReadQueue(ctx context.Context, c *Cache, consumer string, priorities []string, count int64,
+	block time.Duration,
+) ([]QueueEntry, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return nil, err
+	}
+	streams := make([]string, 0, 2*len(priorities))
+	byStream := make(map[string]string, len(priorities))
+	for _, priority := range priorities {
+		streams = append(streams, QueueStream(priority))
+		byStream[QueueStream(priority)] = priority
+	}
+	reply, err := readScript.Run(ctx, client, streams, queueGroup, consumer, count).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if err == nil {
+		stream, msgs, errReply := scriptStream(reply)
+		if errReply != nil {
+			return nil, errReply
+		}
+		entries := make([]QueueEntry, 0, len(msgs))
+		for _, msg := range msgs {
+			entries = append(entries, queueEntry(msg, byStream[stream], 1))
+		}
+		return entries, nil
+	}
+	for range priorities {
+		streams = append(streams, ">")
+	}
+	replies, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    queueGroup,
+		Consumer: consumer,
+		Streams:  streams,
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []QueueEntry
+	for _, priority := range priorities {
+		for _, reply := range replies {
+			if byStream[reply.Stream] != priority {
+				continue
+			}
+			for _, msg := range reply.Messages {
+				entries = append(entries, queueEntry(msg, priority, 1))
+			}
+		}
+	}
+	return entries, nil
+}
+
+// scriptStream reads the reply of XREADGROUP for one stream as it is returned by a script.
+func scriptStream(reply interface{}) (string, []redis.XMessage, error) {
+	invalid := fmt.Errorf("%w: %v", ErrInvalidStreamReply, reply)
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields) != 2 {
+		return "", nil, invalid
+	}
+	stream, ok := fields[0].(string)
+	rawMsgs, okMsgs := fields[1].([]interface{})
+	if !ok || !okMsgs {
+		return "", nil, invalid
+	}
+	msgs := make([]redis.XMessage, 0, len(rawMsgs))
+	for _, rawMsg := range rawMsgs {
+		msg, okMsg := rawMsg.([]interface{})
+		if !okMsg || len(msg) != 2 {
+			return "", nil, invalid
+		}
+		id, okID := msg[0].(string)
+		pairs, okPairs := msg[1].([]interface{})
+		if !okID || !okPairs {
+			return "", nil, invalid
+		}
+		values := make(map[string]interface{}, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if field, okField := pairs[i].(string); okField {
+				values[field] = pairs[i+1]
+			}
+		}
+		msgs = append(msgs, redis.XMessage{ID: id, Values: values})
+	}
+	return stream, msgs, nil
+}
+
+// ClaimStaleEntries hands pending entries of the priority which were not touched for minIdle over to
+// the consumer. Their consumers are considered dead.
+func ClaimStaleEntries(ctx context.Context, c *Cache, priority, consumer string, minIdle time.Duration,
+	count int64,
+) ([]QueueEntry, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return nil, err
+	}
+	stream := QueueStream(priority)
+	pending, err := client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: stream,
+		Group:  queueGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  queuePendingScan,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	deliveries := make(map[string]int64)
+	for _, p := range pending {
+		if p.Idle < minIdle {
+			continue
+		}
+		ids = append(ids, p.ID)
+		deliveries[p.ID] = p.RetryCount
+		if int64(len(ids)) == count {
+			break
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	msgs, err := client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   stream,
+		Group:    queueGroup,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]QueueEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		entries = append(entries, queueEntry(msg, priority, deliveries[msg.ID]+1))
+	}
+	return entries, nil
+}
+
+// TouchQueueEntry resets the idle time of an entry the consumer is executing, so that it is not claimed
+// by another consumer meanwhile.
+func TouchQueueEntry(ctx context.Context, c *Cache, consumer string, entry QueueEntry) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	return client.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   QueueStream(entry.Priority),
+		Group:    queueGroup,
+		Consumer: consumer,
+		Messages: []string{entry.ID},
+	}).Err()
+}
+
+// AckQueueEntry acknowledges an executed entry and removes it from the queue.
+func AckQueueEntry(ctx context.Context, c *Cache, entry QueueEntry) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	stream := QueueStream(entry.Priority)
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, stream, queueGroup, entry.ID)
+		pipe.XDel(ctx, stream, entry.ID)
+		return nil
+	})
+	return err
+}
+
+func queueEntry(msg redis.XMessage, priority string, deliveries int64) QueueEntry {
+	entry := QueueEntry{ID: msg.ID, Priority: priority, Deliveries: deliveries}
+	raw, ok := msg.Values[queueRequestField].(string)
+	if !ok {
+		return entry
+	}
+	req := new(StoredRequest)
+	if err := req.UnmarshalBinary([]byte(raw)); err == nil {
+		entry.Request = req
+	}
+	return entry
+}
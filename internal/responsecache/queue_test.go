@@ -0,0 +1,147 @@
+package responsecache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimStaleEntries(t *testing.T) {
+	ctx := context.Background()
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{
+		Client: redisClient,
+	}
+	mockedCacheConn.ExpectXPendingExt(&redis.XPendingExtArgs{
+		Stream: QueueStream("low"),
+		Group:  queueGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  queuePendingScan,
+	}).SetVal([]redis.XPendingExt{
+		{ID: "1-0", Consumer: "worker-1", Idle: time.Second, RetryCount: 1},
+		{ID: "2-0", Consumer: "worker-2", Idle: 2 * time.Minute, RetryCount: 2},
+	})
+	mockedCacheConn.ExpectXClaim(&redis.XClaimArgs{
+		Stream:   QueueStream("low"),
+		Group:    queueGroup,
+		Consumer: "worker-3",
+		MinIdle:  time.Minute,
+		Messages: []string{"2-0"},
+	}).SetVal([]redis.XMessage{
+		{ID: "2-0", Values: map[string]interface{}{queueRequestField: `{"id":"uniq_id","method":"POST"}`}},
+	})
+
+	entries, err := ClaimStaleEntries(ctx, cache, "low", "worker-3", time.Minute, 10)
+
+	assert.NoError(t, err)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "2-0", entries[0].ID)
+		assert.Equal(t, int64(3), entries[0].Deliveries)
+		assert.Equal(t, "low", entries[0].Priority)
+		if assert.NotNil(t, entries[0].Request) {
+			assert.Equal(t, "uniq_id", entries[0].Request.ID)
+		}
+	}
+}
+
+func TestReadQueue(t *testing.T) {
+	ctx := context.Background()
+	streams := []string{QueueStream("high"), QueueStream("low")}
+	args := &redis.XReadGroupArgs{
+		Group:    queueGroup,
+		Consumer: "worker-1",
+		Streams:  []string{QueueStream("high"), QueueStream("low"), ">", ">"},
+		Count:    4,
+		Block:    time.Second,
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cache := &Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectEvalSha(readScript.Hash(), streams, queueGroup, "worker-1", int64(4)).RedisNil()
+		mockedCacheConn.ExpectXReadGroup(args).RedisNil()
+
+		entries, err := ReadQueue(ctx, cache, "worker-1", []string{"high", "low"}, 4, time.Second)
+
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+	})
+
+	t.Run("highest priority", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cache := &Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectEvalSha(readScript.Hash(), streams, queueGroup, "worker-1", int64(4)).
+			SetVal([]interface{}{QueueStream("low"), []interface{}{
+				[]interface{}{"1-0", []interface{}{queueRequestField, `{"id":"a"}`}},
+				[]interface{}{"2-0", []interface{}{queueRequestField, `{"id":"b"}`}},
+			}})
+
+		entries, err := ReadQueue(ctx, cache, "worker-1", []string{"high", "low"}, 4, time.Second)
+
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2, "the entries are read at once without waiting") {
+			for i, id := range []string{"a", "b"} {
+				assert.Equal(t, "low", entries[i].Priority)
+				if assert.NotNil(t, entries[i].Request) {
+					assert.Equal(t, id, entries[i].Request.ID)
+				}
+			}
+		}
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+	})
+
+	t.Run("invalid reply", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cache := &Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectEvalSha(readScript.Hash(), streams, queueGroup, "worker-1", int64(4)).
+			SetVal([]interface{}{QueueStream("low")})
+
+		_, err := ReadQueue(ctx, cache, "worker-1", []string{"high", "low"}, 4, time.Second)
+
+		assert.ErrorIs(t, err, ErrInvalidStreamReply)
+	})
+
+	t.Run("waited ordered by priority", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cache := &Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectEvalSha(readScript.Hash(), streams, queueGroup, "worker-1", int64(4)).RedisNil()
+		mockedCacheConn.ExpectXReadGroup(args).SetVal([]redis.XStream{
+			{
+				Stream:   QueueStream("low"),
+				Messages: []redis.XMessage{{ID: "1-0", Values: map[string]interface{}{queueRequestField: `{"id":"a"}`}}},
+			},
+			{
+				Stream:   QueueStream("high"),
+				Messages: []redis.XMessage{{ID: "2-0", Values: map[string]interface{}{queueRequestField: "{"}}},
+			},
+		})
+
+		entries, err := ReadQueue(ctx, cache, "worker-1", []string{"high", "low"}, 4, time.Second)
+
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, QueueEntry{ID: "2-0", Priority: "high", Deliveries: 1}, entries[0],
+				"a malformed entry is delivered to be dropped")
+			assert.Equal(t, "low", entries[1].Priority)
+			if assert.NotNil(t, entries[1].Request) {
+				assert.Equal(t, "a", entries[1].Request.ID)
+			}
+		}
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+	})
+}
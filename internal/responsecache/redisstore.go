@@ -0,0 +1,177 @@
+package responsecache
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore keeps the records in Redis, chunks are stored in a hash.
+type RedisStore struct {
+	Client redis.UniversalClient
+}
+
+func (r *RedisStore) Save(ctx context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration) error {
+	return r.Client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *RedisStore) SaveNew(ctx context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration,
+) (bool, error) {
+	return r.Client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (r *RedisStore) SaveExisting(ctx context.Context, key string, value encoding.BinaryMarshaler,
+	ttl time.Duration,
+) (bool, error) {
+	return r.Client.SetXX(ctx, key, value, ttl).Result()
+}
+
+func (r *RedisStore) Get(ctx context.Context, key string, value encoding.BinaryUnmarshaler) error {
+	return r.Client.Get(ctx, key).Scan(value)
+}
+
+func (r *RedisStore) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := r.Client.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+func (r *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	return r.Client.Del(ctx, keys...).Err()
+}
+
+func (r *RedisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ttl, err := r.Client.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// PTTL reports -2 for missing keys and -1 for keys without expiration
+	if ttl == -2 {
+		return 0, ErrNotFound
+	}
+	return ttl, nil
+}
+
+// List iterates the keys with SCAN, so keys added or removed during the iteration may be missed.
+func (r *RedisStore) List(ctx context.Context, prefix string, cursor uint64, count int64,
+) ([]Record, uint64, error) {
+	if cluster, ok := r.Client.(*redis.ClusterClient); ok {
+		return listCluster(ctx, cluster, prefix, cursor, count)
+	}
+	keys, next, err := r.Client.Scan(ctx, cursor, prefix+"*", count).Result()
+	if err != nil || len(keys) == 0 {
+		return nil, next, err
+	}
+	values, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]Record, 0, len(values))
+	for i, value := range values {
+		rawValue, ok := value.(string)
+		if !ok {
+			// the key expired between SCAN and MGET
+			continue
+		}
+		records = append(records, Record{Key: keys[i], Value: []byte(rawValue)})
+	}
+	return records, next, nil
+}
+
+// SaveChunks writes the chunks in one transaction, so readers never see some of them only.
+func (r *RedisStore) SaveChunks(ctx context.Context, key string, chunks [][]byte, ttl time.Duration) error {
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		for n, chunk := range chunks {
+			pipe.HSet(ctx, key, strconv.Itoa(n), chunk)
+		}
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisStore) GetChunk(ctx context.Context, key string, n int) ([]byte, error) {
+	return r.Client.HGet(ctx, key, strconv.Itoa(n)).Bytes()
+}
+
+// clusterCursorShift is the bit position of the node index in the cursors of listCluster, the bits below
+// hold the SCAN cursor of the node.
+const clusterCursorShift = 48
+
+// listCluster scans the master nodes one after another, ordered by address. The keys of a node live in
+// different slots, so their values are read with a pipeline instead of MGET.
+func listCluster(ctx context.Context, cluster *redis.ClusterClient, prefix string, cursor uint64, count int64,
+) ([]Record, uint64, error) {
+	var (
+		mu      sync.Mutex
+		masters []*redis.Client
+	)
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		masters = append(masters, master)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+	node, nodeCursor := splitClusterCursor(cursor)
+	if node >= len(masters) {
+		return nil, 0, nil
+	}
+	master := masters[node]
+	keys, nodeNext, err := master.Scan(ctx, nodeCursor, prefix+"*", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	next := joinClusterCursor(node, nodeNext)
+	if nodeNext == 0 {
+		next = 0
+		if node+1 < len(masters) {
+			next = joinClusterCursor(node+1, 0)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, next, nil
+	}
+	gets := make([]*redis.StringCmd, 0, len(keys))
+	// the error of the pipeline is the first error of its commands, they are checked one by one
+	_, _ = master.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			gets = append(gets, pipe.Get(ctx, key))
+		}
+		return nil
+	})
+	records := make([]Record, 0, len(gets))
+	for i, get := range gets {
+		value, errGet := get.Bytes()
+		if errors.Is(errGet, redis.Nil) {
+			// the key expired between SCAN and GET
+			continue
+		}
+		if errGet != nil {
+			return nil, 0, errGet
+		}
+		records = append(records, Record{Key: keys[i], Value: value})
+	}
+	return records, next, nil
+}
+
+func joinClusterCursor(node int, nodeCursor uint64) uint64 {
+	return uint64(node)<<clusterCursorShift | nodeCursor
+}
+
+func splitClusterCursor(cursor uint64) (int, uint64) {
+	return int(cursor >> clusterCursorShift), cursor & (1<<clusterCursorShift - 1)
+}
@@ -2,7 +2,11 @@ package responsecache
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"time"
 
@@ -11,60 +15,224 @@ import (
 	"github.com/go-redis/redis/v8"
 )
 
+// ErrNoCertificates is returned by NewTLSConfig for CA files without PEM encoded certificates.
+var ErrNoCertificates = errors.New("no certificates found")
+
+// waitPollInterval is how often WaitResponse checks for the response when the cache has no events.
+const waitPollInterval = 100 * time.Millisecond
+
 type HTTPResponse struct {
 	Code    int         `json:"code"`
 	Headers http.Header `json:"headers"`
 	Body    []byte      `json:"body"`
+	// Owner is the identity of the caller who created a background response, empty for anonymous callers.
+	Owner string `json:"owner,omitempty"`
+	// Encoding, Chunks and Size describe a body stored apart from the response, Body is empty then
+	// and the body is read with OpenBody.
+	Encoding string `json:"encoding,omitempty"`
+	Chunks   int    `json:"chunks,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	// Encrypted tells that the chunks of the body are encrypted.
+	Encrypted bool `json:"encrypted,omitempty"`
 }
 
-func (h *HTTPResponse) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, h)
+type Cache struct {
+	// Client is used for the features which need Redis: events, scheduling and the durable queue.
+	// It is nil when the records are kept in another store.
+	Client redis.UniversalClient
+	// Store keeps the records, the Redis client is used when it is nil.
+	Store   Store
+	Storage Storage
+	// Format is how responses are written, plain JSON when it is empty.
+	Format ResponseFormat
+	// Keys encrypt the stored responses, they are stored in clear when it is nil.
+	Keys *Keyring
+	// AllowPlaintext reads the records stored in clear although the cache has keys, it is only set while
+	// they are migrated.
+	AllowPlaintext bool
 }
 
-func (h *HTTPResponse) MarshalBinary() (data []byte, err error) {
-	return json.Marshal(h)
+// cacheOptions are the options of the Redis client, the deployment is picked like in redis.NewUniversalClient
+// unless it is a cluster.
+type cacheOptions struct {
+	redis.UniversalOptions
+	cluster bool
 }
 
-type Cache struct {
-	Client *redis.Client
+type CacheOption func(rOpt *cacheOptions)
+
+// WithAddr connects to a standalone Redis.
+func WithAddr(addr string) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.Addrs = []string{addr}
+	}
 }
 
-type CacheOption func(rOpt *redis.Options)
+// WithSentinel connects to the master masterName monitored by the sentinels at addrs.
+func WithSentinel(masterName string, addrs []string) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.MasterName = masterName
+		rOpt.Addrs = addrs
+	}
+}
 
-func WithAddr(addr string) CacheOption {
-	return func(rOpt *redis.Options) {
-		rOpt.Addr = addr
+// WithCluster connects to the Redis Cluster with the seed nodes at addrs.
+func WithCluster(addrs []string) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.cluster = true
+		rOpt.Addrs = addrs
 	}
 }
 
+// WithCredentials authenticates connections with AUTH, an empty username uses the default user.
+func WithCredentials(username, password string) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.Username = username
+		rOpt.Password = password
+	}
+}
+
+// WithDB selects the database of the connections, a cluster only has database 0.
+func WithDB(db int) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.DB = db
+	}
+}
+
+// WithTLS connects over TLS, see NewTLSConfig.
+func WithTLS(tlsConfig *tls.Config) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.TLSConfig = tlsConfig
+	}
+}
+
+// WithPool sizes the connection pool, zero values keep the defaults of the client.
+func WithPool(size, minIdle int) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.PoolSize = size
+		rOpt.MinIdleConns = minIdle
+	}
+}
+
+// WithTimeouts sets the timeouts of connections, zero values keep the defaults of the client.
+func WithTimeouts(dial, read, write time.Duration) CacheOption {
+	return func(rOpt *cacheOptions) {
+		rOpt.DialTimeout = dial
+		rOpt.ReadTimeout = read
+		rOpt.WriteTimeout = write
+	}
+}
+
+// NewTLSConfig returns the TLS configuration of connections to Redis. The server certificate is verified
+// with the PEM encoded certificates of caFile, or with the system roots if caFile is empty.
+func NewTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA certificates: %w", err)
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, ErrNoCertificates
+	}
+	return tlsConfig, nil
+}
+
 func NewCache(ctx context.Context, clientOpts ...CacheOption) (*Cache, error) {
 	logger := logging.FromContext(ctx)
-	redisOpts := new(redis.Options)
+	redisOpts := new(cacheOptions)
 	for i := range clientOpts {
 		funcOpt := clientOpts[i]
 		funcOpt(redisOpts)
 	}
-	rdb := redis.NewClient(redisOpts)
+	var rdb redis.UniversalClient
+	switch {
+	case redisOpts.cluster:
+		rdb = redis.NewClusterClient(redisOpts.Cluster())
+	case redisOpts.MasterName != "":
+		rdb = redis.NewFailoverClient(redisOpts.Failover())
+	default:
+		rdb = redis.NewClient(redisOpts.Simple())
+	}
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		logger.WithError(err).Error("ping failed")
 		return nil, err
 	}
 	rdb.AddHook(redisotel.NewTracingHook())
-	cache := &Cache{Client: rdb}
+	cache := &Cache{
+		Client: rdb,
+		Store:  &RedisStore{Client: rdb},
+	}
 	return cache, nil
 }
 
-func SaveResponse(ctx context.Context, c *Cache, k string, resp *HTTPResponse) error {
-	noTTL := time.Duration(0)
-	return c.Client.Set(ctx, k, resp, noTTL).Err()
+// SaveResponse stores resp under k. The key expires after ttl, zero ttl keeps it forever.
+// Large bodies are compressed and stored in chunks, see Storage.
+func SaveResponse(ctx context.Context, c *Cache, k string, resp *HTTPResponse, ttl time.Duration) error {
+	if !c.Inline(resp) {
+		return saveChunked(ctx, c, k, resp, ttl)
+	}
+	return c.store().Save(ctx, k, c.encodeResponse(k, resp), ttl)
 }
 
 func GetResponse(ctx context.Context, c *Cache, k string) (*HTTPResponse, error) {
 	httpResp := new(HTTPResponse)
-	err := c.Client.Get(ctx, k).Scan(httpResp)
-	return httpResp, err
+	var raw rawRecord
+	if err := c.store().Get(ctx, k, &raw); err != nil {
+		return httpResp, err
+	}
+	return httpResp, c.decodeResponse(raw, k, httpResp)
+}
+
+// ResponseExists reports whether a response is stored under k.
+func ResponseExists(ctx context.Context, c *Cache, k string) (bool, error) {
+	return c.store().Exists(ctx, k)
 }
 
 func DeleteResponse(ctx context.Context, c *Cache, k string) error {
-	return c.Client.Del(ctx, k).Err()
+	return c.store().Delete(ctx, k, ChunksKey(k))
+}
+
+// WaitResponse returns the response stored under k. If there is no response yet it waits up to wait
+// for an event of the job and returns ErrNotFound if the response is still missing. Without events
+// the store is polled.
+func WaitResponse(ctx context.Context, c *Cache, k string, wait time.Duration) (*HTTPResponse, error) {
+	// only one of events and poll is set
+	var (
+		events <-chan *redis.Message
+		poll   <-chan time.Time
+	)
+	pubsub, err := SubscribeEvents(ctx, c, k)
+	switch {
+	case err == nil:
+		defer func() {
+			_ = pubsub.Close()
+		}()
+		events = pubsub.Channel()
+	case errors.Is(err, ErrNotSupported):
+		ticker := time.NewTicker(waitPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	default:
+		return nil, err
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		httpResp, err := GetResponse(ctx, c, k)
+		if !errors.Is(err, ErrNotFound) {
+			return httpResp, err
+		}
+		select {
+		case <-events:
+		case <-poll:
+		case <-timer.C:
+			return GetResponse(ctx, c, k)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
@@ -0,0 +1,79 @@
+package responsecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheOptions(t *testing.T) {
+	redisOpts := new(cacheOptions)
+	for _, opt := range []CacheOption{
+		WithAddr("resp_cache:6379"),
+		WithCredentials("rest-server", "secret"),
+		WithDB(2),
+		WithPool(20, 5),
+		WithTimeouts(time.Second, 2*time.Second, 3*time.Second),
+	} {
+		opt(redisOpts)
+	}
+
+	assert.False(t, redisOpts.cluster)
+	assert.Equal(t, redis.UniversalOptions{
+		Addrs:        []string{"resp_cache:6379"},
+		Username:     "rest-server",
+		Password:     "secret",
+		DB:           2,
+		PoolSize:     20,
+		MinIdleConns: 5,
+		DialTimeout:  time.Second,
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 3 * time.Second,
+	}, redisOpts.UniversalOptions)
+}
+
+func TestCacheOptions_Deployment(t *testing.T) {
+	sentinel := new(cacheOptions)
+	WithSentinel("mymaster", []string{"sentinel-1:26379", "sentinel-2:26379"})(sentinel)
+	assert.False(t, sentinel.cluster)
+	assert.Equal(t, "mymaster", sentinel.MasterName)
+	assert.Equal(t, []string{"sentinel-1:26379", "sentinel-2:26379"}, sentinel.Addrs)
+
+	cluster := new(cacheOptions)
+	WithCluster([]string{"node-1:6379"})(cluster)
+	assert.True(t, cluster.cluster, "a single seed node is still a cluster")
+	assert.Equal(t, []string{"node-1:6379"}, cluster.Addrs)
+}
+
+func TestClusterCursor(t *testing.T) {
+	node, nodeCursor := splitClusterCursor(joinClusterCursor(2, 1234))
+	assert.Equal(t, 2, node)
+	assert.Equal(t, uint64(1234), nodeCursor)
+
+	node, nodeCursor = splitClusterCursor(0)
+	assert.Zero(t, node)
+	assert.Zero(t, nodeCursor)
+}
+
+func TestHashTags(t *testing.T) {
+	assert.Equal(t, "{uniq_id}:chunks", ChunksKey("uniq_id"))
+	assert.Equal(t, "{bg-queue}:high", QueueStream("high"))
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tlsConfig, err := NewTLSConfig("")
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig.RootCAs, "the system roots are used")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+	_, err = NewTLSConfig(caFile)
+	assert.ErrorIs(t, err, ErrNoCertificates)
+
+	_, err = NewTLSConfig(caFile + ".missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
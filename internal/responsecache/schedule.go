@@ -0,0 +1,320 @@
+package responsecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	scheduledKeyPrefix = "scheduled:"
+	// scheduleKey is the sorted set of scheduled request ids scored by the unix milliseconds they are due at.
+	scheduleKey = "{schedule}"
+	// leasesKey is the sorted set of claimed request ids scored by the unix milliseconds their lease ends at.
+	// It shares the hash tag of scheduleKey, so that both are updated by one script in a cluster.
+	leasesKey = scheduleKey + ":leases"
+	// repairBatch is how many stored requests RepairSchedule scans at once.
+	repairBatch = 100
+)
+
+// claimScript moves a request from the schedule to the leases, it returns 1 if the request was scheduled.
+var claimScript = redis.NewScript(`
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// renewScript extends a lease, it returns 0 if the request is not leased.
+var renewScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+return 1
+`)
+
+// reclaimScript extends a lease which ended, it returns 1 if the lease ended before ARGV[2].
+var reclaimScript = redis.NewScript(`
+local deadline = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not deadline or tonumber(deadline) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// indexScript adds a request to the schedule unless it is scheduled or leased already, it returns 1 if the
+// request was added.
+var indexScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[2], ARGV[2]) then
+	return 0
+end
+return redis.call("ZADD", KEYS[1], "NX", ARGV[1], ARGV[2])
+`)
+
+// StoredRequest is a background request which is persisted until it is executed, it is either scheduled
+// or queued.
+type StoredRequest struct {
+	ID     string      `json:"id"`
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	// SealedBody holds Body encrypted when the cache has keys, see OpenStoredRequest.
+	SealedBody []byte `json:"sealed_body,omitempty"`
+	// Owner is the identity of the caller who made the request.
+	Owner string `json:"owner,omitempty"`
+	// RunAt is the time a scheduled request is due at.
+	RunAt       time.Time       `json:"run_at"`
+	Retention   time.Duration   `json:"retention,omitempty"`
+	CallbackURL string          `json:"callback_url,omitempty"`
+	Idempotency *IdempotencyRef `json:"idempotency,omitempty"`
+	Priority    string          `json:"priority,omitempty"`
+}
+
+// IdempotencyRef is the Idempotency-Key record a stored request completes.
+type IdempotencyRef struct {
+	Key         string        `json:"key"`
+	Fingerprint string        `json:"fingerprint"`
+	CreatedAt   time.Time     `json:"created_at"`
+	TTL         time.Duration `json:"ttl"`
+}
+
+func (s *StoredRequest) UnmarshalBinary(data []byte) error {
+	return json.Unmarshal(data, s)
+}
+
+func (s *StoredRequest) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(s)
+}
+
+// ScheduledRequestKey is the key of a scheduled request. It shares the hash tag of JobKey, so that in a cluster
+// the request and its job record are written in one transaction.
+func ScheduledRequestKey(id string) string {
+	return scheduledKeyPrefix + "{" + id + "}"
+}
+
+// ScheduleRequest stores the request with its job record in one transaction, then adds it to the schedule.
+// The schedule is in another slot of a cluster, so it is written last: a request which is not scheduled
+// because the instance stopped meanwhile is added by RepairSchedule. If it can not be scheduled, the request
+// and the job record are removed.
+func ScheduleRequest(ctx context.Context, c *Cache, job *Job, req *StoredRequest) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	stored, err := c.sealRequest(req)
+	if err != nil {
+		return err
+	}
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, JobKey(job.ID), job, 0)
+		pipe.Set(ctx, ScheduledRequestKey(req.ID), stored, 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = indexScheduledRequest(ctx, client, req); err != nil {
+		if errDel := client.Del(ctx, JobKey(job.ID), ScheduledRequestKey(req.ID)).Err(); errDel != nil {
+			return fmt.Errorf("%w, remove the request: %s", err, errDel)
+		}
+		return err
+	}
+	return nil
+}
+
+// RepairSchedule adds the stored requests which are neither scheduled nor leased to the schedule, they were
+// stored by an instance which stopped before it scheduled them. It returns the number of added requests.
+func RepairSchedule(ctx context.Context, c *Cache) (int, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		repaired int
+		cursor   uint64
+	)
+	for {
+		records, next, errList := c.store().List(ctx, scheduledKeyPrefix, cursor, repairBatch)
+		if errList != nil {
+			return repaired, errList
+		}
+		for _, record := range records {
+			req := new(StoredRequest)
+			if err = req.UnmarshalBinary(record.Value); err != nil {
+				return repaired, fmt.Errorf("decode scheduled request %s: %w", record.Key, err)
+			}
+			added, errIndex := indexScheduledRequest(ctx, client, req)
+			if errIndex != nil {
+				return repaired, errIndex
+			}
+			if added {
+				repaired++
+			}
+		}
+		if next == 0 {
+			return repaired, nil
+		}
+		cursor = next
+	}
+}
+
+// MigrateScheduledRequests encrypts the bodies of the scheduled requests stored in clear if the cache has keys.
+// It returns the number of encrypted requests, requests which are removed meanwhile are not written again.
+func MigrateScheduledRequests(ctx context.Context, c *Cache) (int, error) {
+	if c.Keys == nil {
+		return 0, nil
+	}
+	var (
+		migrated int
+		cursor   uint64
+	)
+	for {
+		records, next, err := c.store().List(ctx, scheduledKeyPrefix, cursor, repairBatch)
+		if err != nil {
+			return migrated, err
+		}
+		for _, record := range records {
+			req := new(StoredRequest)
+			if err = req.UnmarshalBinary(record.Value); err != nil {
+				return migrated, fmt.Errorf("decode scheduled request %s: %w", record.Key, err)
+			}
+			if req.SealedBody != nil {
+				continue
+			}
+			sealed, errSeal := c.sealRequest(req)
+			if errSeal != nil {
+				return migrated, errSeal
+			}
+			ok, errSave := c.store().SaveExisting(ctx, record.Key, sealed, KeepTTL)
+			if errSave != nil {
+				return migrated, errSave
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if next == 0 {
+			return migrated, nil
+		}
+		cursor = next
+	}
+}
+
+func indexScheduledRequest(ctx context.Context, client redis.UniversalClient, req *StoredRequest) (bool, error) {
+	added, err := indexScript.Run(ctx, client, []string{scheduleKey, leasesKey}, scheduleScore(req.RunAt),
+		req.ID).Int()
+	return added == 1, err
+}
+
+// RescheduleRequest moves a claimed request back to the schedule, due at runAt.
+func RescheduleRequest(ctx context.Context, c *Cache, id string, runAt time.Time) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, leasesKey, id)
+		pipe.ZAdd(ctx, scheduleKey, &redis.Z{Score: scheduleScore(runAt), Member: id})
+		return nil
+	})
+	return err
+}
+
+// DueScheduledRequests returns up to limit ids of requests which are due at now.
+func DueScheduledRequests(ctx context.Context, c *Cache, now time.Time, limit int64) ([]string, error) {
+	return rangeByScore(ctx, c, scheduleKey, now, limit)
+}
+
+// ExpiredScheduledLeases returns up to limit ids of claimed requests whose lease ended at now, the instance
+// which claimed them stopped before they were finished.
+func ExpiredScheduledLeases(ctx context.Context, c *Cache, now time.Time, limit int64) ([]string, error) {
+	return rangeByScore(ctx, c, leasesKey, now, limit)
+}
+
+func rangeByScore(ctx context.Context, c *Cache, key string, maxTime time.Time, limit int64) ([]string, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(scheduleScore(maxTime), 'f', -1, 64),
+		Count: limit,
+	}).Result()
+}
+
+// ClaimScheduledRequest moves the request from the schedule to the leases, leased until now plus lease.
+// It reports false if another instance claimed it first, only the instance which claimed a request executes
+// it. The lease must be renewed until the request is finished and deleted, otherwise the request is
+// reclaimed by ReclaimScheduledRequest once the lease ended.
+func ClaimScheduledRequest(ctx context.Context, c *Cache, id string, lease time.Duration) (bool, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return false, err
+	}
+	deadline := time.Now().UTC().Add(lease).UnixMilli()
+	claimed, err := claimScript.Run(ctx, client, []string{scheduleKey, leasesKey}, id, deadline).Int()
+	return claimed == 1, err
+}
+
+// ReclaimScheduledRequest takes over a claimed request whose lease ended at now, leased until now plus lease.
+// It reports false if the lease was renewed or another instance reclaimed the request first.
+func ReclaimScheduledRequest(ctx context.Context, c *Cache, id string, now time.Time, lease time.Duration,
+) (bool, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return false, err
+	}
+	reclaimed, err := reclaimScript.Run(ctx, client, []string{leasesKey}, id, now.UnixMilli(),
+		now.Add(lease).UnixMilli()).Int()
+	return reclaimed == 1, err
+}
+
+// RenewScheduledLease extends the lease of a claimed request until now plus lease. It reports false if the
+// request is not leased anymore, it was finished and deleted.
+func RenewScheduledLease(ctx context.Context, c *Cache, id string, lease time.Duration) (bool, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return false, err
+	}
+	deadline := time.Now().UTC().Add(lease).UnixMilli()
+	renewed, err := renewScript.Run(ctx, client, []string{leasesKey}, id, deadline).Int()
+	return renewed == 1, err
+}
+
+// GetScheduledRequest returns the scheduled request, its body is opened with OpenStoredRequest.
+func GetScheduledRequest(ctx context.Context, c *Cache, id string) (*StoredRequest, error) {
+	client, err := c.redisClient()
+	if err != nil {
+		return nil, err
+	}
+	req := new(StoredRequest)
+	err = client.Get(ctx, ScheduledRequestKey(id)).Scan(req)
+	return req, err
+}
+
+// DeleteScheduledRequest removes a finished request, then its lease. The lease of a request which is removed
+// already ends, the request is not found when it is claimed again then.
+func DeleteScheduledRequest(ctx context.Context, c *Cache, id string) error {
+	client, err := c.redisClient()
+	if err != nil {
+		return err
+	}
+	if err = client.Del(ctx, ScheduledRequestKey(id)).Err(); err != nil {
+		return err
+	}
+	return client.ZRem(ctx, leasesKey, id).Err()
+}
+
+func scheduleScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
@@ -0,0 +1,121 @@
+package responsecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimScheduledRequest(t *testing.T) {
+	ctx := context.Background()
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{
+		Client: redisClient,
+	}
+	before := time.Now().Add(time.Minute).UnixMilli()
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		deadline, ok := actual[len(actual)-1].(int64)
+		if !ok || deadline < before || deadline > time.Now().Add(time.Minute).UnixMilli() {
+			return fmt.Errorf("unexpected lease deadline %v", actual[len(actual)-1])
+		}
+		return nil
+	}).ExpectEvalSha(claimScript.Hash(), []string{scheduleKey, leasesKey}, "uniq_id", nil).SetVal(int64(1))
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		return nil
+	}).ExpectEvalSha(claimScript.Hash(), []string{scheduleKey, leasesKey}, "uniq_id", nil).SetVal(int64(0))
+
+	claimed, err := ClaimScheduledRequest(ctx, cache, "uniq_id", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = ClaimScheduledRequest(ctx, cache, "uniq_id", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed, "the request is claimed by another instance")
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+}
+
+func TestReclaimScheduledRequest(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{
+		Client: redisClient,
+	}
+	mockedCacheConn.ExpectEvalSha(reclaimScript.Hash(), []string{leasesKey}, "uniq_id", now.UnixMilli(),
+		now.Add(time.Minute).UnixMilli()).SetVal(int64(1))
+
+	reclaimed, err := ReclaimScheduledRequest(ctx, cache, "uniq_id", now, time.Minute)
+
+	assert.NoError(t, err)
+	assert.True(t, reclaimed)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+}
+
+func TestScheduleRequest(t *testing.T) {
+	ctx := context.Background()
+	runAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	job := &Job{ID: "uniq_id", Status: JobScheduled}
+	req := &StoredRequest{ID: "uniq_id", RunAt: runAt}
+	expectStored := func(mockedCacheConn redismock.ClientMock) {
+		mockedCacheConn.ExpectTxPipeline()
+		mockedCacheConn.ExpectSet("job:{uniq_id}", job, 0).SetVal("OK")
+		mockedCacheConn.ExpectSet("scheduled:{uniq_id}", req, 0).SetVal("OK")
+		mockedCacheConn.ExpectTxPipelineExec()
+	}
+
+	t.Run("scheduled", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cache := &Cache{
+			Client: redisClient,
+		}
+		expectStored(mockedCacheConn)
+		mockedCacheConn.ExpectEvalSha(indexScript.Hash(), []string{scheduleKey, leasesKey}, scheduleScore(runAt),
+			"uniq_id").SetVal(int64(1))
+
+		assert.NoError(t, ScheduleRequest(ctx, cache, job, req))
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the request is stored before it is scheduled")
+	})
+
+	t.Run("not scheduled", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cache := &Cache{
+			Client: redisClient,
+		}
+		expectStored(mockedCacheConn)
+		mockedCacheConn.ExpectEvalSha(indexScript.Hash(), []string{scheduleKey, leasesKey}, scheduleScore(runAt),
+			"uniq_id").SetErr(errors.New("connection refused"))
+		mockedCacheConn.ExpectDel("job:{uniq_id}", "scheduled:{uniq_id}").SetVal(2)
+
+		assert.Error(t, ScheduleRequest(ctx, cache, job, req))
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the stored request is removed")
+	})
+}
+
+func TestRepairSchedule(t *testing.T) {
+	ctx := context.Background()
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{
+		Client: redisClient,
+	}
+	runAt := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockedCacheConn.ExpectScan(0, scheduledKeyPrefix+"*", repairBatch).
+		SetVal([]string{"scheduled:{a}", "scheduled:{b}"}, 0)
+	mockedCacheConn.ExpectMGet("scheduled:{a}", "scheduled:{b}").SetVal([]interface{}{
+		`{"id":"a","run_at":"2022-05-01T12:00:00Z"}`,
+		`{"id":"b","run_at":"2022-05-01T12:00:00Z"}`,
+	})
+	mockedCacheConn.ExpectEvalSha(indexScript.Hash(), []string{scheduleKey, leasesKey}, scheduleScore(runAt),
+		"a").SetVal(int64(1))
+	mockedCacheConn.ExpectEvalSha(indexScript.Hash(), []string{scheduleKey, leasesKey}, scheduleScore(runAt),
+		"b").SetVal(int64(0))
+
+	repaired, err := RepairSchedule(ctx, cache)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, repaired, "only the request which was neither scheduled nor leased is added")
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+}
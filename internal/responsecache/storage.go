@@ -0,0 +1,179 @@
+package responsecache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	chunksKeySuffix = ":chunks"
+	encodingGzip    = "gzip"
+
+	DefaultCompressThreshold = 8 << 10
+	DefaultChunkSize         = 512 << 10
+	DefaultMaxStoredSize     = 32 << 20
+)
+
+var ErrResponseTooLarge = errors.New("response exceeds the maximum stored size")
+
+// Storage defines how response bodies are stored, zero values mean the defaults.
+type Storage struct {
+	// CompressThreshold is the body size above which bodies are compressed and stored apart from the response.
+	CompressThreshold int
+	// ChunkSize is the size of the values the stored body is split into.
+	ChunkSize int
+	// MaxSize limits the stored, compressed body.
+	MaxSize int
+}
+
+func (s Storage) compressThreshold() int {
+	if s.CompressThreshold > 0 {
+		return s.CompressThreshold
+	}
+	return DefaultCompressThreshold
+}
+
+func (s Storage) chunkSize() int {
+	if s.ChunkSize > 0 {
+		return s.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+func (s Storage) maxSize() int {
+	if s.MaxSize > 0 {
+		return s.MaxSize
+	}
+	return DefaultMaxStoredSize
+}
+
+// Inline reports whether the body of resp is stored within the response value.
+func (c *Cache) Inline(resp *HTTPResponse) bool {
+	return len(resp.Body) <= c.Storage.compressThreshold()
+}
+
+// ChunksKey is the hash holding the body chunks of the response stored under k. Its hash tag is k, so
+// that in a cluster both keys are in the same slot and are deleted with one DEL.
+func ChunksKey(k string) string {
+	return "{" + k + "}" + chunksKeySuffix
+}
+
+// saveChunked compresses the body of resp and stores it in chunks next to the response value.
+// The chunks are written before the value, so readers never see a value whose body is missing.
+func saveChunked(ctx context.Context, c *Cache, k string, resp *HTTPResponse, ttl time.Duration) error {
+	body, encoding, err := compressBody(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(body) > c.Storage.maxSize() {
+		return fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, len(body))
+	}
+	meta := &HTTPResponse{
+		Code:     resp.Code,
+		Headers:  resp.Headers,
+		Owner:    resp.Owner,
+		Encoding: encoding,
+		Size:     len(body),
+	}
+	chunkSize := c.Storage.chunkSize()
+	chunks := make([][]byte, 0, len(body)/chunkSize+1)
+	for offset := 0; offset < len(body); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(body) {
+			end = len(body)
+		}
+		chunk := body[offset:end]
+		if c.Keys != nil {
+			if chunk, err = c.Keys.seal(nil, chunk, chunkKey(ChunksKey(k), len(chunks))); err != nil {
+				return err
+			}
+			meta.Encrypted = true
+		}
+		chunks = append(chunks, chunk)
+	}
+	meta.Chunks = len(chunks)
+	if err = c.store().SaveChunks(ctx, ChunksKey(k), chunks, ttl); err != nil {
+		return err
+	}
+	return c.store().Save(ctx, k, c.encodeResponse(k, meta), ttl)
+}
+
+// compressBody gzips the body, it is kept as is when compression does not make it smaller.
+func compressBody(body []byte) ([]byte, string, error) {
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(body); err != nil {
+		return nil, "", fmt.Errorf("compress body: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, "", fmt.Errorf("compress body: %w", err)
+	}
+	if compressed.Len() >= len(body) {
+		return body, "", nil
+	}
+	return compressed.Bytes(), encodingGzip, nil
+}
+
+// OpenBody returns the body of resp read by GetResponse. Chunked bodies are fetched one chunk at a time
+// while the reader is consumed.
+func OpenBody(ctx context.Context, c *Cache, k string, resp *HTTPResponse) (io.ReadCloser, error) {
+	var body io.Reader = bytes.NewReader(resp.Body)
+	if resp.Chunks > 0 {
+		body = &chunkReader{
+			ctx:       ctx,
+			c:         c,
+			chunksKey: ChunksKey(k),
+			chunks:    resp.Chunks,
+			encrypted: resp.Encrypted,
+		}
+	}
+	if resp.Encoding != encodingGzip {
+		return ioutil.NopCloser(body), nil
+	}
+	gzipReader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, fmt.Errorf("decompress body: %w", err)
+	}
+	return gzipReader, nil
+}
+
+type chunkReader struct {
+	ctx       context.Context
+	c         *Cache
+	chunksKey string
+	chunks    int
+	encrypted bool
+	next      int
+	current   []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		if r.next == r.chunks {
+			return 0, io.EOF
+		}
+		chunk, err := r.c.store().GetChunk(r.ctx, r.chunksKey, r.next)
+		if err != nil {
+			return 0, fmt.Errorf("get chunk %d: %w", r.next, err)
+		}
+		switch {
+		case r.encrypted:
+			if chunk, err = r.c.Keys.open(chunk, 0, chunkKey(r.chunksKey, r.next)); err != nil {
+				return 0, fmt.Errorf("get chunk %d: %w", r.next, err)
+			}
+		case !r.c.plaintextAllowed():
+			return 0, fmt.Errorf("get chunk %d: %w", r.next, ErrNotEncrypted)
+		}
+		r.current = chunk
+		r.next++
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
@@ -0,0 +1,65 @@
+package responsecache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenBody_Chunked(t *testing.T) {
+	ctx := context.Background()
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{
+		Client:  redisClient,
+		Storage: Storage{ChunkSize: 64},
+	}
+	body := bytes.Repeat([]byte("a long time ago in a galaxy far, far away. "), 100)
+	stored, encoding, err := compressBody(body)
+	assert.NoError(t, err)
+	assert.Equal(t, encodingGzip, encoding)
+
+	resp := &HTTPResponse{Encoding: encoding, Size: len(stored)}
+	for offset := 0; offset < len(stored); offset += cache.Storage.ChunkSize {
+		end := offset + cache.Storage.ChunkSize
+		if end > len(stored) {
+			end = len(stored)
+		}
+		mockedCacheConn.ExpectHGet(ChunksKey("uniq_id"), strconv.Itoa(resp.Chunks)).SetVal(string(stored[offset:end]))
+		resp.Chunks++
+	}
+
+	reader, err := OpenBody(ctx, cache, "uniq_id", resp)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.Equal(t, body, got)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestSaveResponse_TooLarge(t *testing.T) {
+	ctx := context.Background()
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cache := &Cache{
+		Client:  redisClient,
+		Storage: Storage{CompressThreshold: 8, MaxSize: 16},
+	}
+	// random-looking data does not compress below the limit
+	body := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	err := SaveResponse(ctx, cache, "uniq_id", &HTTPResponse{Code: 200, Body: body}, 0)
+
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "nothing should be stored")
+}
+
+func TestCache_Inline(t *testing.T) {
+	cache := &Cache{}
+	assert.True(t, cache.Inline(&HTTPResponse{Body: make([]byte, DefaultCompressThreshold)}))
+	assert.False(t, cache.Inline(&HTTPResponse{Body: make([]byte, DefaultCompressThreshold+1)}))
+}
@@ -0,0 +1,67 @@
+package responsecache
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// KeepTTL keeps the current expiration of a record which is saved again.
+const KeepTTL = redis.KeepTTL
+
+var (
+	// ErrNotFound is returned for missing records. It is redis.Nil, so that either may be checked for.
+	ErrNotFound = redis.Nil
+	// ErrNotSupported is returned for features which need the Redis store: events, scheduling and the
+	// durable queue.
+	ErrNotSupported = errors.New("not supported by the cache store")
+)
+
+// Store keeps the records of the cache: responses, their body chunks, jobs and idempotency records.
+// A ttl of zero keeps a record forever, KeepTTL keeps its current expiration.
+type Store interface {
+	Save(ctx context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration) error
+	// SaveNew saves the value unless the key exists, it reports whether the value was saved.
+	SaveNew(ctx context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration) (bool, error)
+	// SaveExisting saves the value if the key exists, it reports whether the value was saved.
+	SaveExisting(ctx context.Context, key string, value encoding.BinaryMarshaler, ttl time.Duration) (bool, error)
+	// Get reads the record of the key into value, it returns ErrNotFound if there is none.
+	Get(ctx context.Context, key string, value encoding.BinaryUnmarshaler) error
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, keys ...string) error
+	// TTL returns the time until the record expires, a negative duration if it does not expire.
+	// It returns ErrNotFound if there is no record.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// List returns a page of the records whose keys start with prefix, iterated from cursor. The page may
+	// hold fewer than count records, the iteration is complete when the returned cursor is zero.
+	List(ctx context.Context, prefix string, cursor uint64, count int64) ([]Record, uint64, error)
+	// SaveChunks replaces the chunks stored under the key.
+	SaveChunks(ctx context.Context, key string, chunks [][]byte, ttl time.Duration) error
+	// GetChunk returns chunk n stored under the key.
+	GetChunk(ctx context.Context, key string, n int) ([]byte, error)
+}
+
+// Record is a record returned by Store.List.
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// store returns the store of the cache, a cache created with a Redis client only keeps its records in Redis.
+func (c *Cache) store() Store {
+	if c.Store != nil {
+		return c.Store
+	}
+	return &RedisStore{Client: c.Client}
+}
+
+// redisClient returns the Redis client of the cache, ErrNotSupported if the cache does not use Redis.
+func (c *Cache) redisClient() (redis.UniversalClient, error) {
+	if c.Client == nil {
+		return nil, ErrNotSupported
+	}
+	return c.Client, nil
+}
@@ -0,0 +1,160 @@
+package responsecache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore_Expiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := NewMemoryStore(0)
+	store.now = func() time.Time {
+		return now
+	}
+	assert.NoError(t, store.Save(ctx, "a", &HTTPResponse{Code: 200}, time.Minute))
+	assert.NoError(t, store.Save(ctx, "a", &HTTPResponse{Code: 201}, KeepTTL))
+
+	ttl, err := store.TTL(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ttl, "KeepTTL keeps the expiration")
+
+	now = now.Add(time.Minute)
+	assert.ErrorIs(t, store.Get(ctx, "a", new(HTTPResponse)), ErrNotFound)
+	_, err = store.TTL(ctx, "a")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Zero(t, store.size, "expired records are removed")
+}
+
+func TestMemoryStore_Eviction(t *testing.T) {
+	ctx := context.Background()
+	value := &HTTPResponse{Code: 200}
+	data, err := value.MarshalBinary()
+	assert.NoError(t, err)
+	store := NewMemoryStore(2 * (len(data) + 1))
+	assert.NoError(t, store.Save(ctx, "a", value, 0))
+	assert.NoError(t, store.Save(ctx, "b", value, 0))
+	// reading a makes b the least recently used record
+	assert.NoError(t, store.Get(ctx, "a", new(HTTPResponse)))
+
+	assert.NoError(t, store.Save(ctx, "c", value, 0))
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		exists, errExists := store.Exists(ctx, key)
+		assert.NoError(t, errExists)
+		assert.Equal(t, expected, exists, key)
+	}
+}
+
+func TestMemoryStore_SaveNew(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+
+	saved, err := store.SaveNew(ctx, "a", &HTTPResponse{Code: 200}, 0)
+	assert.NoError(t, err)
+	assert.True(t, saved)
+	saved, err = store.SaveNew(ctx, "a", &HTTPResponse{Code: 500}, 0)
+	assert.NoError(t, err)
+	assert.False(t, saved)
+
+	got := new(HTTPResponse)
+	assert.NoError(t, store.Get(ctx, "a", got))
+	assert.Equal(t, 200, got.Code)
+}
+
+func TestMemoryStore_List(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(0)
+	for _, id := range []string{"c", "a", "b"} {
+		assert.NoError(t, SaveJob(ctx, &Cache{Store: store}, &Job{ID: id}, 0))
+	}
+	assert.NoError(t, store.Save(ctx, "other", &HTTPResponse{}, 0))
+
+	records, cursor, err := store.List(ctx, jobKeyPrefix, 0, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), cursor)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, JobKey("a"), records[0].Key)
+		assert.Equal(t, JobKey("b"), records[1].Key)
+	}
+
+	records, cursor, err = store.List(ctx, jobKeyPrefix, cursor, 2)
+	assert.NoError(t, err)
+	assert.Zero(t, cursor)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, JobKey("c"), records[0].Key)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	store, err := NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	store.now = func() time.Time {
+		return now
+	}
+	cache := &Cache{
+		Store:   store,
+		Storage: Storage{CompressThreshold: 8, ChunkSize: 16},
+	}
+	body := bytes.Repeat([]byte("a long time ago in a galaxy far, far away. "), 10)
+
+	assert.NoError(t, SaveResponse(ctx, cache, "uniq_id", &HTTPResponse{Code: 200, Body: body}, time.Minute))
+	assert.NoError(t, SaveJob(ctx, cache, &Job{ID: "uniq_id", Status: JobSucceeded}, 0))
+
+	resp, err := GetResponse(ctx, cache, "uniq_id")
+	assert.NoError(t, err)
+	assert.Greater(t, resp.Chunks, 1)
+	reader, err := OpenBody(ctx, cache, "uniq_id", resp)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, body, got)
+
+	jobs, cursor, err := ScanJobs(ctx, cache, 0, 10)
+	assert.NoError(t, err)
+	assert.Zero(t, cursor)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, JobSucceeded, jobs[0].Status)
+	}
+
+	now = now.Add(time.Minute)
+	_, err = GetResponse(ctx, cache, "uniq_id")
+	assert.ErrorIs(t, err, ErrNotFound, "the response expired")
+	_, err = store.GetChunk(ctx, ChunksKey("uniq_id"), 0)
+	assert.ErrorIs(t, err, ErrNotFound, "the chunks expired")
+
+	assert.NoError(t, store.Delete(ctx, JobKey("uniq_id")))
+	exists, err := store.Exists(ctx, JobKey("uniq_id"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestDiskStore_LongKey(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	cache := &Cache{Store: store}
+	longID := strings.Repeat("k", 300)
+
+	assert.NoError(t, SaveJob(ctx, cache, &Job{ID: longID, Status: JobSucceeded}, 0))
+
+	job, err := GetJob(ctx, cache, longID)
+	assert.NoError(t, err)
+	assert.Equal(t, longID, job.ID)
+	jobs, _, err := ScanJobs(ctx, cache, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, longID, jobs[0].ID)
+	}
+	assert.NoError(t, store.Delete(ctx, JobKey(longID)))
+	_, err = GetJob(ctx, cache, longID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
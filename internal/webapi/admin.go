@@ -0,0 +1,220 @@
+package webapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+const (
+	DefaultJobsPageSize = 100
+	MaxJobsPageSize     = 1000
+)
+
+var ErrInvalidJobFilter = errors.New("invalid job filter")
+
+// AdminCheck reports whether the caller of ctx is an operator.
+type AdminCheck func(ctx context.Context) bool
+
+// AdminCallers allows the callers with the given identities, see CallerIdentity.
+func AdminCallers(callers []string) AdminCheck {
+	admins := make(map[string]struct{}, len(callers))
+	for _, caller := range callers {
+		if caller != "" {
+			admins[caller] = struct{}{}
+		}
+	}
+	return func(ctx context.Context) bool {
+		_, ok := admins[CallerFromContext(ctx)]
+		return ok
+	}
+}
+
+// AdminMw rejects callers which are not operators with 403.
+func AdminMw(isAdmin AdminCheck) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if !isAdmin(ctx) {
+				logging.FromContext(ctx).Warn("admin endpoint called by a regular caller")
+				Forbidden(ctx, w, "admin access required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// JobsPage is a page of ListJobs, Cursor is "0" once all jobs have been scanned.
+type JobsPage struct {
+	Jobs   []*responsecache.Job `json:"jobs"`
+	Cursor string               `json:"cursor"`
+}
+
+// JobDetail is a job record with its timings.
+type JobDetail struct {
+	*responsecache.Job
+	QueueTime    string `json:"queue_time,omitempty"`
+	RunTime      string `json:"run_time,omitempty"`
+	ResultStored bool   `json:"result_stored"`
+}
+
+type jobFilter struct {
+	status responsecache.JobStatus
+	route  string
+	owner  string
+	minAge time.Duration
+	maxAge time.Duration
+}
+
+func parseJobFilter(query url.Values) (jobFilter, error) {
+	filter := jobFilter{
+		status: responsecache.JobStatus(query.Get("status")),
+		route:  query.Get("route"),
+		owner:  query.Get("owner"),
+	}
+	var err error
+	if filter.minAge, err = parseAge(query.Get("min_age")); err != nil {
+		return filter, err
+	}
+	if filter.maxAge, err = parseAge(query.Get("max_age")); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func parseAge(rawAge string) (time.Duration, error) {
+	if rawAge == "" {
+		return 0, nil
+	}
+	age, err := time.ParseDuration(rawAge)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("%w: age %q", ErrInvalidJobFilter, rawAge)
+	}
+	return age, nil
+}
+
+func (f jobFilter) match(job *responsecache.Job, now time.Time) bool {
+	age := now.Sub(job.CreatedAt)
+	return (f.status == "" || job.Status == f.status) &&
+		(f.route == "" || job.Path == f.route) &&
+		(f.owner == "" || job.Owner == f.owner) &&
+		(f.minAge == 0 || age >= f.minAge) &&
+		(f.maxAge == 0 || age <= f.maxAge)
+}
+
+// ListJobs returns a page of background jobs matching the status, route, owner, min_age and max_age
+// query parameters. Pages are iterated with the cursor parameter, limit is a hint for the page size.
+func ListJobs(cacheConn *responsecache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+		query := r.URL.Query()
+		filter, err := parseJobFilter(query)
+		if err != nil {
+			logger.WithError(err).Warn("invalid job filter")
+			BadRequest(ctx, w, err.Error())
+			return
+		}
+		cursor, limit, err := parsePage(query.Get("cursor"), query.Get("limit"))
+		if err != nil {
+			logger.WithError(err).Warn("invalid page")
+			BadRequest(ctx, w, err.Error())
+			return
+		}
+		jobs, next, err := responsecache.ScanJobs(ctx, cacheConn, cursor, limit)
+		if err != nil {
+			logger.WithError(err).Error("scan jobs failed")
+			InternalError(ctx, w, "scan jobs failed")
+			return
+		}
+		now := time.Now().UTC()
+		page := &JobsPage{
+			Jobs:   make([]*responsecache.Job, 0, len(jobs)),
+			Cursor: strconv.FormatUint(next, 10),
+		}
+		for _, job := range jobs {
+			if filter.match(job, now) {
+				page.Jobs = append(page.Jobs, job)
+			}
+		}
+		StatusOkJSON(ctx, w, page)
+	}
+}
+
+func parsePage(rawCursor, rawLimit string) (uint64, int64, error) {
+	var cursor uint64
+	limit := int64(DefaultJobsPageSize)
+	var err error
+	if rawCursor != "" {
+		if cursor, err = strconv.ParseUint(rawCursor, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("%w: cursor %q", ErrInvalidJobFilter, rawCursor)
+		}
+	}
+	if rawLimit != "" {
+		if limit, err = strconv.ParseInt(rawLimit, 10, 64); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("%w: limit %q", ErrInvalidJobFilter, rawLimit)
+		}
+		if limit > MaxJobsPageSize {
+			limit = MaxJobsPageSize
+		}
+	}
+	return cursor, limit, nil
+}
+
+// JobDetails returns the job record with its timings. The result is left in the cache.
+func JobDetails(cacheConn *responsecache.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+		bgID := chi.URLParam(r, "bg_id")
+		logger = logger.WithField("bg_id", bgID)
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if err != nil {
+			if errors.Is(err, responsecache.ErrNotFound) {
+				logger.Warn("background id not found")
+				NotFound(ctx, w, "background id not found")
+				return
+			}
+			logger.WithError(err).Error("get job failed")
+			InternalError(ctx, w, "get job failed")
+			return
+		}
+		stored, err := responsecache.ResponseExists(ctx, cacheConn, bgID)
+		if err != nil {
+			logger.WithError(err).Error("check response failed")
+			InternalError(ctx, w, "check response failed")
+			return
+		}
+		StatusOkJSON(ctx, w, newJobDetail(job, stored, time.Now().UTC()))
+	}
+}
+
+func newJobDetail(job *responsecache.Job, stored bool, now time.Time) *JobDetail {
+	detail := &JobDetail{
+		Job:          job,
+		ResultStored: stored,
+	}
+	queuedUntil := now
+	if job.StartedAt != nil {
+		queuedUntil = *job.StartedAt
+		runUntil := now
+		if job.FinishedAt != nil {
+			runUntil = *job.FinishedAt
+		}
+		detail.RunTime = runUntil.Sub(*job.StartedAt).String()
+	} else if job.FinishedAt != nil {
+		queuedUntil = *job.FinishedAt
+	}
+	detail.QueueTime = queuedUntil.Sub(job.CreatedAt).String()
+	return detail
+}
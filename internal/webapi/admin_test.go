@@ -0,0 +1,128 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestAdminMw(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	handler := AdminMw(AdminCallers([]string{"jwt:ops"}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses", nil)
+	handler.ServeHTTP(testRecorder, testRequest.WithContext(WithCaller(ctx, "jwt:user")))
+	assert.Equal(t, http.StatusForbidden, testRecorder.Code)
+
+	testRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(testRecorder, testRequest.WithContext(WithCaller(ctx, "jwt:ops")))
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+
+	testRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(testRecorder, testRequest.WithContext(WithCaller(ctx, "")))
+	assert.Equal(t, http.StatusForbidden, testRecorder.Code, "anonymous callers are never admins")
+}
+
+func TestListJobs_Filter(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	now := time.Now().UTC()
+	jobs := []*responsecache.Job{
+		{ID: "a", Status: responsecache.JobRunning, Path: "/send", Owner: "jwt:a", CreatedAt: now.Add(-time.Hour)},
+		{ID: "b", Status: responsecache.JobSucceeded, Path: "/send", Owner: "jwt:a", CreatedAt: now},
+		{ID: "c", Status: responsecache.JobRunning, Path: "/send", Owner: "jwt:b", CreatedAt: now},
+	}
+	keys := make([]string, 0, len(jobs)+1)
+	values := make([]interface{}, 0, len(jobs)+1)
+	for _, job := range jobs {
+		rawJob, err := json.Marshal(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, "job:"+job.ID)
+		values = append(values, string(rawJob))
+	}
+	// expired between SCAN and MGET
+	keys = append(keys, "job:d")
+	values = append(values, nil)
+	mockedCacheConn.ExpectScan(7, "job:*", 2).SetVal(keys, 0)
+	mockedCacheConn.ExpectMGet(keys...).SetVal(values)
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses?status=running&owner=jwt:a&cursor=7&limit=2", nil)
+	ListJobs(cacheConn).ServeHTTP(testRecorder, testRequest.WithContext(ctx))
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	page := new(JobsPage)
+	assert.NoError(t, json.Unmarshal(testRecorder.Body.Bytes(), page))
+	assert.Equal(t, "0", page.Cursor)
+	if assert.Len(t, page.Jobs, 1) {
+		assert.Equal(t, "a", page.Jobs[0].ID)
+	}
+}
+
+func TestListJobs_InvalidFilter(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	for _, query := range []string{"min_age=soon", "max_age=-1s", "cursor=x", "limit=0"} {
+		testRecorder := httptest.NewRecorder()
+		testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses?"+query, nil)
+		ListJobs(cacheConn).ServeHTTP(testRecorder, testRequest.WithContext(ctx))
+		assert.Equal(t, http.StatusBadRequest, testRecorder.Code, query)
+	}
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+}
+
+func TestParsePage(t *testing.T) {
+	cursor, limit, err := parsePage("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), cursor)
+	assert.Equal(t, int64(DefaultJobsPageSize), limit)
+
+	_, limit, err = parsePage("12", "5000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(MaxJobsPageSize), limit)
+
+	_, _, err = parsePage("", "-1")
+	assert.ErrorIs(t, err, ErrInvalidJobFilter)
+}
+
+func TestNewJobDetail(t *testing.T) {
+	createdAt := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	startedAt := createdAt.Add(2 * time.Second)
+	finishedAt := startedAt.Add(3 * time.Second)
+	now := finishedAt.Add(time.Minute)
+
+	detail := newJobDetail(&responsecache.Job{CreatedAt: createdAt}, false, now)
+	assert.Equal(t, "1m5s", detail.QueueTime)
+	assert.Empty(t, detail.RunTime)
+
+	detail = newJobDetail(&responsecache.Job{CreatedAt: createdAt, StartedAt: &startedAt}, false, now)
+	assert.Equal(t, "2s", detail.QueueTime)
+	assert.Equal(t, "1m3s", detail.RunTime)
+
+	finishedJob := &responsecache.Job{CreatedAt: createdAt, StartedAt: &startedAt, FinishedAt: &finishedAt}
+	detail = newJobDetail(finishedJob, true, now)
+	assert.Equal(t, "2s", detail.QueueTime)
+	assert.Equal(t, "3s", detail.RunTime)
+	assert.True(t, detail.ResultStored)
+}
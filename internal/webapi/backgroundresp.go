@@ -1,26 +1,64 @@
 package webapi
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Sugar-pack/users-manager/pkg/logging"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-redis/redis/v8"
 
 	"github.com/Sugar-pack/rest-server/internal/responsecache"
 )
 
-func CachedResponse(cacheConn *responsecache.Cache) http.HandlerFunc {
+var (
+	ErrNegativeWait    = errors.New("wait must not be negative")
+	ErrInvalidReadMode = errors.New("read mode must be consume or keep")
+)
+
+// ResultReadMode defines what happens to a background result once it is read.
+type ResultReadMode string
+
+const (
+	// ResultConsume deletes the result once it is read.
+	ResultConsume ResultReadMode = "consume"
+	// ResultKeep keeps the result until its retention expires or it is acknowledged by DELETE.
+	ResultKeep ResultReadMode = "keep"
+)
+
+// MaxResultWait limits the wait query parameter of CachedResponse.
+const MaxResultWait = time.Minute
+
+// CachedResponse returns the result of a background request. The read query parameter overrides defaultMode.
+// Results of other callers are reported as not found.
+func CachedResponse(cacheConn *responsecache.Cache, owns OwnershipCheck, defaultMode ResultReadMode,
+) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		logger := logging.FromContext(ctx)
 		bgID := chi.URLParam(r, "bg_id")
 		logger = logger.WithField("bg_id", bgID)
+		wait, err := resultWait(r.URL.Query().Get("wait"))
+		if err != nil {
+			logger.WithError(err).Warn("invalid wait duration")
+			BadRequest(ctx, w, "invalid wait duration")
+			return
+		}
+		mode, err := ParseResultReadMode(r.URL.Query().Get("read"), defaultMode)
+		if err != nil {
+			logger.WithError(err).Warn("invalid read mode")
+			BadRequest(ctx, w, err.Error())
+			return
+		}
 		httpResp, err := responsecache.GetResponse(ctx, cacheConn, bgID)
+		if wait > 0 && errors.Is(err, responsecache.ErrNotFound) && jobInProgress(ctx, cacheConn, bgID) {
+			logger.WithField("wait", wait).Trace("wait for background response")
+			httpResp, err = responsecache.WaitResponse(ctx, cacheConn, bgID, wait)
+		}
 		if err != nil {
-			errRedisNil := redis.Nil
-			if errors.As(err, &errRedisNil) {
+			if errors.Is(err, responsecache.ErrNotFound) {
 				logger.Warn("background id not found")
 				NotFound(ctx, w, "background id not found")
 				return
@@ -29,11 +67,208 @@ func CachedResponse(cacheConn *responsecache.Cache) http.HandlerFunc {
 			InternalError(ctx, w, "get response failed")
 			return
 		}
+		if !owns(ctx, httpResp.Owner) {
+			logger.Warn("background response belongs to another caller")
+			NotFound(ctx, w, "background id not found")
+			return
+		}
+		body, err := responsecache.OpenBody(ctx, cacheConn, bgID, httpResp)
+		if err != nil {
+			logger.WithError(err).Error("open response body failed")
+			InternalError(ctx, w, "get response failed")
+			return
+		}
+		defer func() {
+			_ = body.Close()
+		}()
+		if !streamResponse(ctx, w, httpResp.Code, httpResp.Headers, body) || mode != ResultConsume {
+			return
+		}
+		// the result is removed once it has been fully written
 		if err = responsecache.DeleteResponse(ctx, cacheConn, bgID); err != nil {
 			logger.WithError(err).Warn("drop cache key failed")
 		} else {
 			logger.Trace("response purged")
 		}
-		rawResponse(ctx, w, httpResp.Code, httpResp.Headers, httpResp.Body)
+	}
+}
+
+// ParseResultReadMode returns the mode named by rawMode, defaultMode if it is empty.
+func ParseResultReadMode(rawMode string, defaultMode ResultReadMode) (ResultReadMode, error) {
+	switch mode := ResultReadMode(rawMode); mode {
+	case "":
+		return defaultMode, nil
+	case ResultConsume, ResultKeep:
+		return mode, nil
+	default:
+		return "", ErrInvalidReadMode
+	}
+}
+
+// resultWait parses the wait query parameter, the result is capped by MaxResultWait.
+func resultWait(rawWait string) (time.Duration, error) {
+	if rawWait == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(rawWait)
+	if err != nil {
+		return 0, fmt.Errorf("parse wait: %w", err)
+	}
+	if wait < 0 {
+		return 0, ErrNegativeWait
+	}
+	if wait > MaxResultWait {
+		wait = MaxResultWait
+	}
+	return wait, nil
+}
+
+// jobInProgress reports whether a result of the job is worth waiting for.
+func jobInProgress(ctx context.Context, cacheConn *responsecache.Cache, bgID string) bool {
+	job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+	if err != nil {
+		return false
+	}
+	return !job.Status.Finished()
+}
+
+func BackgroundStatus(cacheConn *responsecache.Cache, owns OwnershipCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+		bgID := chi.URLParam(r, "bg_id")
+		logger = logger.WithField("bg_id", bgID)
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if err != nil {
+			if errors.Is(err, responsecache.ErrNotFound) {
+				logger.Warn("background id not found")
+				NotFound(ctx, w, "background id not found")
+				return
+			}
+			logger.WithError(err).Error("get job failed")
+			InternalError(ctx, w, "get job failed")
+			return
+		}
+		if !owns(ctx, job.Owner) {
+			logger.Warn("background job belongs to another caller")
+			NotFound(ctx, w, "background id not found")
+			return
+		}
+		StatusOkJSON(ctx, w, job)
+	}
+}
+
+const (
+	// DefaultCancelWait is how long CancelBackground waits for the cancelled job to finish.
+	DefaultCancelWait = 5 * time.Second
+	// DefaultCancelRequestTTL is how long the cancel of a job running on another instance is kept
+	// for the instance to pick it up.
+	DefaultCancelRequestTTL = 24 * time.Hour
+)
+
+// CancelBackground cancels a running background job. For a finished job it acknowledges the result,
+// which is then removed from the cache. A job which is not running on this instance, like the ones of the
+// durable queue, is cancelled by the instance which executes it: before it starts or between its attempts.
+func CancelBackground(cacheConn *responsecache.Cache, registry *JobRegistry, owns OwnershipCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+		bgID := chi.URLParam(r, "bg_id")
+		logger = logger.WithField("bg_id", bgID)
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if err != nil {
+			if errors.Is(err, responsecache.ErrNotFound) {
+				logger.Warn("background id not found")
+				NotFound(ctx, w, "background id not found")
+				return
+			}
+			logger.WithError(err).Error("get job failed")
+			InternalError(ctx, w, "get job failed")
+			return
+		}
+		if !owns(ctx, job.Owner) {
+			logger.Warn("background job belongs to another caller")
+			NotFound(ctx, w, "background id not found")
+			return
+		}
+		if job.Status.Finished() {
+			if err = acknowledgeResult(ctx, cacheConn, job); err != nil {
+				logger.WithError(err).Error("acknowledge result failed")
+				InternalError(ctx, w, "acknowledge result failed")
+				return
+			}
+			logger.Trace("result acknowledged")
+			StatusOkJSON(ctx, w, job)
+			return
+		}
+		if job.Status == responsecache.JobScheduled {
+			cancelled, errCancel := cancelScheduled(ctx, cacheConn, job)
+			if errCancel != nil {
+				logger.WithError(errCancel).Error("cancel scheduled job failed")
+				InternalError(ctx, w, "cancel scheduled job failed")
+				return
+			}
+			if cancelled {
+				logger.Info("scheduled job cancelled")
+				StatusOkJSON(ctx, w, job)
+				return
+			}
+		}
+
+		done, ok := registry.Cancel(bgID)
+		if !ok {
+			if err = responsecache.RequestCancel(ctx, cacheConn, bgID, DefaultCancelRequestTTL); err != nil {
+				logger.WithError(err).Error("request cancel failed")
+				InternalError(ctx, w, "request cancel failed")
+				return
+			}
+			logger.Info("cancel of background job running on another instance requested")
+			StatusAcceptedJSON(ctx, w, job)
+			return
+		}
+		logger.Info("background job cancelled")
+		timer := time.NewTimer(DefaultCancelWait)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			logger.Warn("background job is still running after cancel")
+		case <-ctx.Done():
+			return
+		}
+
+		job, err = responsecache.GetJob(ctx, cacheConn, bgID)
+		if err != nil {
+			logger.WithError(err).Error("get job failed")
+			InternalError(ctx, w, "get job failed")
+			return
+		}
+		if !job.Status.Finished() {
+			StatusAcceptedJSON(ctx, w, job)
+			return
+		}
+		StatusOkJSON(ctx, w, job)
+	}
+}
+
+// acknowledgeResult removes the result of a finished job, the job record is kept until its retention expires.
+func acknowledgeResult(ctx context.Context, cacheConn *responsecache.Cache, job *responsecache.Job) error {
+	if err := responsecache.DeleteResponse(ctx, cacheConn, job.ID); err != nil {
+		return fmt.Errorf("delete response: %w", err)
+	}
+	if job.AcknowledgedAt != nil {
+		return nil
+	}
+	acknowledgedAt := time.Now().UTC()
+	job.AcknowledgedAt = &acknowledgedAt
+	if err := responsecache.SaveJob(ctx, cacheConn, job, responsecache.KeepTTL); err != nil {
+		return fmt.Errorf("save job: %w", err)
+	}
+	return nil
+}
+
+func BackgroundWorkers(pool *WorkerPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		StatusOkJSON(r.Context(), w, pool.Stats())
 	}
 }
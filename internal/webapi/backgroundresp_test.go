@@ -3,14 +3,19 @@ package webapi
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/agiledragon/gomonkey/v2"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis/v8"
 	"github.com/go-redis/redismock/v8"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/Sugar-pack/rest-server/internal/responsecache"
@@ -36,9 +41,9 @@ func TestCachedResponse_OK(t *testing.T) {
 		t.Fatal(err)
 	}
 	mockedCacheConn.ExpectGet(bgID).SetVal(string(mockedRedisValue))
-	mockedCacheConn.ExpectDel(bgID).SetVal(0)
+	mockedCacheConn.ExpectDel(bgID, responsecache.ChunksKey(bgID)).SetVal(0)
 
-	handlerFn := CachedResponse(cacheConn)
+	handlerFn := CachedResponse(cacheConn, CallerOwns, ResultConsume)
 	testRecorder := httptest.NewRecorder()
 	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}", nil)
 	testRequest = testRequest.WithContext(ctx)
@@ -73,7 +78,7 @@ func TestCachedResponse_NotFound(t *testing.T) {
 	}
 	mockedCacheConn.ExpectGet(bgID).RedisNil()
 
-	handlerFn := CachedResponse(cacheConn)
+	handlerFn := CachedResponse(cacheConn, CallerOwns, ResultConsume)
 	testRecorder := httptest.NewRecorder()
 	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}", nil)
 	testRequest = testRequest.WithContext(ctx)
@@ -96,3 +101,343 @@ func TestCachedResponse_NotFound(t *testing.T) {
 	assert.Equal(t, expectedHTTPCode, gotHttpCode)
 	assert.Equal(t, expectedBody, gotResponseBody)
 }
+
+func TestBackgroundStatus_Running(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	startedAt := time.Date(2022, 4, 20, 10, 0, 0, 0, time.UTC)
+	mockedJob := &responsecache.Job{
+		ID:        bgID,
+		Status:    responsecache.JobRunning,
+		Method:    http.MethodPost,
+		Path:      "/send",
+		CreatedAt: startedAt,
+		StartedAt: &startedAt,
+	}
+	mockedRedisValue, err := json.Marshal(mockedJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(mockedRedisValue))
+
+	handlerFn := BackgroundStatus(cacheConn, CallerOwns)
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}/status", nil)
+	testRequest = testRequest.WithContext(ctx)
+
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(testRequest.Context(), chi.RouteCtxKey, newChiCtx))
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+
+	gotJob := new(responsecache.Job)
+	if err = json.NewDecoder(testRecorder.Body).Decode(gotJob); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.Equal(t, "application/json", testRecorder.Header().Get("Content-Type"))
+	assert.Equal(t, mockedJob, gotJob)
+}
+
+func TestBackgroundStatus_NotFound(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).RedisNil()
+	mockedCacheConn.ExpectGet("job:" + bgID).RedisNil()
+
+	handlerFn := BackgroundStatus(cacheConn, CallerOwns)
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}/status", nil)
+	testRequest = testRequest.WithContext(ctx)
+
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(testRequest.Context(), chi.RouteCtxKey, newChiCtx))
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Equal(t, http.StatusNotFound, testRecorder.Code)
+	assert.Equal(t, "background id not found", testRecorder.Body.String())
+}
+
+type cancellableResponse struct{}
+
+func (c *cancellableResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	<-ctx.Done()
+	RequestCancelled(ctx, w, "cancelled")
+}
+
+func TestCancelBackground_Running(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	httpHeaders := make(http.Header)
+	httpHeaders.Add(HTTPHeaderXBackground, "true")
+	httpHeaders.Add(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+
+	mockedUUID := uuid.MustParse("ef24471b-e968-40f0-b4d4-c9d0410565c8")
+	bgID := mockedUUID.String()
+	patches := gomonkey.ApplyFunc(uuid.New, func() uuid.UUID {
+		return mockedUUID
+	})
+	defer patches.Reset()
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+		Format: responsecache.FormatBinary,
+	}
+	runningJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobRunning})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelledJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobCancelled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventAccepted)
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(runningJob))
+	mockedCacheConn.ExpectSet(bgID, &responsecache.HTTPResponse{
+		Code:    StatusClientClosedRequest,
+		Headers: make(map[string][]string),
+		Body:    []byte("cancelled"),
+	}, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobCancelled, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventCompleted)
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(cancelledJob))
+
+	registry := NewJobRegistry()
+	handlerFn := AsyncMw(cacheConn, WithJobRegistry(registry))(new(cancellableResponse))
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header = httpHeaders
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+
+	cancelRecorder := httptest.NewRecorder()
+	cancelRequest := httptest.NewRequest(http.MethodDelete, "/bg-responses/{bg_id}", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	cancelRequest = cancelRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+	CancelBackground(cacheConn, registry, CallerOwns).ServeHTTP(cancelRecorder, cancelRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	gotJob := new(responsecache.Job)
+	if err = json.NewDecoder(cancelRecorder.Body).Decode(gotJob); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, cancelRecorder.Code)
+	assert.Equal(t, responsecache.JobCancelled, gotJob.Status)
+}
+
+func TestCancelBackground_NotRunningHere(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	runningJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobRunning})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(runningJob))
+	mockedCacheConn.Regexp().ExpectSet(responsecache.CancelKey(bgID), `.*`, DefaultCancelRequestTTL).SetVal("OK")
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodDelete, "/bg-responses/{bg_id}", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+	CancelBackground(cacheConn, NewJobRegistry(), CallerOwns).ServeHTTP(testRecorder, testRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+}
+
+func TestCancelBackground_AcknowledgeFinished(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	finishedJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(finishedJob))
+	mockedCacheConn.ExpectDel(bgID, responsecache.ChunksKey(bgID)).SetVal(1)
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		job, ok := actual[2].(*responsecache.Job)
+		if !ok || job.AcknowledgedAt == nil {
+			return fmt.Errorf("unexpected job %+v", actual[2])
+		}
+		return nil
+	}).ExpectSet(responsecache.JobKey(bgID), nil, redis.KeepTTL).SetVal("OK")
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodDelete, "/bg-responses/{bg_id}", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+	CancelBackground(cacheConn, NewJobRegistry(), CallerOwns).ServeHTTP(testRecorder, testRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+}
+
+func TestCachedResponse_Keep(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	mockedRedisValue, err := json.Marshal(&responsecache.HTTPResponse{Code: http.StatusOK, Body: []byte("from cache")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedCacheConn.ExpectGet(bgID).SetVal(string(mockedRedisValue))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}?read=keep", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+	CachedResponse(cacheConn, CallerOwns, ResultConsume).ServeHTTP(testRecorder, testRequest)
+
+	// no DEL is expected, the result stays until it is acknowledged
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.Equal(t, "from cache", testRecorder.Body.String())
+}
+
+func TestParseResultReadMode(t *testing.T) {
+	mode, err := ParseResultReadMode("", ResultKeep)
+	assert.NoError(t, err)
+	assert.Equal(t, ResultKeep, mode)
+	mode, err = ParseResultReadMode("consume", ResultKeep)
+	assert.NoError(t, err)
+	assert.Equal(t, ResultConsume, mode)
+	_, err = ParseResultReadMode("forget", ResultKeep)
+	assert.ErrorIs(t, err, ErrInvalidReadMode)
+}
+
+func TestCachedResponse_InvalidWait(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+
+	handlerFn := CachedResponse(cacheConn, CallerOwns, ResultConsume)
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}?wait=-1s", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", "uniq_id")
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Equal(t, http.StatusBadRequest, testRecorder.Code)
+}
+
+func TestCachedResponse_WaitFinishedJob(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	finishedJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedCacheConn.ExpectGet(bgID).RedisNil()
+	mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(finishedJob))
+
+	handlerFn := CachedResponse(cacheConn, CallerOwns, ResultConsume)
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}?wait=10s", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Equal(t, http.StatusNotFound, testRecorder.Code, "result of a finished job will never appear")
+}
+
+func TestResultWait(t *testing.T) {
+	wait, err := resultWait("")
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+	wait, err = resultWait("10s")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, wait)
+	wait, err = resultWait("1h")
+	assert.NoError(t, err)
+	assert.Equal(t, MaxResultWait, wait)
+	_, err = resultWait("-1s")
+	assert.ErrorIs(t, err, ErrNegativeWait)
+	_, err = resultWait("soon")
+	assert.Error(t, err)
+}
+
+func TestCachedResponse_MemoryStore(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	bgID := "uniq_id"
+	cacheConn := &responsecache.Cache{
+		Store: responsecache.NewMemoryStore(0),
+	}
+	err := responsecache.SaveResponse(ctx, cacheConn, bgID,
+		&responsecache.HTTPResponse{Code: http.StatusOK, Body: []byte("from memory")}, time.Minute)
+	assert.NoError(t, err)
+
+	get := func() *httptest.ResponseRecorder {
+		testRecorder := httptest.NewRecorder()
+		testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}", nil)
+		newChiCtx := chi.NewRouteContext()
+		newChiCtx.URLParams.Add("bg_id", bgID)
+		testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+		CachedResponse(cacheConn, CallerOwns, ResultConsume).ServeHTTP(testRecorder, testRequest)
+		return testRecorder
+	}
+
+	testRecorder := get()
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.Equal(t, "from memory", testRecorder.Body.String())
+	assert.Equal(t, http.StatusNotFound, get().Code, "the result is consumed")
+}
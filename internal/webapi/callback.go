@@ -0,0 +1,391 @@
+package webapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+const (
+	HTTPHeaderXBackgroundCallback  = "x-background-callback"
+	HTTPHeaderXBackgroundSignature = "x-background-signature"
+	// HTTPHeaderXBackgroundTimestamp is the unix time a callback was sent at, it is signed with the payload.
+	HTTPHeaderXBackgroundTimestamp = "x-background-timestamp"
+
+	DefaultCallbackMaxAttempts = 3
+	DefaultCallbackBackoff     = time.Second
+	DefaultCallbackTimeout     = 10 * time.Second
+	// DefaultCallbackTolerance is how far the timestamp of a callback may be from the clock of its receiver,
+	// older callbacks are replays.
+	DefaultCallbackTolerance = 5 * time.Minute
+)
+
+var (
+	ErrCallbackDisabled   = errors.New("background callback is not enabled")
+	ErrInvalidCallbackURL = errors.New("background callback must be an absolute http(s) url")
+	// ErrCallbackDestination is returned for callbacks to hosts which are not allowed, or to loopback,
+	// private or link-local addresses.
+	ErrCallbackDestination = errors.New("background callback destination is not allowed")
+	// ErrCallbackInterrupted is recorded for callbacks which were still pending when the server stopped.
+	ErrCallbackInterrupted = errors.New("background callback interrupted by server shutdown")
+	// ErrCallbackSignature is returned by VerifyCallback for callbacks which were not signed with the secret
+	// or whose timestamp is outside the tolerance.
+	ErrCallbackSignature = errors.New("background callback signature is not valid")
+)
+
+var (
+	// sharedAddressSpace is the range of carrier-grade NAT, it is not reachable from the internet.
+	sharedAddressSpace = mustParseCIDR("100.64.0.0/10")
+	// nat64Prefix embeds an IPv4 address in its last 32 bits, nat64LocalPrefix is used by local translators
+	// which may embed it anywhere.
+	nat64Prefix      = mustParseCIDR("64:ff9b::/96")
+	nat64LocalPrefix = mustParseCIDR("64:ff9b:1::/48")
+)
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+type callbackConfig struct {
+	secret      string
+	maxAttempts int
+	backoff     time.Duration
+	client      *http.Client
+	// allowedHosts are the hosts callbacks may be delivered to, any public host when it is empty.
+	allowedHosts map[string]bool
+	allowPrivate bool
+	// sender delivers the callbacks, each one is delivered in its own goroutine when it is nil.
+	sender *CallbackSender
+}
+
+func defaultCallbackConfig() callbackConfig {
+	return callbackConfig{
+		maxAttempts: DefaultCallbackMaxAttempts,
+		backoff:     DefaultCallbackBackoff,
+		client:      newCallbackClient(false),
+	}
+}
+
+// newCallbackClient returns the client delivering callbacks. Unless allowPrivate is set it refuses to connect
+// to loopback, private and link-local addresses, which is checked on the resolved address so that names
+// resolving to them are refused as well. It neither uses a proxy nor follows redirects for the same reason.
+func newCallbackClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: DefaultCallbackTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrCallbackDestination, address)
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w: %s", ErrCallbackDestination, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // it is a transport
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   DefaultCallbackTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicIP reports whether callbacks may be delivered to ip when private addresses are not allowed.
+// IPv4 addresses mapped to IPv6 or translated by NAT64 are checked as the IPv4 address they reach.
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if nat64Prefix.Contains(ip) {
+		return publicIP(ip[net.IPv6len-net.IPv4len:])
+	} else if nat64LocalPrefix.Contains(ip) {
+		return false
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// WithCallback enables x-background-callback. Payloads are signed with secret, failed deliveries are
+// retried up to maxAttempts times with an exponential backoff starting from backoff.
+func WithCallback(secret string, maxAttempts int, backoff time.Duration) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.callback.secret = secret
+		if maxAttempts > 0 {
+			cfg.callback.maxAttempts = maxAttempts
+		}
+		if backoff > 0 {
+			cfg.callback.backoff = backoff
+		}
+	}
+}
+
+// WithCallbackDestinations restricts where callbacks are delivered. When allowedHosts is not empty callback
+// urls must name one of them. Loopback, private and link-local addresses are refused unless allowPrivate is set.
+func WithCallbackDestinations(allowedHosts []string, allowPrivate bool) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.callback.allowedHosts = nil
+		if len(allowedHosts) > 0 {
+			cfg.callback.allowedHosts = make(map[string]bool, len(allowedHosts))
+			for _, host := range allowedHosts {
+				cfg.callback.allowedHosts[strings.ToLower(host)] = true
+			}
+		}
+		cfg.callback.allowPrivate = allowPrivate
+		cfg.callback.client = newCallbackClient(allowPrivate)
+	}
+}
+
+// WithCallbackSender delivers callbacks with the sender instead of the worker which executed the request,
+// so slow receivers do not hold the workers. Callbacks which do not fit in its queue are not delivered.
+func WithCallbackSender(sender *CallbackSender) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.callback.sender = sender
+	}
+}
+
+// CallbackSender delivers callbacks with a bounded number of workers and queue, apart from the background
+// workers. It is drained with DrainBackground.
+type CallbackSender struct {
+	pool *WorkerPool
+	// ctx is cancelled once the sender is interrupted, pending deliveries are then given up.
+	ctx       context.Context //nolint:containedctx // cancels the deliveries at shutdown
+	interrupt context.CancelFunc
+}
+
+func NewCallbackSender(workers, queueSize int) *CallbackSender {
+	ctx, interrupt := context.WithCancel(context.Background())
+	return &CallbackSender{
+		pool:      NewWorkerPool(workers, queueSize),
+		ctx:       ctx,
+		interrupt: interrupt,
+	}
+}
+
+// submit queues the delivery, its context is cancelled if the sender is interrupted.
+func (s *CallbackSender) submit(ctx context.Context, deliver func(ctx context.Context)) error {
+	return s.pool.TrySubmit(func() {
+		deliveryCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-s.ctx.Done():
+				cancel()
+			case <-deliveryCtx.Done():
+			}
+		}()
+		deliver(deliveryCtx)
+	})
+}
+
+// drain stops accepting callbacks and waits for the pending ones until ctx is done. The deliveries which are
+// still pending then are interrupted, they are recorded as not delivered.
+func (s *CallbackSender) drain(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	s.pool.Close()
+	if err := s.pool.Wait(ctx); err == nil {
+		logger.Info("callbacks drained")
+		return
+	}
+	stats := s.pool.Stats()
+	logger.WithField("callbacks", stats.ActiveWorkers+stats.QueueDepth).Warn("interrupt callbacks")
+	s.interrupt()
+	graceCtx, cancel := context.WithTimeout(withoutCancel(ctx), DefaultInterruptGrace)
+	defer cancel()
+	if err := s.pool.Wait(graceCtx); err != nil {
+		logger.Error("callbacks are still pending after interrupt")
+	}
+}
+
+// CallbackPayload is posted to the callback url once a background request is finished.
+type CallbackPayload struct {
+	BackgroundID string      `json:"background_id"`
+	Code         int         `json:"code"`
+	Headers      http.Header `json:"headers"`
+	Body         []byte      `json:"body"`
+}
+
+// SignCallback returns the value of x-background-signature for the payload sent with the x-background-timestamp
+// timestamp. The signed content is the timestamp, a dot and the payload, so a captured callback can not be
+// replayed with another timestamp.
+func SignCallback(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyCallback checks the signature of a callback received at now. Callbacks whose timestamp is further
+// than tolerance from now are refused, receivers should use DefaultCallbackTolerance unless their clock is off.
+func VerifyCallback(secret, timestamp, signature string, payload []byte, now time.Time,
+	tolerance time.Duration,
+) error {
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: timestamp %q", ErrCallbackSignature, timestamp)
+	}
+	if skew := now.Sub(time.Unix(unixTime, 0)); skew > tolerance || skew < -tolerance {
+		return fmt.Errorf("%w: timestamp is %s off", ErrCallbackSignature, skew)
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignCallback(secret, timestamp, payload))) {
+		return ErrCallbackSignature
+	}
+	return nil
+}
+
+func backgroundCallbackURL(httpHeader http.Header, cfg callbackConfig) (string, error) {
+	rawURL := httpHeader.Get(HTTPHeaderXBackgroundCallback)
+	if rawURL == "" {
+		return "", nil
+	}
+	if cfg.secret == "" {
+		return "", ErrCallbackDisabled
+	}
+	callbackURL, err := url.Parse(rawURL)
+	if err != nil || !callbackURL.IsAbs() || (callbackURL.Scheme != "http" && callbackURL.Scheme != "https") ||
+		callbackURL.Hostname() == "" {
+		return "", ErrInvalidCallbackURL
+	}
+	host := strings.ToLower(callbackURL.Hostname())
+	if cfg.allowedHosts != nil && !cfg.allowedHosts[host] {
+		return "", fmt.Errorf("%w: %s", ErrCallbackDestination, host)
+	}
+	if ip := net.ParseIP(host); ip != nil && !cfg.allowPrivate && !publicIP(ip) {
+		return "", fmt.Errorf("%w: %s", ErrCallbackDestination, host)
+	}
+	return callbackURL.String(), nil
+}
+
+// sendCallback delivers the response of the job to the callback url with the sender of cfg and records the
+// outcome in the job record. The job record of the caller is not changed.
+func sendCallback(ctx context.Context, cacheConn *responsecache.Cache, cfg callbackConfig, job responsecache.Job,
+	callbackURL string, retention time.Duration, httpResp *responsecache.HTTPResponse,
+) {
+	logger := logging.FromContext(ctx).WithField("callback_url", callbackURL)
+	deliver := func(deliveryCtx context.Context) {
+		job.Callback = deliverCallback(deliveryCtx, cfg, callbackURL, job.ID, httpResp)
+		if deliveryCtx.Err() != nil && !job.Callback.Delivered {
+			job.Callback.Error = ErrCallbackInterrupted.Error()
+		}
+		if err := responsecache.SaveJob(ctx, cacheConn, &job, retention); err != nil {
+			logger.WithError(err).Error("save callback delivery in cache failed")
+		}
+	}
+	if cfg.sender == nil {
+		go deliver(ctx)
+		return
+	}
+	if err := cfg.sender.submit(ctx, deliver); err != nil {
+		logger.WithError(err).Error("callback was not delivered")
+		job.Callback = &responsecache.CallbackDelivery{URL: callbackURL, Error: err.Error()}
+		if errSave := responsecache.SaveJob(ctx, cacheConn, &job, retention); errSave != nil {
+			logger.WithError(errSave).Error("save callback delivery in cache failed")
+		}
+	}
+}
+
+// deliverCallback posts the response to the callback url until it is accepted or attempts are exhausted.
+func deliverCallback(ctx context.Context, cfg callbackConfig, callbackURL, backgroundID string,
+	httpResp *responsecache.HTTPResponse,
+) *responsecache.CallbackDelivery {
+	logger := logging.FromContext(ctx).WithField("callback_url", callbackURL)
+	delivery := &responsecache.CallbackDelivery{URL: callbackURL}
+	payload, err := json.Marshal(&CallbackPayload{
+		BackgroundID: backgroundID,
+		Code:         httpResp.Code,
+		Headers:      httpResp.Headers,
+		Body:         httpResp.Body,
+	})
+	if err != nil {
+		logger.WithError(err).Error("encode callback payload failed")
+		delivery.Error = err.Error()
+		return delivery
+	}
+
+	backoff := cfg.backoff
+	for delivery.Attempts < cfg.maxAttempts {
+		if delivery.Attempts > 0 {
+			select {
+			case <-ctx.Done():
+				delivery.Error = ctx.Err().Error()
+				return delivery
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		delivery.Attempts++
+		statusCode, postErr := postCallback(ctx, cfg.client, cfg.secret, callbackURL, backgroundID, payload)
+		delivery.StatusCode = statusCode
+		if postErr == nil {
+			deliveredAt := time.Now().UTC()
+			delivery.Delivered = true
+			delivery.DeliveredAt = &deliveredAt
+			delivery.Error = ""
+			return delivery
+		}
+		delivery.Error = postErr.Error()
+		logger.WithError(postErr).WithField("attempt", delivery.Attempts).Warn("callback delivery failed")
+		if !retryableCallbackCode(statusCode) || errors.Is(postErr, ErrCallbackDestination) {
+			break
+		}
+	}
+	logger.Error("callback was not delivered")
+	return delivery
+}
+
+// postCallback posts the payload signed with the time of the attempt.
+func postCallback(ctx context.Context, client *http.Client, secret, callbackURL, backgroundID string,
+	payload []byte,
+) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("create callback request: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HTTPHeaderXBackgroundID, backgroundID)
+	req.Header.Set(HTTPHeaderXBackgroundTimestamp, timestamp)
+	req.Header.Set(HTTPHeaderXBackgroundSignature, SignCallback(secret, timestamp, payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("post callback: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp.StatusCode, fmt.Errorf("callback responded with %d", resp.StatusCode) //nolint:goerr113 // dynamic
+	}
+	return resp.StatusCode, nil
+}
+
+// retryableCallbackCode reports whether a delivery ended with the code is worth another attempt.
+// Zero code means the request did not reach the receiver.
+func retryableCallbackCode(code int) bool {
+	return code == 0 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout ||
+		code >= http.StatusInternalServerError
+}
@@ -0,0 +1,274 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestDeliverCallback_RetryThenDelivered(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	secret := "shared secret"
+	bgID := "ef24471b-e968-40f0-b4d4-c9d0410565c8"
+	httpResp := &responsecache.HTTPResponse{
+		Code:    http.StatusOK,
+		Headers: http.Header{"X-Custom": []string{"value"}},
+		Body:    []byte("a long time ago"),
+	}
+
+	calls := 0
+	var gotPayload CallbackPayload
+	var signatureErr error
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		signatureErr = VerifyCallback(secret, r.Header.Get(HTTPHeaderXBackgroundTimestamp),
+			r.Header.Get(HTTPHeaderXBackgroundSignature), body, time.Now(), DefaultCallbackTolerance)
+		if err = json.Unmarshal(body, &gotPayload); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	cfg := defaultCallbackConfig()
+	cfg.secret = secret
+	cfg.backoff = time.Millisecond
+	cfg.client = newCallbackClient(true)
+	delivery := deliverCallback(ctx, cfg, receiver.URL, bgID, httpResp)
+
+	assert.True(t, delivery.Delivered)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Equal(t, http.StatusNoContent, delivery.StatusCode)
+	assert.Empty(t, delivery.Error)
+	assert.NoError(t, signatureErr)
+	assert.Equal(t, CallbackPayload{
+		BackgroundID: bgID,
+		Code:         httpResp.Code,
+		Headers:      httpResp.Headers,
+		Body:         httpResp.Body,
+	}, gotPayload)
+}
+
+func TestDeliverCallback_NotRetryable(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	cfg := defaultCallbackConfig()
+	cfg.secret = "shared secret"
+	cfg.backoff = time.Millisecond
+	cfg.client = newCallbackClient(true)
+	delivery := deliverCallback(ctx, cfg, receiver.URL, "uniq_id", &responsecache.HTTPResponse{Code: http.StatusOK})
+
+	assert.False(t, delivery.Delivered)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusBadRequest, delivery.StatusCode)
+	assert.NotEmpty(t, delivery.Error)
+}
+
+func TestDeliverCallback_PrivateDestination(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer receiver.Close()
+
+	cfg := defaultCallbackConfig()
+	cfg.secret = "shared secret"
+	cfg.backoff = time.Millisecond
+	delivery := deliverCallback(ctx, cfg, receiver.URL, "uniq_id", &responsecache.HTTPResponse{Code: http.StatusOK})
+
+	assert.False(t, delivery.Delivered)
+	assert.Zero(t, calls)
+	assert.Equal(t, 1, delivery.Attempts, "refused destinations are not retried")
+	assert.Contains(t, delivery.Error, ErrCallbackDestination.Error())
+}
+
+func TestSendCallback(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	cacheConn := &responsecache.Cache{Store: responsecache.NewMemoryStore(0)}
+	delivered := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(delivered)
+	}))
+	defer receiver.Close()
+
+	cfg := defaultCallbackConfig()
+	cfg.secret = "shared secret"
+	cfg.client = newCallbackClient(true)
+	cfg.sender = NewCallbackSender(1, 0)
+	job := &responsecache.Job{ID: "uniq_id", Status: responsecache.JobSucceeded}
+	sendCallback(ctx, cacheConn, cfg, *job, receiver.URL, 0, &responsecache.HTTPResponse{Code: http.StatusOK})
+
+	<-delivered
+	assert.Eventually(t, func() bool {
+		saved, err := responsecache.GetJob(ctx, cacheConn, "uniq_id")
+		return err == nil && saved.Callback != nil && saved.Callback.Delivered
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, job.Callback, "the job record of the caller is not changed")
+
+	// the sender is busy and has no queue
+	assert.Eventually(t, func() bool {
+		return cfg.sender.pool.Stats().ActiveWorkers == 0
+	}, time.Second, time.Millisecond)
+	blocked := make(chan struct{})
+	defer close(blocked)
+	assert.NoError(t, cfg.sender.pool.TrySubmit(func() { <-blocked }))
+	sendCallback(ctx, cacheConn, cfg, *job, receiver.URL, 0, &responsecache.HTTPResponse{Code: http.StatusOK})
+	saved, err := responsecache.GetJob(ctx, cacheConn, "uniq_id")
+	assert.NoError(t, err)
+	assert.False(t, saved.Callback.Delivered)
+	assert.Equal(t, ErrQueueFull.Error(), saved.Callback.Error)
+}
+
+func TestVerifyCallback(t *testing.T) {
+	secret := "shared secret"
+	payload := []byte(`{"background_id":"uniq_id"}`)
+	now := time.Unix(1700000000, 0)
+	timestamp := "1700000000"
+	signature := SignCallback(secret, timestamp, payload)
+	testCases := []struct {
+		name        string
+		secret      string
+		timestamp   string
+		signature   string
+		payload     []byte
+		now         time.Time
+		expectedErr error
+	}{
+		{name: "valid", secret: secret, timestamp: timestamp, signature: signature, payload: payload, now: now},
+		{
+			name: "within tolerance", secret: secret, timestamp: timestamp, signature: signature, payload: payload,
+			now: now.Add(DefaultCallbackTolerance),
+		},
+		{
+			name: "replayed", secret: secret, timestamp: timestamp, signature: signature, payload: payload,
+			now: now.Add(DefaultCallbackTolerance + time.Second), expectedErr: ErrCallbackSignature,
+		},
+		{
+			name: "from the future", secret: secret, timestamp: timestamp, signature: signature, payload: payload,
+			now: now.Add(-DefaultCallbackTolerance - time.Second), expectedErr: ErrCallbackSignature,
+		},
+		{
+			name: "other timestamp", secret: secret, timestamp: "1700000001", signature: signature, payload: payload,
+			now: now, expectedErr: ErrCallbackSignature,
+		},
+		{
+			name: "other payload", secret: secret, timestamp: timestamp, signature: signature, payload: []byte("{}"),
+			now: now, expectedErr: ErrCallbackSignature,
+		},
+		{
+			name: "other secret", secret: "other secret", timestamp: timestamp, signature: signature,
+			payload: payload, now: now, expectedErr: ErrCallbackSignature,
+		},
+		{
+			name: "malformed timestamp", secret: secret, timestamp: "yesterday", signature: signature,
+			payload: payload, now: now, expectedErr: ErrCallbackSignature,
+		},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyCallback(tc.secret, tc.timestamp, tc.signature, tc.payload, tc.now, DefaultCallbackTolerance)
+			assert.ErrorIs(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestBackgroundCallbackURL(t *testing.T) {
+	enabled := defaultCallbackConfig()
+	enabled.secret = "shared secret"
+	restricted := enabled
+	restricted.allowedHosts = map[string]bool{"hooks.example.com": true}
+	testCases := []struct {
+		name        string
+		rawURL      string
+		cfg         callbackConfig
+		expectedURL string
+		expectedErr error
+	}{
+		{name: "no callback", rawURL: "", cfg: enabled},
+		{name: "valid", rawURL: "https://example.com/hook", cfg: enabled, expectedURL: "https://example.com/hook"},
+		{name: "relative", rawURL: "/hook", cfg: enabled, expectedErr: ErrInvalidCallbackURL},
+		{name: "not http", rawURL: "ftp://example.com/hook", cfg: enabled, expectedErr: ErrInvalidCallbackURL},
+		{name: "loopback", rawURL: "http://127.0.0.1:8080/hook", cfg: enabled, expectedErr: ErrCallbackDestination},
+		{name: "link-local", rawURL: "http://[fe80::1]/hook", cfg: enabled, expectedErr: ErrCallbackDestination},
+		{name: "carrier-grade nat", rawURL: "http://100.64.0.1/hook", cfg: enabled, expectedErr: ErrCallbackDestination},
+		{
+			name: "ipv4-mapped private", rawURL: "http://[::ffff:10.0.0.1]/hook", cfg: enabled,
+			expectedErr: ErrCallbackDestination,
+		},
+		{
+			name: "ipv4-mapped loopback", rawURL: "http://[::ffff:127.0.0.1]/hook", cfg: enabled,
+			expectedErr: ErrCallbackDestination,
+		},
+		{
+			name: "nat64 private", rawURL: "http://[64:ff9b::a00:1]/hook", cfg: enabled,
+			expectedErr: ErrCallbackDestination,
+		},
+		{
+			name: "nat64 carrier-grade nat", rawURL: "http://[64:ff9b::6440:1]/hook", cfg: enabled,
+			expectedErr: ErrCallbackDestination,
+		},
+		{
+			name: "nat64 local prefix", rawURL: "http://[64:ff9b:1::808:808]/hook", cfg: enabled,
+			expectedErr: ErrCallbackDestination,
+		},
+		{
+			name: "nat64 public", rawURL: "http://[64:ff9b::808:808]/hook", cfg: enabled,
+			expectedURL: "http://[64:ff9b::808:808]/hook",
+		},
+		{
+			name: "allowed host", rawURL: "https://Hooks.example.com/hook", cfg: restricted,
+			expectedURL: "https://Hooks.example.com/hook",
+		},
+		{
+			name: "host not allowed", rawURL: "https://example.com/hook", cfg: restricted,
+			expectedErr: ErrCallbackDestination,
+		},
+		{
+			name: "disabled", rawURL: "https://example.com/hook", cfg: defaultCallbackConfig(),
+			expectedErr: ErrCallbackDisabled,
+		},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			httpHeaders := make(http.Header)
+			if tc.rawURL != "" {
+				httpHeaders.Add(HTTPHeaderXBackgroundCallback, tc.rawURL)
+			}
+			gotURL, err := backgroundCallbackURL(httpHeaders, tc.cfg)
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expectedURL, gotURL)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package webapi
+
+import (
+	"context"
+	"time"
+)
+
+type uncancelableContext struct {
+	context.Context //nolint:containedctx // values are still taken from the parent
+}
+
+func (uncancelableContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (uncancelableContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (uncancelableContext) Err() error {
+	return nil
+}
+
+// withoutCancel returns a context which keeps the values of the parent but is never cancelled.
+// It is used to roll back or finish a distributed transaction after the request was cancelled.
+func withoutCancel(ctx context.Context) context.Context {
+	return uncancelableContext{Context: ctx}
+}
@@ -0,0 +1,132 @@
+package webapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+// EventsHeartbeat is the interval of comments keeping idle event streams open.
+const EventsHeartbeat = 15 * time.Second
+
+// BackgroundEvents streams events of a background job as Server-Sent Events. The stream starts with
+// a status snapshot and ends with the completed event. Jobs of other callers are reported as not found.
+//
+//nolint:cyclop // a flat event loop is easier to follow
+func BackgroundEvents(cacheConn *responsecache.Cache, owns OwnershipCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+		bgID := chi.URLParam(r, "bg_id")
+		logger = logger.WithField("bg_id", bgID)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			logger.Error("response writer does not support flushing")
+			InternalError(ctx, w, "streaming is not supported")
+			return
+		}
+		pubsub, err := responsecache.SubscribeEvents(ctx, cacheConn, bgID)
+		if errors.Is(err, responsecache.ErrNotSupported) {
+			logger.WithError(err).Warn("events are not available")
+			NotImplemented(ctx, w, "events are not supported by the cache store")
+			return
+		}
+		if err != nil {
+			logger.WithError(err).Error("subscribe to events failed")
+			InternalError(ctx, w, "subscribe to events failed")
+			return
+		}
+		defer func() {
+			_ = pubsub.Close()
+		}()
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if err != nil {
+			if errors.Is(err, responsecache.ErrNotFound) {
+				logger.Warn("background id not found")
+				NotFound(ctx, w, "background id not found")
+				return
+			}
+			logger.WithError(err).Error("get job failed")
+			InternalError(ctx, w, "get job failed")
+			return
+		}
+		if !owns(ctx, job.Owner) {
+			logger.Warn("background job belongs to another caller")
+			NotFound(ctx, w, "background id not found")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		snapshot := &responsecache.Event{
+			Type:         responsecache.EventStatus,
+			BackgroundID: bgID,
+			Time:         time.Now().UTC(),
+			Job:          job,
+		}
+		if job.Status.Finished() {
+			if httpResp, errResp := responsecache.GetResponse(ctx, cacheConn, bgID); errResp == nil {
+				snapshot.Response = httpResp
+			}
+		}
+		if err = writeEvent(w, flusher, snapshot); err != nil || job.Status.Finished() {
+			return
+		}
+
+		heartbeat := time.NewTicker(EventsHeartbeat)
+		defer heartbeat.Stop()
+		events := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-events:
+				if !ok {
+					return
+				}
+				event := new(responsecache.Event)
+				if err = event.UnmarshalBinary([]byte(msg.Payload)); err != nil {
+					logger.WithError(err).Warn("decode background event failed")
+					continue
+				}
+				if err = responsecache.OpenEvent(cacheConn, event); err != nil {
+					logger.WithError(err).Error("decrypt background event failed")
+					continue
+				}
+				if err = writeEvent(w, flusher, event); err != nil {
+					logger.WithError(err).Warn("write background event failed")
+					return
+				}
+				if event.Type == responsecache.EventCompleted {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err = io.WriteString(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func writeEvent(w io.Writer, flusher http.Flusher, event *responsecache.Event) error {
+	data, err := event.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return fmt.Errorf("write event: %w", err)
+	}
+	flusher.Flush()
+	return nil
+}
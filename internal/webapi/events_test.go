@@ -0,0 +1,105 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redismock/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+type progressResponse struct{}
+
+func (p *progressResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	time.Sleep(30 * time.Millisecond) //nolint:revive,gomnd // wait till the request is detached
+	ReportProgress(ctx, "halfway")
+	StatusOk(ctx, w, "done")
+}
+
+func TestReportProgress_Background(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	httpHeaders := make(http.Header)
+	httpHeaders.Add(HTTPHeaderXBackground, "true")
+	httpHeaders.Add(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+
+	mockedUUID := uuid.MustParse("ef24471b-e968-40f0-b4d4-c9d0410565c8")
+	bgID := mockedUUID.String()
+	patches := gomonkey.ApplyFunc(uuid.New, func() uuid.UUID {
+		return mockedUUID
+	})
+	defer patches.Reset()
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+		Format: responsecache.FormatBinary,
+	}
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventAccepted)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventProgress)
+	mockedCacheConn.ExpectSet(bgID, &responsecache.HTTPResponse{
+		Code:    http.StatusOK,
+		Headers: make(map[string][]string),
+		Body:    []byte("done"),
+	}, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobSucceeded, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventCompleted)
+
+	handlerFn := AsyncMw(cacheConn)(new(progressResponse))
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header = httpHeaders
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+
+	<-time.NewTimer(60 * time.Millisecond).C // need to wait till handler completion
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestWriteEvent(t *testing.T) {
+	testRecorder := httptest.NewRecorder()
+	event := &responsecache.Event{
+		Type:         responsecache.EventProgress,
+		BackgroundID: "uniq_id",
+		Time:         time.Date(2022, 4, 20, 10, 0, 0, 0, time.UTC),
+		Stage:        "user_prepared",
+	}
+
+	err := writeEvent(testRecorder, testRecorder, event)
+
+	assert.NoError(t, err)
+	assert.True(t, testRecorder.Flushed)
+	expectedBody := "event: progress\n" +
+		`data: {"type":"progress","background_id":"uniq_id","time":"2022-04-20T10:00:00Z","stage":"user_prepared"}` +
+		"\n\n"
+	assert.Equal(t, expectedBody, testRecorder.Body.String())
+}
+
+func TestBackgroundEvents_NotSupported(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	cacheConn := &responsecache.Cache{
+		Store: responsecache.NewMemoryStore(0),
+	}
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-events/{bg_id}", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", "uniq_id")
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+	BackgroundEvents(cacheConn, CallerOwns).ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusNotImplemented, testRecorder.Code)
+}
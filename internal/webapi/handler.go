@@ -48,8 +48,11 @@ type Message struct {
 // @Accept       json
 // @Produce      json
 // @Param        message body Message true "Message"
+// @Param        Idempotency-Key header string false "Retries with the same key replay the first response"
 // @Success      200  {string} string	"ok"
 // @Failure      400  {string} string	"message decode error"
+// @Failure      409  {string} string	"idempotency key is used for another request or in progress"
+// @Failure      499  {string} string	"request cancelled"
 // @Failure      500  {string} string	"server error"
 // @Router       /send [post].
 func (h *Handler) SendMessage(writer http.ResponseWriter, request *http.Request) {
@@ -74,11 +77,35 @@ func (h *Handler) SendMessage(writer http.ResponseWriter, request *http.Request)
 	createUser, err := h.UserClient.CreateUser(ctx, user)
 	if err != nil {
 		logger.WithError(err).Error("Error while creating user")
+		if ctx.Err() != nil {
+			RequestCancelled(ctx, writer, "Request cancelled")
+
+			return
+		}
+		ReportError(ctx, err)
 		InternalError(ctx, writer, "Error while creating user")
 
 		return
 	}
 	userTx := createUser.GetTxId()
+	ReportProgress(ctx, "user_prepared")
+	// prepared transactions must be finished even if the request is cancelled.
+	txCtx := withoutCancel(ctx)
+	userRollback := &userTxPb.TxToRollback{TxId: userTx}
+
+	if ctx.Err() != nil {
+		logger.WithError(ctx.Err()).Warn("Request cancelled after creating user")
+		_, errRollback := h.UserTxClient.Rollback(txCtx, userRollback)
+		if errRollback != nil {
+			logger.WithError(errRollback).Error("Error while rollback user")
+			InternalError(ctx, writer, "Error while rollback user")
+
+			return
+		}
+		RequestCancelled(ctx, writer, "Request cancelled. User rollback success")
+
+		return
+	}
 
 	order := &orderPb.Order{
 		UserId:    createUser.GetId(),
@@ -88,29 +115,60 @@ func (h *Handler) SendMessage(writer http.ResponseWriter, request *http.Request)
 	insertOrder, err := h.OrderClient.InsertOrder(ctx, order)
 	if err != nil {
 		logger.WithError(err).Error("Error while creating order")
-		userRollback := &userTxPb.TxToRollback{TxId: userTx}
-		_, errRollback := h.UserTxClient.Rollback(ctx, userRollback)
+		_, errRollback := h.UserTxClient.Rollback(txCtx, userRollback)
 		if errRollback != nil {
 			logger.WithError(errRollback).Error("Error while rollback user")
 			InternalError(ctx, writer, "Error while rollback user")
 
 			return
 		}
+		if ctx.Err() != nil {
+			RequestCancelled(ctx, writer, "Request cancelled. User rollback success")
+
+			return
+		}
+		ReportError(ctx, err)
 		InternalError(ctx, writer, "Error while creating order. User rollback success")
 
 		return
 	}
 	orderTx := insertOrder.GetTnx()
+	ReportProgress(ctx, "order_prepared")
+
+	if ctx.Err() != nil {
+		logger.WithError(ctx.Err()).Warn("Request cancelled after creating order")
+		_, errRollback := h.UserTxClient.Rollback(txCtx, userRollback)
+		if errRollback != nil {
+			logger.WithError(errRollback).Error("Error while rollback user")
+		}
+		orderRollback := &orderPb.Confirmation{
+			Tnx:    orderTx,
+			Commit: false,
+		}
+		_, errRollbackOrder := h.OrderTxClient.SendConfirmation(txCtx, orderRollback)
+		if errRollbackOrder != nil {
+			logger.WithError(errRollbackOrder).Error("Error while rollback order")
+		}
+		if errRollback != nil || errRollbackOrder != nil {
+			InternalError(ctx, writer, "Error while rollback user and order")
+
+			return
+		}
+		RequestCancelled(ctx, writer, "Request cancelled. User and order rollback success")
+
+		return
+	}
 
+	// from here on the transactions are committed and the request can not be cancelled any more.
 	userCommit := &userTxPb.TxToCommit{TxId: userTx}
-	_, errCommit := h.UserTxClient.Commit(ctx, userCommit)
+	_, errCommit := h.UserTxClient.Commit(txCtx, userCommit)
 	if errCommit != nil {
 		logger.WithError(errCommit).Error("Error while commit user")
 		orderRollback := &orderPb.Confirmation{
 			Tnx:    orderTx,
 			Commit: false,
 		}
-		_, errRollback := h.OrderTxClient.SendConfirmation(ctx, orderRollback)
+		_, errRollback := h.OrderTxClient.SendConfirmation(txCtx, orderRollback)
 		if errRollback != nil {
 			logger.WithError(errRollback).Error("Error while rollback order. User commit success")
 			InternalError(ctx, writer, "Error while rollback order. User commit success")
@@ -121,18 +179,20 @@ func (h *Handler) SendMessage(writer http.ResponseWriter, request *http.Request)
 
 		return
 	}
+	ReportProgress(ctx, "user_committed")
 
 	orderCommit := &orderPb.Confirmation{
 		Tnx:    orderTx,
 		Commit: true,
 	}
-	_, errCommitOrder := h.OrderTxClient.SendConfirmation(ctx, orderCommit)
+	_, errCommitOrder := h.OrderTxClient.SendConfirmation(txCtx, orderCommit)
 	if errCommitOrder != nil {
 		logger.WithError(errCommitOrder).Error("Error while commit order")
 		InternalError(ctx, writer, "Error while commit order. User commit success")
 
 		return
 	}
+	ReportProgress(ctx, "order_committed")
 
 	StatusOk(ctx, writer, "User and order created")
 }
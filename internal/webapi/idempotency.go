@@ -0,0 +1,285 @@
+package webapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+const (
+	HTTPHeaderIdempotencyKey     = "Idempotency-Key"
+	HTTPHeaderIdempotentReplayed = "Idempotent-Replayed"
+	DefaultIdempotencyTTL        = 24 * time.Hour
+	// MaxIdempotencyKeyLength limits the Idempotency-Key header, longer keys are rejected with 400.
+	MaxIdempotencyKeyLength       = 255
+	idempotencyInProgressResponse = "request with the idempotency key is in progress"
+)
+
+type idempotentRequestKey struct{}
+
+// idempotentRequest is a request which reserved its Idempotency-Key and is being executed.
+type idempotentRequest struct {
+	key         string
+	fingerprint string
+	createdAt   time.Time
+	ttl         time.Duration
+	// backgroundID is set once AsyncMw detached the request, the record is then completed by the background job.
+	backgroundID string
+}
+
+func withIdempotentRequest(ctx context.Context, idem *idempotentRequest) context.Context {
+	return context.WithValue(ctx, idempotentRequestKey{}, idem)
+}
+
+func idempotentRequestFromContext(ctx context.Context) *idempotentRequest {
+	idem, _ := ctx.Value(idempotentRequestKey{}).(*idempotentRequest)
+	return idem
+}
+
+// idempotentRequestFromRef restores the request a scheduled request completes, nil if it has no key.
+func idempotentRequestFromRef(ref *responsecache.IdempotencyRef, backgroundID string) *idempotentRequest {
+	if ref == nil {
+		return nil
+	}
+	return &idempotentRequest{
+		key:          ref.Key,
+		fingerprint:  ref.Fingerprint,
+		createdAt:    ref.CreatedAt,
+		ttl:          ref.TTL,
+		backgroundID: backgroundID,
+	}
+}
+
+// ref returns the reference persisted with a scheduled request.
+func (i *idempotentRequest) ref() *responsecache.IdempotencyRef {
+	if i == nil {
+		return nil
+	}
+	return &responsecache.IdempotencyRef{
+		Key:         i.key,
+		Fingerprint: i.fingerprint,
+		CreatedAt:   i.createdAt,
+		TTL:         i.ttl,
+	}
+}
+
+// detach records the background id so that retries get it while the job is running.
+func (i *idempotentRequest) detach(ctx context.Context, cacheConn *responsecache.Cache, backgroundID string,
+	retention time.Duration,
+) {
+	if i == nil {
+		return
+	}
+	i.backgroundID = backgroundID
+	i.save(ctx, cacheConn, &responsecache.IdempotencyRecord{
+		BackgroundID: backgroundID,
+		Retention:    retention,
+	})
+}
+
+// complete stores the response replayed for retries. Failed and cancelled requests release the key,
+// so the client may retry them.
+func (i *idempotentRequest) complete(ctx context.Context, cacheConn *responsecache.Cache,
+	httpResp *responsecache.HTTPResponse,
+) {
+	if i == nil {
+		return
+	}
+	if httpResp.Code >= http.StatusInternalServerError || httpResp.Code == StatusClientClosedRequest {
+		if err := responsecache.DeleteIdempotencyRecord(ctx, cacheConn, i.key); err != nil {
+			logging.FromContext(ctx).WithError(err).Error("release idempotency key failed")
+		}
+		return
+	}
+	i.save(ctx, cacheConn, &responsecache.IdempotencyRecord{
+		BackgroundID: i.backgroundID,
+		Response:     httpResp,
+	})
+}
+
+func (i *idempotentRequest) save(ctx context.Context, cacheConn *responsecache.Cache,
+	record *responsecache.IdempotencyRecord,
+) {
+	record.Fingerprint = i.fingerprint
+	record.CreatedAt = i.createdAt
+	if err := responsecache.SaveIdempotencyRecord(ctx, cacheConn, i.key, record, i.ttl); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("save idempotency record failed")
+	}
+}
+
+// IdempotencyMw executes a request with an Idempotency-Key once. Retries get the stored response or the id
+// of the background job, a key reused for another request is rejected with 409. Records expire after ttl,
+// DefaultIdempotencyTTL is used when it is not positive. The body is buffered to fingerprint the request,
+// bodies above maxBodySize bytes are rejected with 413, DefaultMaxBodySize is used when it is not positive.
+func IdempotencyMw(cacheConn *responsecache.Cache, ttl time.Duration, maxBodySize int64,
+) func(http.Handler) http.Handler {
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			key := r.Header.Get(HTTPHeaderIdempotencyKey)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > MaxIdempotencyKeyLength {
+				logging.FromContext(ctx).WithField("length", len(key)).Warn("idempotency key is too long")
+				BadRequest(ctx, w, fmt.Sprintf("%s must not exceed %d bytes", HTTPHeaderIdempotencyKey,
+					MaxIdempotencyKeyLength))
+				return
+			}
+			logger := logging.FromContext(ctx).WithField("idempotency_key", key)
+			body, err := readBody(r, maxBodySize)
+			if err != nil {
+				logger.WithError(err).Warn("read request body failed")
+				if errors.Is(err, ErrBodyTooLarge) {
+					RequestEntityTooLarge(ctx, w, err.Error())
+					return
+				}
+				BadRequest(ctx, w, "read request body failed")
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			storeKey := key
+			if caller := CallerFromContext(ctx); caller != "" {
+				// keys are chosen by clients, they are unique per caller only.
+				storeKey = caller + "/" + key
+			}
+			idem := &idempotentRequest{
+				key:         storeKey,
+				fingerprint: requestFingerprint(r.Method, r.URL.Path, body),
+				createdAt:   time.Now().UTC(),
+				ttl:         ttl,
+			}
+			reserved, err := responsecache.ReserveIdempotencyKey(ctx, cacheConn, storeKey, &responsecache.IdempotencyRecord{
+				Fingerprint: idem.fingerprint,
+				CreatedAt:   idem.createdAt,
+			}, ttl)
+			if err != nil {
+				logger.WithError(err).Error("reserve idempotency key failed")
+				InternalError(ctx, w, "reserve idempotency key failed")
+				return
+			}
+			if !reserved {
+				replayIdempotent(ctx, w, cacheConn, idem)
+				return
+			}
+
+			recorder := newResponseRecorder(w)
+			next.ServeHTTP(recorder, r.WithContext(withIdempotentRequest(ctx, idem)))
+			if idem.backgroundID != "" {
+				return
+			}
+			idem.complete(withoutCancel(ctx), cacheConn, recorder.response())
+		})
+	}
+}
+
+func replayIdempotent(ctx context.Context, w http.ResponseWriter, cacheConn *responsecache.Cache,
+	idem *idempotentRequest,
+) {
+	logger := logging.FromContext(ctx).WithField("idempotency_key", idem.key)
+	record, err := responsecache.GetIdempotencyRecord(ctx, cacheConn, idem.key)
+	if err != nil {
+		if errors.Is(err, responsecache.ErrNotFound) {
+			// the first request failed and released the key meanwhile
+			logger.Warn("idempotency record not found")
+			Conflict(ctx, w, idempotencyInProgressResponse)
+			return
+		}
+		logger.WithError(err).Error("get idempotency record failed")
+		InternalError(ctx, w, "get idempotency record failed")
+		return
+	}
+	if record.Fingerprint != idem.fingerprint {
+		logger.Warn("idempotency key reused for another request")
+		Conflict(ctx, w, "idempotency key is already used for another request")
+		return
+	}
+	switch {
+	case record.Response != nil:
+		logger.Trace("replay stored response")
+		w.Header().Set(HTTPHeaderIdempotentReplayed, "true")
+		rawResponse(ctx, w, record.Response.Code, record.Response.Headers, record.Response.Body)
+	case record.BackgroundID != "":
+		logger.WithField("bg_id", record.BackgroundID).Trace("replay background id")
+		w.Header().Set(HTTPHeaderIdempotentReplayed, "true")
+		StatusAccepted(ctx, w, "request is already executed in the background", record.BackgroundID,
+			record.Retention)
+	default:
+		logger.Warn("idempotent request is in progress")
+		Conflict(ctx, w, idempotencyInProgressResponse)
+	}
+}
+
+// requestFingerprint identifies the payload a key was first used with.
+func requestFingerprint(method, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + "\n" + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder passes the response through and keeps a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	buf  bytes.Buffer
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{
+		ResponseWriter: w,
+		code:           http.StatusOK,
+	}
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.code = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.buf.Write(b)
+	return r.ResponseWriter.Write(b) //nolint:wrapcheck // passthrough writer
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack() //nolint:wrapcheck // passthrough writer
+}
+
+func (r *responseRecorder) response() *responsecache.HTTPResponse {
+	return &responsecache.HTTPResponse{
+		Code:    r.code,
+		Headers: r.Header().Clone(),
+		Body:    r.buf.Bytes(),
+	}
+}
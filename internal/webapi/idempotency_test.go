@@ -0,0 +1,284 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/go-redis/redismock/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+const testIdempotencyKey = "6d1c3b8e-retry"
+
+// expectIdempotencyRecord expects the record of testIdempotencyKey to be stored by SET,
+// or by SET NX when reserve is true.
+func expectIdempotencyRecord(mockedCacheConn redismock.ClientMock, reserve bool,
+	check func(record *responsecache.IdempotencyRecord) bool,
+) *redismock.ExpectedStatus {
+	key := responsecache.IdempotencyKey(testIdempotencyKey)
+	matcher := mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		if actual[1] != key {
+			return fmt.Errorf("unexpected key %v", actual[1])
+		}
+		record, ok := actual[2].(*responsecache.IdempotencyRecord)
+		if !ok || record.Fingerprint == "" || !check(record) {
+			return fmt.Errorf("unexpected record %+v", actual[2])
+		}
+		return nil
+	})
+	if reserve {
+		matcher.ExpectSetNX(key, nil, DefaultIdempotencyTTL).SetVal(true)
+		return nil
+	}
+	return matcher.ExpectSet(key, nil, DefaultIdempotencyTTL)
+}
+
+func expectIdempotencyReplay(t *testing.T, mockedCacheConn redismock.ClientMock,
+	record *responsecache.IdempotencyRecord,
+) {
+	t.Helper()
+	key := responsecache.IdempotencyKey(testIdempotencyKey)
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		if actual[1] != key {
+			return fmt.Errorf("unexpected key %v", actual[1])
+		}
+		return nil
+	}).ExpectSetNX(key, nil, DefaultIdempotencyTTL).SetVal(false)
+	rawRecord, err := json.Marshal(record)
+	assert.NoError(t, err)
+	mockedCacheConn.ExpectGet(key).SetVal(string(rawRecord))
+}
+
+func newIdempotentRequest(ctx context.Context, body string) *http.Request {
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body))
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header.Set(HTTPHeaderIdempotencyKey, testIdempotencyKey)
+	return testRequest
+}
+
+func TestIdempotencyMw_FirstRequest(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	expectIdempotencyRecord(mockedCacheConn, true, func(record *responsecache.IdempotencyRecord) bool {
+		return record.Response == nil
+	})
+	expectIdempotencyRecord(mockedCacheConn, false, func(record *responsecache.IdempotencyRecord) bool {
+		return record.Response != nil && record.Response.Code == http.StatusOK &&
+			string(record.Response.Body) == "fast and furious"
+	}).SetVal("OK")
+
+	handlerFn := IdempotencyMw(cacheConn, 0, 0)(new(handlerResponse))
+	testRecorder := httptest.NewRecorder()
+	handlerFn.ServeHTTP(testRecorder, newIdempotentRequest(ctx, `{"name":"John"}`))
+
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.Equal(t, "fast and furious", testRecorder.Body.String())
+	assert.Empty(t, testRecorder.Header().Get(HTTPHeaderIdempotentReplayed))
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestIdempotencyMw_Limits(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	handlerFn := IdempotencyMw(cacheConn, 0, 16)(new(handlerResponse))
+
+	testRecorder := httptest.NewRecorder()
+	handlerFn.ServeHTTP(testRecorder, newIdempotentRequest(ctx, `{"name":"John Ronald Reuel"}`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, testRecorder.Code)
+
+	memoryCache := &responsecache.Cache{Store: responsecache.NewMemoryStore(0)}
+	testRecorder = httptest.NewRecorder()
+	IdempotencyMw(memoryCache, 0, 16)(new(handlerResponse)).ServeHTTP(testRecorder,
+		newIdempotentRequest(ctx, `{"name":"Johny"}`))
+	assert.Equal(t, http.StatusOK, testRecorder.Code, "a body of the limit is accepted")
+
+	testRequest := newIdempotentRequest(ctx, `{}`)
+	testRequest.Header.Set(HTTPHeaderIdempotencyKey, strings.Repeat("k", MaxIdempotencyKeyLength+1))
+	testRecorder = httptest.NewRecorder()
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+	assert.Equal(t, http.StatusBadRequest, testRecorder.Code)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "rejected requests do not reserve the key")
+}
+
+type failedResponse struct{}
+
+func (f *failedResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	InternalError(r.Context(), w, "server error")
+}
+
+func TestIdempotencyMw_ServerErrorReleasesKey(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	expectIdempotencyRecord(mockedCacheConn, true, func(record *responsecache.IdempotencyRecord) bool {
+		return record.Response == nil
+	})
+	mockedCacheConn.ExpectDel(responsecache.IdempotencyKey(testIdempotencyKey)).SetVal(1)
+
+	handlerFn := IdempotencyMw(cacheConn, 0, 0)(new(failedResponse))
+	testRecorder := httptest.NewRecorder()
+	handlerFn.ServeHTTP(testRecorder, newIdempotentRequest(ctx, `{"name":"John"}`))
+
+	assert.Equal(t, http.StatusInternalServerError, testRecorder.Code)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestIdempotencyMw_Replay(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	body := `{"name":"John"}`
+	fingerprint := requestFingerprint(http.MethodPost, "/send", []byte(body))
+	testCases := []struct {
+		name           string
+		body           string
+		record         *responsecache.IdempotencyRecord
+		expectedCode   int
+		expectedBody   string
+		expectedBgID   string
+		expectReplayed bool
+	}{
+		{
+			name: "stored response",
+			body: body,
+			record: &responsecache.IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Response: &responsecache.HTTPResponse{
+					Code:    http.StatusOK,
+					Headers: http.Header{"X-Custom": []string{"value"}},
+					Body:    []byte("ok"),
+				},
+			},
+			expectedCode:   http.StatusOK,
+			expectedBody:   "ok",
+			expectReplayed: true,
+		},
+		{
+			name: "running in background",
+			body: body,
+			record: &responsecache.IdempotencyRecord{
+				Fingerprint:  fingerprint,
+				BackgroundID: "uniq_id",
+				Retention:    time.Hour,
+			},
+			expectedCode:   http.StatusAccepted,
+			expectedBody:   "request is already executed in the background",
+			expectedBgID:   "uniq_id",
+			expectReplayed: true,
+		},
+		{
+			name:         "in progress",
+			body:         body,
+			record:       &responsecache.IdempotencyRecord{Fingerprint: fingerprint},
+			expectedCode: http.StatusConflict,
+			expectedBody: idempotencyInProgressResponse,
+		},
+		{
+			name: "another payload",
+			body: `{"name":"Jane"}`,
+			record: &responsecache.IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Response:    &responsecache.HTTPResponse{Code: http.StatusOK},
+			},
+			expectedCode: http.StatusConflict,
+			expectedBody: "idempotency key is already used for another request",
+		},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			redisClient, mockedCacheConn := redismock.NewClientMock()
+			cacheConn := &responsecache.Cache{
+				Client: redisClient,
+			}
+			expectIdempotencyReplay(t, mockedCacheConn, tc.record)
+
+			handlerFn := IdempotencyMw(cacheConn, 0, 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("handler must not be called for a retry")
+			}))
+			testRecorder := httptest.NewRecorder()
+			handlerFn.ServeHTTP(testRecorder, newIdempotentRequest(ctx, tc.body))
+
+			assert.Equal(t, tc.expectedCode, testRecorder.Code)
+			assert.Equal(t, tc.expectedBody, testRecorder.Body.String())
+			assert.Equal(t, tc.expectedBgID, testRecorder.Header().Get(HTTPHeaderXBackgroundID))
+			assert.Equal(t, tc.expectReplayed, testRecorder.Header().Get(HTTPHeaderIdempotentReplayed) == "true")
+			assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+		})
+	}
+}
+
+func TestIdempotencyMw_Background(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	mockedUUID := uuid.MustParse("ef24471b-e968-40f0-b4d4-c9d0410565c8")
+	bgID := mockedUUID.String()
+	patches := gomonkey.ApplyFunc(uuid.New, func() uuid.UUID {
+		return mockedUUID
+	})
+	defer patches.Reset()
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+		Format: responsecache.FormatBinary,
+	}
+	expectIdempotencyRecord(mockedCacheConn, true, func(record *responsecache.IdempotencyRecord) bool {
+		return record.BackgroundID == "" && record.Response == nil
+	})
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventAccepted)
+	expectIdempotencyRecord(mockedCacheConn, false, func(record *responsecache.IdempotencyRecord) bool {
+		return record.BackgroundID == bgID && record.Response == nil
+	}).SetVal("OK")
+	mockedCacheConn.ExpectSet(bgID, &responsecache.HTTPResponse{
+		Code:    http.StatusOK,
+		Headers: make(map[string][]string),
+		Body:    []byte("a long time ago"),
+	}, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobSucceeded, 0)
+	expectIdempotencyRecord(mockedCacheConn, false, func(record *responsecache.IdempotencyRecord) bool {
+		return record.BackgroundID == bgID && record.Response != nil &&
+			string(record.Response.Body) == "a long time ago"
+	}).SetVal("OK")
+	expectEvent(mockedCacheConn, bgID, responsecache.EventCompleted)
+
+	handlerFn := IdempotencyMw(cacheConn, 0, 0)(AsyncMw(cacheConn)(new(withRequestTTL)))
+	testRecorder := httptest.NewRecorder()
+	testRequest := newIdempotentRequest(ctx, `{"name":"John"}`)
+	testRequest.Header.Set(HTTPHeaderXBackground, "true")
+	testRequest.Header.Set(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+	assert.Equal(t, bgID, testRecorder.Header().Get(HTTPHeaderXBackgroundID))
+
+	<-time.NewTimer(100 * time.Millisecond).C // need to wait till handler completion
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
@@ -3,9 +3,12 @@ package webapi
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/textproto"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Sugar-pack/users-manager/pkg/logging"
@@ -13,6 +16,7 @@ import (
 	"github.com/google/uuid"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/status"
 
 	"github.com/Sugar-pack/rest-server/internal/responsecache"
 )
@@ -65,11 +69,113 @@ func (a *asyncResponseWriter) WriteHeader(statusCode int) {
 }
 
 const (
-	HTTPHeaderXBackground    = "x-background"
-	HTTPHeaderXBackgroundTTL = "x-background-ttl"
-	DefaultTimeout           = 100 * time.Millisecond
+	HTTPHeaderXBackground          = "x-background"
+	HTTPHeaderXBackgroundTTL       = "x-background-ttl"
+	HTTPHeaderXBackgroundRetention = "x-background-retention"
+	HTTPHeaderXBackgroundID        = "x-background-id"
+	DefaultTimeout                 = 100 * time.Millisecond
+	DefaultRetryAfter              = 5 * time.Second
 )
 
+type asyncConfig struct {
+	policy       BackgroundPolicy
+	retention    time.Duration
+	maxRetention time.Duration
+	maxBodySize  int64
+	callback     callbackConfig
+	registry     *JobRegistry
+	pool         *WorkerPool
+	retryAfter   time.Duration
+	queue        bool
+	priorities   *PriorityClasses
+}
+
+// submit runs the task in the worker pool with the priority, or in a new goroutine when there is no pool.
+func (c *asyncConfig) submit(task func(), priority Priority) error {
+	if c.pool == nil {
+		go task()
+		return nil
+	}
+	return c.pool.TrySubmitPriority(task, priority.Level)
+}
+
+// routeRetention is the retention of results of the route, the policy may override the default one.
+func (c *asyncConfig) routeRetention() time.Duration {
+	if c.policy.Retention > 0 {
+		return c.policy.Retention
+	}
+	return c.retention
+}
+
+// retentionLimit limits the retention requested by clients, it is the retention of the route unless
+// a maximum is set.
+func (c *asyncConfig) retentionLimit() time.Duration {
+	if c.maxRetention > 0 {
+		return c.maxRetention
+	}
+	return c.routeRetention()
+}
+
+type AsyncOption func(cfg *asyncConfig)
+
+// WithRetention sets how long background results are kept in the cache by default.
+func WithRetention(retention time.Duration) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.retention = retention
+	}
+}
+
+// WithMaxRetention limits x-background-retention, without it clients may only shorten the retention.
+func WithMaxRetention(maxRetention time.Duration) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.maxRetention = maxRetention
+	}
+}
+
+// WithMaxBodySize limits the body of background requests, larger ones are rejected with 413.
+func WithMaxBodySize(size int64) AsyncOption {
+	return func(cfg *asyncConfig) {
+		if size > 0 {
+			cfg.maxBodySize = size
+		}
+	}
+}
+
+// WithJobRegistry sets the registry used to cancel background jobs.
+func WithJobRegistry(registry *JobRegistry) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.registry = registry
+	}
+}
+
+// WithWorkerPool executes background requests in the pool. When its queue is full requests are rejected
+// with 503 and Retry-After.
+func WithWorkerPool(pool *WorkerPool, retryAfter time.Duration) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.pool = pool
+		cfg.retryAfter = retryAfter
+	}
+}
+
+// WithQueue hands background requests over to the durable queue instead of executing them, they are
+// executed by QueueWorker processes.
+func WithQueue() AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.queue = true
+	}
+}
+
+// detachedJob is a job handed over to the detached handler once the request went to the background.
+type detachedJob struct {
+	job         *responsecache.Job
+	retention   time.Duration
+	callbackURL string
+	// idempotency is completed with the response when the request was made with an Idempotency-Key.
+	idempotency *idempotentRequest
+	// cancelReason is the final status of a job cancelled before completion.
+	cancelReason responsecache.JobStatus
+}
+
 func NewAsyncResponseWriter() *asyncResponseWriter {
 	rid := uuid.New()
 	var buffBytes []byte
@@ -82,63 +188,147 @@ func NewAsyncResponseWriter() *asyncResponseWriter {
 	}
 }
 
+func newAsyncConfig(opts ...AsyncOption) *asyncConfig {
+	cfg := &asyncConfig{
+		policy:      DefaultBackgroundPolicy,
+		maxBodySize: DefaultMaxBodySize,
+		callback:    defaultCallbackConfig(),
+		registry:    NewJobRegistry(),
+		retryAfter:  DefaultRetryAfter,
+		priorities:  DefaultPriorityClasses,
+	}
+	for i := range opts {
+		opt := opts[i]
+		opt(cfg)
+	}
+	return cfg
+}
+
 //nolint:gocognit,cyclop // need to refactor to decrease cyclo complexity
-func AsyncMw(cacheConn *responsecache.Cache) func(http.Handler) http.Handler {
+func AsyncMw(cacheConn *responsecache.Cache, opts ...AsyncOption) func(http.Handler) http.Handler {
+	cfg := newAsyncConfig(opts...)
 	httpMw := func(next http.Handler) http.Handler {
 		handlerFn := func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			logger := logging.FromContext(ctx)
-			catchTimeoutCh := make(chan uuid.UUID)
-			catchResponseCh := make(chan *asyncResponseWriter)
-			asyncRespWriter := NewAsyncResponseWriter()
-			var timer *time.Timer
-			if timeout, ok := hasBackgroundHeader(ctx, r.Header, DefaultTimeout); ok {
-				timer = time.NewTimer(timeout)
-				timeNow := time.Now().UTC()
-				go func() {
-					select {
-					case tt := <-timer.C:
-						logger.WithField("timer", tt.Sub(timeNow)).Warn("timeout occurred")
-						select {
-						case catchTimeoutCh <- asyncRespWriter.id:
-						default:
-						}
-					}
-				}()
+			timeNow := time.Now().UTC()
+			if run := storedRunFromContext(ctx); run != nil {
+				runStored(w, r, next, cacheConn, cfg, run)
+				return
+			}
+			runAt, scheduled, err := backgroundSchedule(r.Header, timeNow)
+			if err != nil {
+				logger.WithError(err).Warn("invalid background schedule")
+				BadRequest(ctx, w, err.Error())
+				return
+			}
+			timeout, background := hasBackgroundHeader(ctx, r.Header, cfg.policy.defaultTTL())
+			if !background && !scheduled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if scheduled {
+				err = cfg.policy.checkSchedule(runAt.Sub(timeNow))
+			} else {
+				err = cfg.policy.check(timeout)
+			}
+			if err != nil {
+				logger.WithError(err).Warn("background request violates the route policy")
+				BadRequest(ctx, w, err.Error())
+				return
 			}
+			callbackURL, err := backgroundCallbackURL(r.Header, cfg.callback)
+			if err != nil {
+				logger.WithError(err).Warn("invalid background callback")
+				BadRequest(ctx, w, err.Error())
+				return
+			}
+			priority, err := cfg.priorities.resolve(r.Header.Get(HTTPHeaderXBackgroundPriority), CallerFromContext(ctx))
+			if err != nil {
+				logger.WithError(err).Warn("invalid background priority")
+				BadRequest(ctx, w, err.Error())
+				return
+			}
+			w.Header().Set(HTTPHeaderXBackgroundPriority, priority.Name)
+			if scheduled {
+				persistRequest(w, r, cacheConn, cfg, &runAt, callbackURL, priority)
+				return
+			}
+			if cfg.queue {
+				persistRequest(w, r, cacheConn, cfg, nil, callbackURL, priority)
+				return
+			}
+			// background requests outlive r, the handler gets a snapshot of it.
+			handlerReq, err := snapshotRequest(r, cfg.maxBodySize)
+			if err != nil {
+				logger.WithError(err).Warn("snapshot background request failed")
+				if errors.Is(err, ErrBodyTooLarge) {
+					RequestEntityTooLarge(ctx, w, err.Error())
+					return
+				}
+				BadRequest(ctx, w, "read request body failed")
+				return
+			}
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
 
-			go func() {
-				asyncCtx := context.Background()
-				asyncLogger := logging.FromContext(ctx)
-				asyncCtx = logging.WithContext(asyncCtx, asyncLogger)
-				asyncCtx = context.WithValue(asyncCtx, chi.RouteCtxKey, chi.NewRouteContext())
-				_, span := otel.Tracer(TracerNameServer).Start(ctx, "detached span")
+			handlerDoneCh := make(chan struct{})
+			detachedCh := make(chan *detachedJob, 1)
+			asyncRespWriter := NewAsyncResponseWriter()
+			bgWriter := newBackgroundWriter(w, asyncRespWriter)
+			detachedCtx := logging.WithContext(context.Background(), logger)
+			asyncCtx, cancel := context.WithCancel(detachedCtx)
+			bgRun := newBackgroundRun(cacheConn, cfg.registry, cfg.policy.Retry)
+			bgWriter.hold = bgRun.retryable
+			task := func() {
+				defer cancel()
+				bgRun.start(detachedCtx)
+				handlerCtx, span := backgroundContext(ctx, asyncCtx, handlerReq, bgRun)
 				defer span.End()
-				asyncCtx = trace.ContextWithSpan(asyncCtx, span)
-				r = r.WithContext(asyncCtx)
-				next.ServeHTTP(asyncRespWriter, r)
+				runAttempts(handlerCtx, asyncCtx, next, bgWriter, handlerReq, bgRun)
+				bgWriter.finish()
 				select {
-				case catchResponseCh <- asyncRespWriter:
-					if timer != nil {
-						timer.Stop() // timer is not required any more. stop it.
-					}
-				default: // if response already sent, then save real response in the cache
-					saveErr := responsecache.SaveResponse(asyncCtx, cacheConn, asyncRespWriter.id.String(),
-						&responsecache.HTTPResponse{
-							Code:    asyncRespWriter.code,
-							Headers: asyncRespWriter.headers,
-							Body:    asyncRespWriter.buf.Bytes(),
-						})
-					if saveErr != nil {
-						logger.WithError(saveErr).Error("save response in cache failed")
+				case handlerDoneCh <- struct{}{}:
+				case detached := <-detachedCh: // response already sent, then save real response in the cache
+					if asyncCtx.Err() != nil {
+						detached.cancelReason = cfg.registry.cancelReason(detached.job.ID)
 					}
+					saveBackgroundResult(trace.ContextWithSpan(detachedCtx, span), cacheConn, cfg, detached,
+						asyncRespWriter)
+					cfg.registry.finish(detached.job.ID)
 				}
-			}()
+			}
+			if err = cfg.submit(task, priority); err != nil {
+				cancel()
+				logger.WithError(err).Warn("background request rejected")
+				ServiceUnavailable(ctx, w, err.Error(), cfg.retryAfter)
+				return
+			}
+
 			select {
-			case backgroundID := <-catchTimeoutCh:
-				StatusAccepted(ctx, w, "request will be executed in the background", backgroundID.String())
-			case syncResponse := <-catchResponseCh:
-				rawResponse(ctx, w, syncResponse.code, syncResponse.headers, syncResponse.buf.Bytes())
+			case tt := <-timer.C:
+				logger.WithField("timer", tt.Sub(timeNow)).Warn("timeout occurred")
+				if !bgWriter.detach() {
+					logger.Trace("response is already being written, request is not detached")
+					<-handlerDoneCh
+					return
+				}
+				job := bgRun.detach(ctx, &responsecache.Job{
+					ID:        asyncRespWriter.id.String(),
+					Method:    r.Method,
+					Path:      r.URL.Path,
+					CreatedAt: timeNow,
+					Owner:     CallerFromContext(ctx),
+					TraceID:   requestTraceID(ctx),
+					Priority:  priority.Name,
+				})
+				retention := backgroundRetention(ctx, r.Header, cfg.routeRetention(), cfg.retentionLimit())
+				cfg.registry.register(job.ID, cancel, retention)
+				idem := idempotentRequestFromContext(ctx)
+				idem.detach(ctx, cacheConn, job.ID, retention)
+				detachedCh <- &detachedJob{job: job, retention: retention, callbackURL: callbackURL, idempotency: idem}
+				StatusAccepted(ctx, w, "request will be executed in the background", job.ID, retention)
+			case <-handlerDoneCh:
 			}
 		}
 		httpHandlerFn := http.HandlerFunc(handlerFn)
@@ -147,6 +337,281 @@ func AsyncMw(cacheConn *responsecache.Cache) func(http.Handler) http.Handler {
 	return httpMw
 }
 
+// backgroundContext returns the context a background execution of handlerReq runs with, and its span.
+func backgroundContext(ctx, asyncCtx context.Context, handlerReq *http.Request, bgRun *backgroundRun,
+) (context.Context, trace.Span) {
+	routeCtx := chi.RouteContext(handlerReq.Context())
+	if routeCtx == nil {
+		routeCtx = chi.NewRouteContext()
+	}
+	handlerCtx := context.WithValue(asyncCtx, chi.RouteCtxKey, routeCtx)
+	handlerCtx = withProgressReporter(handlerCtx, bgRun)
+	_, span := otel.Tracer(TracerNameServer).Start(ctx, "detached span")
+	return trace.ContextWithSpan(handlerCtx, span), span
+}
+
+// runAttempts executes the handler until it succeeds, the retry policy gives up or the request is cancelled.
+func runAttempts(handlerCtx, asyncCtx context.Context, next http.Handler, bgWriter *backgroundWriter,
+	handlerReq *http.Request, bgRun *backgroundRun,
+) {
+	logger := logging.FromContext(handlerCtx)
+	for attempt := 1; ; attempt++ {
+		bgRun.startAttempt()
+		bgRun.checkCancel(withoutCancel(handlerCtx))
+		if asyncCtx.Err() != nil {
+			RequestCancelled(handlerCtx, bgWriter, "Request cancelled before start")
+		} else {
+			next.ServeHTTP(bgWriter, handlerReq.WithContext(handlerCtx))
+		}
+		code, buffered := bgWriter.result()
+		retry := buffered && asyncCtx.Err() == nil && bgRun.retryable(code)
+		bgRun.finishAttempt(withoutCancel(handlerCtx), code, retry)
+		if !retry {
+			return
+		}
+		backoff := bgRun.retry.backoff(attempt)
+		logger.WithField("attempt", attempt).WithField("backoff", backoff).Warn("background attempt failed, retry")
+		if !waitRetry(asyncCtx, backoff) || !bgWriter.reset() {
+			return
+		}
+		body, err := handlerReq.GetBody()
+		if err != nil {
+			logger.WithError(err).Error("rewind request body failed")
+			return
+		}
+		handlerReq.Body = body
+	}
+}
+
+// backgroundRun keeps the job record of a background request in line with its execution,
+// the request may be detached before or after a worker picks it up.
+type backgroundRun struct {
+	mu        sync.Mutex
+	cacheConn *responsecache.Cache
+	registry  *JobRegistry
+	retry     RetryPolicy
+	startedAt *time.Time
+	job       *responsecache.Job
+	attempts  []responsecache.Attempt
+	// attempt is the running attempt, it is added to attempts once it is finished.
+	attempt responsecache.Attempt
+}
+
+func newBackgroundRun(cacheConn *responsecache.Cache, registry *JobRegistry, retry RetryPolicy) *backgroundRun {
+	return &backgroundRun{
+		cacheConn: cacheConn,
+		registry:  registry,
+		retry:     retry,
+	}
+}
+
+func (b *backgroundRun) start(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	startedAt := time.Now().UTC()
+	b.startedAt = &startedAt
+	if b.job == nil {
+		return
+	}
+	b.job.Status = responsecache.JobRunning
+	b.job.StartedAt = &startedAt
+	if err := responsecache.SaveJob(ctx, b.cacheConn, b.job, 0); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("save job in cache failed")
+	}
+	b.publish(ctx, &responsecache.Event{Type: responsecache.EventRunning, Job: b.job})
+}
+
+func (b *backgroundRun) detach(ctx context.Context, job *responsecache.Job) *responsecache.Job {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job.Status = responsecache.JobQueued
+	if b.startedAt != nil {
+		job.Status = responsecache.JobRunning
+		job.StartedAt = b.startedAt
+	}
+	job.Attempts = append([]responsecache.Attempt(nil), b.attempts...)
+	b.job = job
+	if err := responsecache.SaveJob(ctx, b.cacheConn, job, 0); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("save job in cache failed")
+	}
+	b.publish(ctx, &responsecache.Event{Type: responsecache.EventAccepted, Job: job})
+	return job
+}
+
+// progress publishes the stage reached by the handler. Requests which are not detached have no subscribers.
+func (b *backgroundRun) progress(ctx context.Context, stage string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.job == nil {
+		return
+	}
+	b.publish(ctx, &responsecache.Event{Type: responsecache.EventProgress, Stage: stage})
+}
+
+func (b *backgroundRun) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt.Error = err.Error()
+	if grpcStatus, ok := status.FromError(err); ok {
+		b.attempt.GRPCCode = grpcStatus.Code().String()
+	}
+}
+
+func (b *backgroundRun) startAttempt() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt = responsecache.Attempt{StartedAt: time.Now().UTC()}
+}
+
+// checkCancel cancels the job of a detached request if its cancel was requested through another instance,
+// which can not reach the registry of this one.
+func (b *backgroundRun) checkCancel(ctx context.Context) {
+	b.mu.Lock()
+	job := b.job
+	b.mu.Unlock()
+	if job == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	requested, err := responsecache.CancelRequested(ctx, b.cacheConn, job.ID)
+	if err != nil {
+		logger.WithError(err).Warn("check cancel request failed")
+		return
+	}
+	if requested {
+		logger.Info("background job cancelled by request")
+		b.registry.cancelJob(job.ID, responsecache.JobCancelled)
+	}
+}
+
+// retryable reports whether the running attempt is retried if it ends with the status code.
+func (b *backgroundRun) retryable(statusCode int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.attempts)+1 < b.retry.MaxAttempts && b.retry.retryable(statusCode, b.attempt.GRPCCode)
+}
+
+// finishAttempt records the running attempt in the job record of a detached request.
+func (b *backgroundRun) finishAttempt(ctx context.Context, statusCode int, retry bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt.FinishedAt = time.Now().UTC()
+	b.attempt.Code = statusCode
+	b.attempts = append(b.attempts, b.attempt)
+	if b.job == nil {
+		return
+	}
+	b.job.Attempts = append([]responsecache.Attempt(nil), b.attempts...)
+	if !retry {
+		// the job record is saved with the result
+		return
+	}
+	if err := responsecache.SaveJob(ctx, b.cacheConn, b.job, 0); err != nil {
+		logging.FromContext(ctx).WithError(err).Error("save job in cache failed")
+	}
+	b.publish(ctx, &responsecache.Event{Type: responsecache.EventRetrying, Job: b.job})
+}
+
+func (b *backgroundRun) publish(ctx context.Context, event *responsecache.Event) {
+	event.BackgroundID = b.job.ID
+	event.Time = time.Now().UTC()
+	if err := responsecache.PublishEvent(ctx, b.cacheConn, event); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("publish background event failed")
+	}
+}
+
+// saveBackgroundResult stores the response of a detached handler, marks its job as finished
+// and hands the response over to the callback sender if the client asked for it.
+func saveBackgroundResult(ctx context.Context, cacheConn *responsecache.Cache, cfg *asyncConfig,
+	detached *detachedJob, asyncRespWriter *asyncResponseWriter,
+) {
+	logger := logging.FromContext(ctx)
+	job := detached.job
+	if len(job.Attempts) > 1 {
+		asyncRespWriter.headers.Set(HTTPHeaderXBackgroundAttempts, strconv.Itoa(len(job.Attempts)))
+	}
+	httpResp := &responsecache.HTTPResponse{
+		Code:    asyncRespWriter.code,
+		Headers: asyncRespWriter.headers,
+		Body:    asyncRespWriter.buf.Bytes(),
+		Owner:   job.Owner,
+	}
+	saveErr := responsecache.SaveResponse(ctx, cacheConn, job.ID, httpResp, detached.retention)
+	if errors.Is(saveErr, responsecache.ErrResponseTooLarge) {
+		logger.WithError(saveErr).Error("response is too large to be stored")
+		httpResp = &responsecache.HTTPResponse{
+			Code:  http.StatusInsufficientStorage,
+			Body:  []byte(saveErr.Error()),
+			Owner: job.Owner,
+		}
+		saveErr = responsecache.SaveResponse(ctx, cacheConn, job.ID, httpResp, detached.retention)
+	}
+	if saveErr != nil {
+		logger.WithError(saveErr).Error("save response in cache failed")
+	}
+
+	finishedAt := time.Now().UTC()
+	job.FinishedAt = &finishedAt
+	if detached.retention > 0 {
+		expiresAt := finishedAt.Add(detached.retention)
+		job.ExpiresAt = &expiresAt
+	}
+	job.Code = httpResp.Code
+	if detached.callbackURL != "" {
+		job.Callback = &responsecache.CallbackDelivery{URL: detached.callbackURL}
+	}
+	switch {
+	case detached.cancelReason != "":
+		job.Status = detached.cancelReason
+	case saveErr != nil || httpResp.Code >= http.StatusInternalServerError:
+		job.Status = responsecache.JobFailed
+	default:
+		job.Status = responsecache.JobSucceeded
+	}
+	if err := responsecache.SaveJob(ctx, cacheConn, job, detached.retention); err != nil {
+		logger.WithError(err).Error("save job in cache failed")
+	}
+	detached.idempotency.complete(ctx, cacheConn, httpResp)
+	publishCompleted(ctx, cacheConn, job, httpResp)
+
+	if detached.callbackURL != "" {
+		sendCallback(ctx, cacheConn, cfg.callback, *job, detached.callbackURL, detached.retention, httpResp)
+	}
+}
+
+// publishCompleted notifies event subscribers and result waiters that the job is finished.
+// Bodies which are not stored inline are left out, they are fetched from the result endpoint.
+func publishCompleted(ctx context.Context, cacheConn *responsecache.Cache, job *responsecache.Job,
+	httpResp *responsecache.HTTPResponse,
+) {
+	if !cacheConn.Inline(httpResp) {
+		httpResp = &responsecache.HTTPResponse{
+			Code:    httpResp.Code,
+			Headers: httpResp.Headers,
+			Owner:   httpResp.Owner,
+		}
+	}
+	err := responsecache.PublishEvent(ctx, cacheConn, &responsecache.Event{
+		Type:         responsecache.EventCompleted,
+		BackgroundID: job.ID,
+		Time:         time.Now().UTC(),
+		Job:          job,
+		Response:     httpResp,
+	})
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("publish background event failed")
+	}
+}
+
+// requestTraceID returns the trace id of the request, empty if it is not traced.
+func requestTraceID(ctx context.Context) string {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.HasTraceID() {
+		return ""
+	}
+	return spanCtx.TraceID().String()
+}
+
 func hasBackgroundHeader(ctx context.Context, httpHeader http.Header, defaultTTL time.Duration) (time.Duration, bool) {
 	logger := logging.FromContext(ctx)
 	backgroundHeaders, hasBgHeader := httpHeader[textproto.CanonicalMIMEHeaderKey(HTTPHeaderXBackground)]
@@ -179,3 +644,25 @@ func backgroundTTL(ctx context.Context, rawTTL string, defaultTTL time.Duration)
 	}
 	return ttl
 }
+
+// backgroundRetention returns the retention requested by the client or the default one. A retention
+// has to be positive, keeping a result forever is up to the server, and is limited to maxRetention
+// unless that is zero.
+func backgroundRetention(ctx context.Context, httpHeader http.Header, defaultRetention, maxRetention time.Duration,
+) time.Duration {
+	logger := logging.FromContext(ctx)
+	rawRetention := httpHeader.Get(HTTPHeaderXBackgroundRetention)
+	if rawRetention == "" {
+		return defaultRetention
+	}
+	retention, err := time.ParseDuration(rawRetention)
+	if err != nil || retention <= 0 {
+		logger.WithError(err).WithField("raw_retention", rawRetention).Warn("parse raw retention failed, use default value")
+		return defaultRetention
+	}
+	if maxRetention > 0 && retention > maxRetention {
+		logger.WithField("raw_retention", rawRetention).Warn("retention exceeds the maximum, use the maximum")
+		return maxRetention
+	}
+	return retention
+}
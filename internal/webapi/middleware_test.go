@@ -2,6 +2,7 @@ package webapi
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -33,12 +34,17 @@ func TestAsyncMw_HasAsyncHeader_DefaultTTL_InBackground(t *testing.T) {
 	redisClient, mockedCacheConn := redismock.NewClientMock()
 	cacheConn := &responsecache.Cache{
 		Client: redisClient,
+		Format: responsecache.FormatBinary,
 	}
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventAccepted)
 	mockedCacheConn.ExpectSet(mockedUUID.String(), &responsecache.HTTPResponse{
 		Code:    http.StatusOK,
 		Headers: make(map[string][]string),
 		Body:    []byte("a long time ago"),
 	}, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobSucceeded, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventCompleted)
 
 	mw := AsyncMw(cacheConn)
 	fakeHandler := new(backgroundResponse)
@@ -179,13 +185,18 @@ func TestAsyncMw_HasAsyncHeader_HasTTLHeader(t *testing.T) {
 	redisClient, mockedCacheConn := redismock.NewClientMock()
 	cacheConn := &responsecache.Cache{
 		Client: redisClient,
+		Format: responsecache.FormatBinary,
 	}
 	expectedRedisValue := &responsecache.HTTPResponse{
 		Code:    http.StatusOK,
 		Headers: make(map[string][]string),
 		Body:    []byte("a long time ago"),
 	}
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventAccepted)
 	mockedCacheConn.ExpectSet(mockedUUID.String(), expectedRedisValue, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobSucceeded, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventCompleted)
 
 	mw := AsyncMw(cacheConn)
 	fakeHandler := new(withRequestTTL)
@@ -215,6 +226,93 @@ func TestAsyncMw_HasAsyncHeader_HasTTLHeader(t *testing.T) {
 	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
 }
 
+func TestAsyncMw_HasAsyncHeader_HasRetentionHeader(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	httpHeaders := make(http.Header)
+	httpHeaders.Add(HTTPHeaderXBackground, "true")
+	httpHeaders.Add(HTTPHeaderXBackgroundTTL, (50 * time.Millisecond).String())
+	requestRetention := time.Hour
+	httpHeaders.Add(HTTPHeaderXBackgroundRetention, requestRetention.String())
+
+	mockedUUID := uuid.MustParse("ef24471b-e968-40f0-b4d4-c9d0410565c8")
+	patches := gomonkey.ApplyFunc(uuid.New, func() uuid.UUID {
+		return mockedUUID
+	})
+	defer patches.Reset()
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+		Format: responsecache.FormatBinary,
+	}
+	expectedRedisValue := &responsecache.HTTPResponse{
+		Code:    http.StatusOK,
+		Headers: make(map[string][]string),
+		Body:    []byte("a long time ago"),
+	}
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventAccepted)
+	mockedCacheConn.ExpectSet(mockedUUID.String(), expectedRedisValue, requestRetention).SetVal("OK")
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobSucceeded, requestRetention)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventCompleted)
+
+	mw := AsyncMw(cacheConn, WithRetention(time.Minute), WithMaxRetention(24*time.Hour))
+	fakeHandler := new(withRequestTTL)
+	handlerFn := mw(fakeHandler)
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header = httpHeaders
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+	assert.Equal(t, requestRetention.String(), testRecorder.Header().Get(HTTPHeaderXBackgroundRetention))
+
+	<-time.NewTimer(80 * time.Millisecond).C // need to wait till handler completion
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestBackgroundRetention(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	testCases := []struct {
+		name         string
+		rawRetention string
+		maxRetention time.Duration
+		expected     time.Duration
+	}{
+		{name: "default", expected: time.Hour},
+		{name: "requested", rawRetention: "30m", maxRetention: 24 * time.Hour, expected: 30 * time.Minute},
+		{name: "zero", rawRetention: "0s", maxRetention: 24 * time.Hour, expected: time.Hour},
+		{name: "negative", rawRetention: "-1h", maxRetention: 24 * time.Hour, expected: time.Hour},
+		{name: "invalid", rawRetention: "forever", maxRetention: 24 * time.Hour, expected: time.Hour},
+		{name: "over the maximum", rawRetention: "48h", maxRetention: 24 * time.Hour, expected: 24 * time.Hour},
+		{name: "no maximum", rawRetention: "48h", expected: 48 * time.Hour},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			httpHeaders := make(http.Header)
+			if tc.rawRetention != "" {
+				httpHeaders.Set(HTTPHeaderXBackgroundRetention, tc.rawRetention)
+			}
+			assert.Equal(t, tc.expected, backgroundRetention(ctx, httpHeaders, time.Hour, tc.maxRetention))
+		})
+	}
+}
+
+func TestAsyncConfig_RetentionLimit(t *testing.T) {
+	cfg := newAsyncConfig(WithRetention(time.Hour))
+	assert.Equal(t, time.Hour, cfg.retentionLimit(), "clients may only shorten the retention")
+	cfg = newAsyncConfig(WithRetention(time.Hour), WithPolicy(BackgroundPolicy{Allowed: true, Retention: 2 * time.Hour}))
+	assert.Equal(t, 2*time.Hour, cfg.retentionLimit(), "the retention of the route")
+	cfg = newAsyncConfig(WithRetention(time.Hour), WithMaxRetention(24*time.Hour))
+	assert.Equal(t, 24*time.Hour, cfg.retentionLimit())
+}
+
 type withRequestTTL struct{}
 
 func (s *withRequestTTL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -222,3 +320,182 @@ func (s *withRequestTTL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	time.Sleep(60 * time.Millisecond) //nolint:revive,gomnd // this is temporary and should be removed
 	StatusOk(ctx, w, "a long time ago")
 }
+
+func expectJobSet(mockedCacheConn redismock.ClientMock, bgID string, status responsecache.JobStatus,
+	ttl time.Duration,
+) {
+	jobKey := responsecache.JobKey(bgID)
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		if actual[1] != jobKey {
+			return fmt.Errorf("unexpected key %v", actual[1])
+		}
+		job, ok := actual[2].(*responsecache.Job)
+		if !ok || job.ID != bgID || job.Status != status {
+			return fmt.Errorf("unexpected job %+v", actual[2])
+		}
+		return nil
+	}).ExpectSet(jobKey, nil, ttl).SetVal("OK")
+}
+
+func TestAsyncMw_WorkerPool_QueueFull(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	httpHeaders := make(http.Header)
+	httpHeaders.Add(HTTPHeaderXBackground, "true")
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+
+	pool := NewWorkerPool(1, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	pool.TrySubmit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	pool.TrySubmit(func() {}) // occupy the only queue slot
+
+	mw := AsyncMw(cacheConn, WithWorkerPool(pool, 2*time.Second))
+	handlerFn := mw(new(handlerResponse))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header = httpHeaders
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusServiceUnavailable, testRecorder.Code)
+	assert.Equal(t, "2", testRecorder.Header().Get("Retry-After"))
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestAsyncMw_WorkerPool_Queued(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	httpHeaders := make(http.Header)
+	httpHeaders.Add(HTTPHeaderXBackground, "true")
+	httpHeaders.Add(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+
+	mockedUUID := uuid.MustParse("ef24471b-e968-40f0-b4d4-c9d0410565c8")
+	patches := gomonkey.ApplyFunc(uuid.New, func() uuid.UUID {
+		return mockedUUID
+	})
+	defer patches.Reset()
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+		Format: responsecache.FormatBinary,
+	}
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobQueued, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventAccepted)
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventRunning)
+	mockedCacheConn.ExpectExists(responsecache.CancelKey(mockedUUID.String())).SetVal(0)
+	mockedCacheConn.ExpectSet(mockedUUID.String(), &responsecache.HTTPResponse{
+		Code:    http.StatusOK,
+		Headers: make(map[string][]string),
+		Body:    []byte("fast and furious"),
+	}, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, mockedUUID.String(), responsecache.JobSucceeded, 0)
+	expectEvent(mockedCacheConn, mockedUUID.String(), responsecache.EventCompleted)
+
+	pool := NewWorkerPool(1, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pool.TrySubmit(func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	mw := AsyncMw(cacheConn, WithWorkerPool(pool, time.Second))
+	handlerFn := mw(new(handlerResponse))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header = httpHeaders
+
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+
+	close(release)
+	<-time.NewTimer(50 * time.Millisecond).C // need to wait till handler completion
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestAsyncMw_WorkerPool_SlowCallback(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	cacheConn := &responsecache.Cache{Store: responsecache.NewMemoryStore(0)}
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+
+	pool := NewWorkerPool(1, 1)
+	mw := AsyncMw(cacheConn,
+		WithWorkerPool(pool, time.Second),
+		WithCallback("shared secret", 1, time.Millisecond),
+		WithCallbackDestinations(nil, true),
+		WithCallbackSender(NewCallbackSender(1, 1)),
+	)
+	handlerFn := mw(new(backgroundResponse))
+	send := func(callbackURL string) string {
+		testRequest := httptest.NewRequest(http.MethodGet, "/any", nil).WithContext(ctx)
+		testRequest.Header.Set(HTTPHeaderXBackground, "true")
+		testRequest.Header.Set(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+		if callbackURL != "" {
+			testRequest.Header.Set(HTTPHeaderXBackgroundCallback, callbackURL)
+		}
+		testRecorder := httptest.NewRecorder()
+		handlerFn.ServeHTTP(testRecorder, testRequest)
+		assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+		return testRecorder.Header().Get(HTTPHeaderXBackgroundID)
+	}
+	finished := func(bgID string) func() bool {
+		return func() bool {
+			job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+			return err == nil && job.Status == responsecache.JobSucceeded
+		}
+	}
+
+	withCallback := send(receiver.URL)
+	queued := send("")
+
+	// the callback of the first job is still being delivered
+	assert.Eventually(t, finished(withCallback), time.Second, 10*time.Millisecond)
+	assert.Eventually(t, finished(queued), time.Second, 10*time.Millisecond, "the queued job is not blocked")
+	assert.Eventually(t, func() bool {
+		return pool.Stats().ActiveWorkers == 0
+	}, time.Second, time.Millisecond)
+	send("")
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		job, err := responsecache.GetJob(ctx, cacheConn, withCallback)
+		return err == nil && job.Callback != nil && job.Callback.Delivered
+	}, time.Second, 10*time.Millisecond)
+}
+
+func expectEvent(mockedCacheConn redismock.ClientMock, bgID string, eventType responsecache.EventType) {
+	channel := responsecache.EventChannel(bgID)
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		if actual[1] != channel {
+			return fmt.Errorf("unexpected channel %v", actual[1])
+		}
+		event, ok := actual[2].(*responsecache.Event)
+		if !ok || event.BackgroundID != bgID || event.Type != eventType {
+			return fmt.Errorf("unexpected event %+v", actual[2])
+		}
+		return nil
+	}).ExpectPublish(channel, nil).SetVal(0)
+}
@@ -0,0 +1,158 @@
+package webapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const HTTPHeaderAPIKey = "X-API-Key"
+
+// CallerIdentity returns the identity of the caller of r, empty for anonymous callers.
+type CallerIdentity func(r *http.Request) string
+
+// OwnershipCheck reports whether the caller of ctx may access a background result created by owner.
+type OwnershipCheck func(ctx context.Context, owner string) bool
+
+type callerKey struct{}
+
+// WithCaller stores the identity of the caller in ctx. Auth middlewares may use it to set the caller
+// they authenticated, CallerMw then keeps it.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+func CallerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// CallerMw resolves the identity of the caller with identity unless an auth middleware already set it.
+func CallerMw(identity CallerIdentity) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if CallerFromContext(ctx) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithCaller(ctx, identity(r))))
+		})
+	}
+}
+
+// TokenVerifier returns the subject of a bearer token once it checked its signature and expiry.
+type TokenVerifier func(token string) (string, error)
+
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+// DefaultCallerIdentity identifies the caller by the client certificate or the X-API-Key header, in that
+// order. Bearer tokens are not trusted without a verifier, see NewCallerIdentity.
+func DefaultCallerIdentity(r *http.Request) string {
+	return NewCallerIdentity(nil)(r)
+}
+
+// NewCallerIdentity identifies the caller like DefaultCallerIdentity, then by the subject of the bearer
+// token if verifier accepts it. Tokens are ignored when verifier is nil.
+func NewCallerIdentity(verifier TokenVerifier) CallerIdentity {
+	return func(r *http.Request) string {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			return "cert:" + sha256Hex(r.TLS.PeerCertificates[0].Raw)
+		}
+		if apiKey := r.Header.Get(HTTPHeaderAPIKey); apiKey != "" {
+			// the key itself is a secret, only its hash is stored with the results.
+			return "api-key:" + sha256Hex([]byte(apiKey))
+		}
+		token := bearerToken(r.Header.Get("Authorization"))
+		if verifier == nil || token == "" {
+			return ""
+		}
+		subject, err := verifier(token)
+		if err != nil || subject == "" {
+			return ""
+		}
+		return "jwt:" + subject
+	}
+}
+
+// CallerOwns is the default OwnershipCheck, results are accessible to the caller who created them.
+func CallerOwns(ctx context.Context, owner string) bool {
+	return CallerFromContext(ctx) == owner
+}
+
+func bearerToken(authorization string) string {
+	const bearerPrefix = "Bearer "
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(authorization, bearerPrefix)
+}
+
+// HS256Verifier verifies JWTs signed with HMAC-SHA256 by secret. The token must have an exp claim in the
+// future, and its nbf claim must have passed if it has one.
+func HS256Verifier(secret []byte) TokenVerifier {
+	return func(token string) (string, error) {
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 { //nolint:gomnd // header.payload.signature
+			return "", fmt.Errorf("%w: malformed", ErrInvalidToken)
+		}
+		var header struct {
+			Algorithm string `json:"alg"`
+		}
+		if err := decodeTokenPart(parts[0], &header); err != nil {
+			return "", err
+		}
+		if header.Algorithm != "HS256" {
+			return "", fmt.Errorf("%w: algorithm %q", ErrInvalidToken, header.Algorithm)
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return "", fmt.Errorf("%w: signature: %s", ErrInvalidToken, err.Error())
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return "", fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+		var claims struct {
+			Subject   string `json:"sub"`
+			ExpiresAt *int64 `json:"exp"`
+			NotBefore *int64 `json:"nbf"`
+		}
+		if err = decodeTokenPart(parts[1], &claims); err != nil {
+			return "", err
+		}
+		now := time.Now().Unix()
+		if claims.ExpiresAt == nil || *claims.ExpiresAt <= now {
+			return "", fmt.Errorf("%w: expired", ErrInvalidToken)
+		}
+		if claims.NotBefore != nil && *claims.NotBefore > now {
+			return "", fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+		}
+		return claims.Subject, nil
+	}
+}
+
+func decodeTokenPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	if err = json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, err.Error())
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,157 @@
+package webapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestDefaultCallerIdentity(t *testing.T) {
+	jwtPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-42"}`))
+	testCases := []struct {
+		name     string
+		prepare  func(r *http.Request)
+		expected string
+	}{
+		{name: "anonymous", prepare: func(r *http.Request) {}, expected: ""},
+		{
+			name: "api key",
+			prepare: func(r *http.Request) {
+				r.Header.Set(HTTPHeaderAPIKey, "secret")
+			},
+			expected: "api-key:" + sha256Hex([]byte("secret")),
+		},
+		{
+			name: "unverified jwt",
+			prepare: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer e30."+jwtPayload+".signature")
+			},
+			expected: "",
+		},
+		{
+			name: "client certificate first",
+			prepare: func(r *http.Request) {
+				r.Header.Set(HTTPHeaderAPIKey, "secret")
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte("certificate")}}}
+			},
+			expected: "cert:" + sha256Hex([]byte("certificate")),
+		},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/uniq_id", nil)
+			tc.prepare(testRequest)
+			assert.Equal(t, tc.expected, DefaultCallerIdentity(testRequest))
+		})
+	}
+}
+
+func TestNewCallerIdentity_HS256(t *testing.T) {
+	secret := []byte("jwt-secret")
+	sign := func(key []byte, header, claims string) string {
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(unsigned))
+		return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	validClaims := fmt.Sprintf(`{"sub":"user-42","exp":%d}`, exp)
+	testCases := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{name: "valid", token: sign(secret, `{"alg":"HS256"}`, validClaims), expected: "jwt:user-42"},
+		{name: "forged", token: sign([]byte("guessed"), `{"alg":"HS256"}`, validClaims)},
+		{name: "forged subject", token: forgeSubject(sign(secret, `{"alg":"HS256"}`, validClaims), exp)},
+		{name: "unsigned", token: sign(secret, `{"alg":"none"}`, validClaims)},
+		{name: "expired", token: sign(secret, `{"alg":"HS256"}`, `{"sub":"user-42","exp":1}`)},
+		{name: "without expiry", token: sign(secret, `{"alg":"HS256"}`, `{"sub":"user-42"}`)},
+		{
+			name:  "not valid yet",
+			token: sign(secret, `{"alg":"HS256"}`, fmt.Sprintf(`{"sub":"user-42","exp":%d,"nbf":%d}`, exp, exp)),
+		},
+		{name: "malformed", token: "not-a-jwt"},
+	}
+	identity := NewCallerIdentity(HS256Verifier(secret))
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/uniq_id", nil)
+			testRequest.Header.Set("Authorization", "Bearer "+tc.token)
+			assert.Equal(t, tc.expected, identity(testRequest))
+		})
+	}
+}
+
+// forgeSubject replaces the claims of a signed token with those of another caller, keeping the signature.
+func forgeSubject(token string, exp int64) string {
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"admin","exp":%d}`, exp)))
+	return strings.Join(parts, ".")
+}
+
+func TestCallerMw_KeepsAuthenticatedCaller(t *testing.T) {
+	var gotCaller string
+	handlerFn := CallerMw(DefaultCallerIdentity)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCaller = CallerFromContext(r.Context())
+	}))
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/uniq_id", nil)
+	testRequest.Header.Set(HTTPHeaderAPIKey, "secret")
+	testRequest = testRequest.WithContext(WithCaller(testRequest.Context(), "user-42"))
+
+	handlerFn.ServeHTTP(httptest.NewRecorder(), testRequest)
+
+	assert.Equal(t, "user-42", gotCaller)
+}
+
+func TestCachedResponse_OtherCaller(t *testing.T) {
+	ctx := context.Background()
+	logger := logging.GetLogger()
+	ctx = logging.WithContext(ctx, logger)
+	ctx = WithCaller(ctx, "jwt:intruder")
+	bgID := "uniq_id"
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	mockedRedisValue, err := json.Marshal(&responsecache.HTTPResponse{
+		Code:  http.StatusOK,
+		Body:  []byte("from cache"),
+		Owner: "jwt:user-42",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockedCacheConn.ExpectGet(bgID).SetVal(string(mockedRedisValue))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodGet, "/bg-responses/{bg_id}", nil)
+	newChiCtx := chi.NewRouteContext()
+	newChiCtx.URLParams.Add("bg_id", bgID)
+	testRequest = testRequest.WithContext(context.WithValue(ctx, chi.RouteCtxKey, newChiCtx))
+	CachedResponse(cacheConn, CallerOwns, ResultConsume).ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusNotFound, testRecorder.Code)
+	// the result stays in the cache for its owner
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
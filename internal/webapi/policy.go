@@ -0,0 +1,105 @@
+package webapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+// DefaultMaxTTL limits x-background-ttl of routes which may run in the background.
+const DefaultMaxTTL = 30 * time.Second
+
+var (
+	ErrBackgroundNotAllowed = errors.New("route can not be executed in the background")
+	ErrTTLTooLong           = errors.New("x-background-ttl exceeds the maximum of the route")
+	ErrScheduleNotAllowed   = errors.New("route can not be scheduled")
+	ErrDelayTooLong         = errors.New("scheduled time exceeds the maximum delay of the route")
+)
+
+// BackgroundPolicy defines whether and how requests of a route may be executed in the background.
+type BackgroundPolicy struct {
+	Allowed bool
+	// DefaultTTL is used when x-background-ttl is missing, zero means DefaultTimeout.
+	// MaxTTL limits x-background-ttl, zero means no limit.
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+	// Retention overrides the default retention of results when it is positive.
+	Retention time.Duration
+	// Retry retries failed executions, the zero value disables retries.
+	Retry RetryPolicy
+	// MaxDelay limits how far ahead requests may be scheduled, zero means they can not be scheduled.
+	MaxDelay time.Duration
+}
+
+// NoBackground is the policy of routes which are always executed synchronously.
+var NoBackground = BackgroundPolicy{}
+
+// DefaultBackgroundPolicy is used by AsyncMw without WithPolicy.
+var DefaultBackgroundPolicy = BackgroundPolicy{
+	Allowed:    true,
+	DefaultTTL: DefaultTimeout,
+}
+
+func (p BackgroundPolicy) defaultTTL() time.Duration {
+	if p.DefaultTTL > 0 {
+		return p.DefaultTTL
+	}
+	return DefaultTimeout
+}
+
+// check validates the TTL requested for a background request.
+func (p BackgroundPolicy) check(ttl time.Duration) error {
+	if !p.Allowed {
+		return ErrBackgroundNotAllowed
+	}
+	if p.MaxTTL > 0 && ttl > p.MaxTTL {
+		return fmt.Errorf("%w: %s", ErrTTLTooLong, p.MaxTTL)
+	}
+	return nil
+}
+
+// checkSchedule validates the delay of a scheduled request.
+func (p BackgroundPolicy) checkSchedule(delay time.Duration) error {
+	if !p.Allowed || p.MaxDelay <= 0 {
+		return ErrScheduleNotAllowed
+	}
+	if delay > p.MaxDelay {
+		return fmt.Errorf("%w: %s", ErrDelayTooLong, p.MaxDelay)
+	}
+	return nil
+}
+
+// WithPolicy sets the background policy of the routes served by AsyncMw.
+func WithPolicy(policy BackgroundPolicy) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.policy = policy
+	}
+}
+
+// Route is an endpoint with its background policy.
+type Route struct {
+	Method  string
+	Pattern string
+	Handler http.Handler
+	Policy  BackgroundPolicy
+	// Middlewares are run before AsyncMw.
+	Middlewares []func(http.Handler) http.Handler
+}
+
+// registerRoutes mounts every route behind its own AsyncMw configured with the route policy.
+func registerRoutes(router chi.Router, cacheConn *responsecache.Cache, routes []Route, asyncOpts []AsyncOption) {
+	for _, route := range routes {
+		routeOpts := make([]AsyncOption, 0, len(asyncOpts)+1)
+		routeOpts = append(routeOpts, asyncOpts...)
+		routeOpts = append(routeOpts, WithPolicy(route.Policy))
+		middlewares := make([]func(http.Handler) http.Handler, 0, len(route.Middlewares)+1)
+		middlewares = append(middlewares, route.Middlewares...)
+		middlewares = append(middlewares, AsyncMw(cacheConn, routeOpts...))
+		router.With(middlewares...).Method(route.Method, route.Pattern, route.Handler)
+	}
+}
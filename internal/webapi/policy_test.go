@@ -0,0 +1,84 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestAsyncMw_Policy(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	testCases := []struct {
+		name         string
+		policy       BackgroundPolicy
+		headers      map[string]string
+		expectedCode int
+	}{
+		{
+			name:         "sync request of a sync route",
+			policy:       NoBackground,
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "background request of a sync route",
+			policy:       NoBackground,
+			headers:      map[string]string{HTTPHeaderXBackground: "true"},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:   "ttl above the maximum",
+			policy: BackgroundPolicy{Allowed: true, MaxTTL: time.Second},
+			headers: map[string]string{
+				HTTPHeaderXBackground:    "true",
+				HTTPHeaderXBackgroundTTL: "2s",
+			},
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:   "ttl within the maximum",
+			policy: BackgroundPolicy{Allowed: true, MaxTTL: time.Second},
+			headers: map[string]string{
+				HTTPHeaderXBackground:    "true",
+				HTTPHeaderXBackgroundTTL: "1s",
+			},
+			expectedCode: http.StatusOK,
+		},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			redisClient, mockedCacheConn := redismock.NewClientMock()
+			cacheConn := &responsecache.Cache{
+				Client: redisClient,
+			}
+			handlerFn := AsyncMw(cacheConn, WithPolicy(tc.policy))(new(handlerResponse))
+			testRecorder := httptest.NewRecorder()
+			testRequest := httptest.NewRequest(http.MethodGet, "/any", nil)
+			testRequest = testRequest.WithContext(ctx)
+			for k, v := range tc.headers {
+				testRequest.Header.Set(k, v)
+			}
+			handlerFn.ServeHTTP(testRecorder, testRequest)
+
+			assert.Equal(t, tc.expectedCode, testRecorder.Code)
+			assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+		})
+	}
+}
+
+func TestAsyncConfig_RouteRetention(t *testing.T) {
+	cfg := &asyncConfig{retention: time.Hour, policy: DefaultBackgroundPolicy}
+	assert.Equal(t, time.Hour, cfg.routeRetention())
+	cfg.policy.Retention = time.Minute
+	assert.Equal(t, time.Minute, cfg.routeRetention())
+}
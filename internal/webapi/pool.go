@@ -0,0 +1,186 @@
+package webapi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// poolWaitInterval is how often Wait checks whether the pool is idle.
+const poolWaitInterval = 10 * time.Millisecond
+
+var (
+	ErrQueueFull  = errors.New("background queue is full")
+	ErrPoolClosed = errors.New("background execution is stopped")
+)
+
+// WorkerPool executes background requests with a fixed number of workers and a bounded queue.
+// Queued tasks are executed in priority order. Lower priorities may fill a smaller share of the queue,
+// so under load they are rejected first while higher priorities are still accepted.
+type WorkerPool struct {
+	mu    sync.Mutex
+	ready *sync.Cond
+	// queues holds the queued tasks by priority level, level 0 is the highest one.
+	queues   [][]func()
+	queued   int
+	capacity int
+	workers  int
+	active   int
+	closed   bool
+}
+
+// PoolStats is a snapshot of the worker pool load.
+type PoolStats struct {
+	Workers       int `json:"workers"`
+	ActiveWorkers int `json:"active_workers"`
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+	// QueueDepthByLevel is the depth of the queue by priority level, from the highest one.
+	QueueDepthByLevel []int `json:"queue_depth_by_level"`
+}
+
+type PoolOption func(pool *WorkerPool)
+
+// WithPriorityLevels sets the number of priority levels of the pool, there is a single one by default.
+func WithPriorityLevels(levels int) PoolOption {
+	return func(pool *WorkerPool) {
+		if levels > 1 {
+			pool.queues = make([][]func(), levels)
+		}
+	}
+}
+
+func NewWorkerPool(workers, queueSize int, opts ...PoolOption) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	pool := &WorkerPool{
+		queues:   make([][]func(), 1),
+		capacity: queueSize,
+		workers:  workers,
+	}
+	pool.ready = sync.NewCond(&pool.mu)
+	for i := range opts {
+		opt := opts[i]
+		opt(pool)
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+func (p *WorkerPool) work() {
+	for {
+		p.mu.Lock()
+		for p.queued == 0 {
+			p.ready.Wait()
+		}
+		task := p.pop()
+		p.active++
+		p.mu.Unlock()
+
+		task()
+
+		p.mu.Lock()
+		p.active--
+		p.mu.Unlock()
+	}
+}
+
+// pop removes the oldest task of the highest priority, it must be called with mu held.
+func (p *WorkerPool) pop() func() {
+	for level, queue := range p.queues {
+		if len(queue) == 0 {
+			continue
+		}
+		task := queue[0]
+		queue[0] = nil
+		p.queues[level] = queue[1:]
+		p.queued--
+		return task
+	}
+	return nil
+}
+
+// TrySubmit queues the task with the highest priority without blocking.
+func (p *WorkerPool) TrySubmit(task func()) error {
+	return p.TrySubmitPriority(task, 0)
+}
+
+// TrySubmitPriority queues the task with the priority level without blocking. Levels beyond the lowest one
+// are treated as the lowest one.
+func (p *WorkerPool) TrySubmitPriority(task func(), level int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	if level < 0 {
+		level = 0
+	}
+	if level >= len(p.queues) {
+		level = len(p.queues) - 1
+	}
+	idle := p.workers - p.active
+	if p.queued >= idle+p.levelCapacity(level) {
+		return ErrQueueFull
+	}
+	p.queues[level] = append(p.queues[level], task)
+	p.queued++
+	p.ready.Signal()
+	return nil
+}
+
+// levelCapacity is the share of the queue the priority level may fill, the highest level may fill all of it.
+func (p *WorkerPool) levelCapacity(level int) int {
+	levels := len(p.queues)
+	return p.capacity * (levels - level) / levels
+}
+
+// Close stops accepting new tasks. Queued tasks are still executed.
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+}
+
+// Wait blocks until the queued and running tasks are finished or ctx is done. Tasks submitted meanwhile are
+// waited for as well, so the pool is usually closed first.
+func (p *WorkerPool) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(poolWaitInterval)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		idle := p.queued == 0 && p.active == 0
+		p.mu.Unlock()
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err() //nolint:wrapcheck // caller checks for deadline
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *WorkerPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	depthByLevel := make([]int, len(p.queues))
+	for level, queue := range p.queues {
+		depthByLevel[level] = len(queue)
+	}
+	return PoolStats{
+		Workers:           p.workers,
+		ActiveWorkers:     p.active,
+		QueueDepth:        p.queued,
+		QueueCapacity:     p.capacity,
+		QueueDepthByLevel: depthByLevel,
+	}
+}
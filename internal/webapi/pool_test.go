@@ -0,0 +1,81 @@
+package webapi
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool_QueueFull(t *testing.T) {
+	pool := NewWorkerPool(1, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	assert.NoError(t, pool.TrySubmit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.NoError(t, pool.TrySubmit(func() {}), "task should wait in the queue")
+	assert.ErrorIs(t, pool.TrySubmit(func() {}), ErrQueueFull)
+	assert.Equal(t, PoolStats{Workers: 1, ActiveWorkers: 1, QueueDepth: 1, QueueCapacity: 1,
+		QueueDepthByLevel: []int{1}}, pool.Stats())
+	close(release)
+}
+
+func TestWorkerPool_Closed(t *testing.T) {
+	pool := NewWorkerPool(1, 1)
+	pool.Close()
+	assert.ErrorIs(t, pool.TrySubmit(func() {}), ErrPoolClosed)
+}
+
+func TestWorkerPool_Wait(t *testing.T) {
+	pool := NewWorkerPool(1, 1)
+	release := make(chan struct{})
+	assert.NoError(t, pool.TrySubmit(func() { <-release }))
+	assert.NoError(t, pool.TrySubmit(func() {}))
+	pool.Close()
+
+	waitCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Wait(waitCtx), context.DeadlineExceeded, "a task is still running")
+	close(release)
+	assert.NoError(t, pool.Wait(context.Background()))
+	assert.Equal(t, 0, pool.Stats().QueueDepth)
+}
+
+func TestWorkerPool_Priority(t *testing.T) {
+	pool := NewWorkerPool(1, 3, WithPriorityLevels(3))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	assert.NoError(t, pool.TrySubmit(func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+		}
+	}
+	assert.NoError(t, pool.TrySubmitPriority(record("low"), 2))
+	assert.ErrorIs(t, pool.TrySubmitPriority(record("low"), 2), ErrQueueFull, "low fills a third of the queue")
+	assert.NoError(t, pool.TrySubmitPriority(record("normal"), 1))
+	assert.NoError(t, pool.TrySubmitPriority(record("high"), 0))
+	assert.ErrorIs(t, pool.TrySubmitPriority(record("high"), 0), ErrQueueFull)
+	assert.Equal(t, []int{1, 1, 1}, pool.Stats().QueueDepthByLevel)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order) == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"high", "normal", "low"}, order)
+}
@@ -0,0 +1,103 @@
+package webapi
+
+import (
+	"errors"
+	"fmt"
+)
+
+const HTTPHeaderXBackgroundPriority = "x-background-priority"
+
+var ErrInvalidPriority = errors.New("unknown x-background-priority")
+
+// Priority is the priority class of a background request, level 0 is the highest one.
+type Priority struct {
+	Name  string
+	Level int
+}
+
+// PriorityClasses are the allowed values of x-background-priority ordered from the highest priority,
+// with the highest priority each capped caller may use.
+type PriorityClasses struct {
+	names    []string
+	fallback Priority
+	caps     map[string]int
+}
+
+// DefaultPriorityClasses are high, normal and low, requests without x-background-priority are normal.
+var DefaultPriorityClasses = &PriorityClasses{
+	names:    []string{"high", "normal", "low"},
+	fallback: Priority{Name: "normal", Level: 1},
+}
+
+// NewPriorityClasses returns the classes named by names, from the highest priority. Requests without
+// x-background-priority get defaultName, caps maps caller identities to the highest priority they may use.
+// Empty names and defaultName fall back to DefaultPriorityClasses.
+func NewPriorityClasses(names []string, defaultName string, caps map[string]string) (*PriorityClasses, error) {
+	if len(names) == 0 {
+		names = DefaultPriorityClasses.names
+	}
+	if defaultName == "" {
+		defaultName = DefaultPriorityClasses.fallback.Name
+	}
+	classes := &PriorityClasses{
+		names: names,
+		caps:  make(map[string]int, len(caps)),
+	}
+	fallback, ok := classes.lookup(defaultName)
+	if !ok {
+		return nil, fmt.Errorf("%w: default %q", ErrInvalidPriority, defaultName)
+	}
+	classes.fallback = fallback
+	for caller, name := range caps {
+		priority, ok := classes.lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: cap %q of %s", ErrInvalidPriority, name, caller)
+		}
+		classes.caps[caller] = priority.Level
+	}
+	return classes, nil
+}
+
+// Names returns the classes from the highest priority.
+func (p *PriorityClasses) Names() []string {
+	return p.names
+}
+
+func (p *PriorityClasses) lookup(name string) (Priority, bool) {
+	for level, className := range p.names {
+		if className == name {
+			return Priority{Name: name, Level: level}, true
+		}
+	}
+	return Priority{}, false
+}
+
+// resolve returns the priority requested with rawPriority, lowered to the cap of the caller.
+func (p *PriorityClasses) resolve(rawPriority, caller string) (Priority, error) {
+	priority := p.fallback
+	if rawPriority != "" {
+		var ok bool
+		if priority, ok = p.lookup(rawPriority); !ok {
+			return Priority{}, fmt.Errorf("%w: %q", ErrInvalidPriority, rawPriority)
+		}
+	}
+	if capLevel, ok := p.caps[caller]; ok && priority.Level < capLevel {
+		priority = Priority{Name: p.names[capLevel], Level: capLevel}
+	}
+	return priority, nil
+}
+
+// stored returns the priority a stored request was accepted with, the default one if the class is gone.
+func (p *PriorityClasses) stored(name string) Priority {
+	if priority, ok := p.lookup(name); ok {
+		return priority
+	}
+	return p.fallback
+}
+
+// WithPriorities sets the priority classes of background requests, DefaultPriorityClasses by default.
+func WithPriorities(classes *PriorityClasses) AsyncOption {
+	return func(cfg *asyncConfig) {
+		cfg.priorities = classes
+	}
+}
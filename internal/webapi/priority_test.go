@@ -0,0 +1,61 @@
+package webapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityClasses_Resolve(t *testing.T) {
+	classes, err := NewPriorityClasses([]string{"interactive", "batch", "backfill"}, "batch",
+		map[string]string{"jwt:nightly": "backfill"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name     string
+		raw      string
+		caller   string
+		expected Priority
+		err      bool
+	}{
+		{name: "default", expected: Priority{Name: "batch", Level: 1}},
+		{name: "requested", raw: "interactive", caller: "jwt:user", expected: Priority{Name: "interactive"}},
+		{name: "capped", raw: "interactive", caller: "jwt:nightly", expected: Priority{Name: "backfill", Level: 2}},
+		{name: "default is capped", caller: "jwt:nightly", expected: Priority{Name: "backfill", Level: 2}},
+		{name: "unknown", raw: "urgent", err: true},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			priority, err := classes.resolve(tc.raw, tc.caller)
+			if tc.err {
+				assert.ErrorIs(t, err, ErrInvalidPriority)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, priority)
+		})
+	}
+}
+
+func TestNewPriorityClasses_Invalid(t *testing.T) {
+	_, err := NewPriorityClasses([]string{"high", "low"}, "normal", nil)
+	assert.ErrorIs(t, err, ErrInvalidPriority)
+	_, err = NewPriorityClasses([]string{"high", "low"}, "low", map[string]string{"jwt:user": "normal"})
+	assert.ErrorIs(t, err, ErrInvalidPriority)
+}
+
+func TestAsyncMw_InvalidPriority(t *testing.T) {
+	handlerFn := AsyncMw(nil)(new(handlerResponse))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", nil)
+	testRequest.Header.Set(HTTPHeaderXBackground, "true")
+	testRequest.Header.Set(HTTPHeaderXBackgroundPriority, "urgent")
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusBadRequest, testRecorder.Code)
+}
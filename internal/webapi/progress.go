@@ -0,0 +1,37 @@
+package webapi
+
+import (
+	"context"
+)
+
+type progressReporterKey struct{}
+
+type progressReporter interface {
+	progress(ctx context.Context, stage string)
+	failure(err error)
+}
+
+func withProgressReporter(ctx context.Context, reporter progressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, reporter)
+}
+
+// ReportProgress publishes the stage reached by a handler to the event stream of its background job.
+// It does nothing if the request is not executed in the background.
+func ReportProgress(ctx context.Context, stage string) {
+	reporter, ok := ctx.Value(progressReporterKey{}).(progressReporter)
+	if !ok {
+		return
+	}
+	reporter.progress(withoutCancel(ctx), stage)
+}
+
+// ReportError records the upstream error the handler failed with, the retry policy of the route matches
+// its gRPC code. Handlers report only errors after which the request can be safely executed again.
+// It does nothing if the request is not executed in the background.
+func ReportError(ctx context.Context, err error) {
+	reporter, ok := ctx.Value(progressReporterKey{}).(progressReporter)
+	if !ok {
+		return
+	}
+	reporter.failure(err)
+}
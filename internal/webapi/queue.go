@@ -0,0 +1,280 @@
+package webapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+const (
+	// DefaultQueueClaimIdle is how long a queued request may go without a heartbeat of its worker before
+	// another worker claims it.
+	DefaultQueueClaimIdle = time.Minute
+	// DefaultQueueMaxDeliveries is how many times a queued request is delivered before it is given up,
+	// a request whose workers keep dying is failed instead of taking down every worker.
+	DefaultQueueMaxDeliveries = 3
+	queueBlock                = 5 * time.Second
+	queueErrorBackoff         = time.Second
+)
+
+// BackgroundMode defines where background requests are executed.
+type BackgroundMode string
+
+const (
+	// BackgroundLocal executes background requests in the instance which accepted them.
+	BackgroundLocal BackgroundMode = "local"
+	// BackgroundQueue hands background requests over to the durable queue, they are executed by workers.
+	BackgroundQueue BackgroundMode = "queue"
+)
+
+var ErrInvalidBackgroundMode = errors.New("background mode must be local or queue")
+
+// ParseBackgroundMode returns the mode named by rawMode, BackgroundLocal if it is empty.
+func ParseBackgroundMode(rawMode string) (BackgroundMode, error) {
+	switch mode := BackgroundMode(rawMode); mode {
+	case "":
+		return BackgroundLocal, nil
+	case BackgroundLocal, BackgroundQueue:
+		return mode, nil
+	default:
+		return "", ErrInvalidBackgroundMode
+	}
+}
+
+// QueueWorker executes requests of the durable queue. Requests are replayed through handler, which is
+// usually the router of the API, and their results are saved like the ones of other background requests.
+// A request is removed from the queue once it is executed, the requests of a worker which died are
+// claimed by the other workers. Requests of higher priorities are executed first.
+type QueueWorker struct {
+	cacheConn     *responsecache.Cache
+	handler       http.Handler
+	priorities    []string
+	consumer      string
+	concurrency   int
+	claimIdle     time.Duration
+	maxDeliveries int64
+}
+
+// NewQueueWorker returns a worker which executes up to concurrency requests of the priority classes at once.
+// The consumer name must be unique among the workers.
+func NewQueueWorker(cacheConn *responsecache.Cache, handler http.Handler, priorities *PriorityClasses,
+	consumer string, concurrency int, claimIdle time.Duration,
+) *QueueWorker {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if claimIdle <= 0 {
+		claimIdle = DefaultQueueClaimIdle
+	}
+	return &QueueWorker{
+		cacheConn:     cacheConn,
+		handler:       handler,
+		priorities:    priorities.Names(),
+		consumer:      consumer,
+		concurrency:   concurrency,
+		claimIdle:     claimIdle,
+		maxDeliveries: DefaultQueueMaxDeliveries,
+	}
+}
+
+// Run executes queued requests until ctx is done. Requests which are being executed then are finished
+// before it returns.
+func (q *QueueWorker) Run(ctx context.Context) error {
+	for _, priority := range q.priorities {
+		if err := responsecache.CreateQueue(ctx, q.cacheConn, priority); err != nil {
+			return fmt.Errorf("create queue %s: %w", priority, err)
+		}
+	}
+	logging.FromContext(ctx).WithField("consumer", q.consumer).Info("queue worker started")
+	var wg sync.WaitGroup
+	q.consume(ctx, &wg)
+	wg.Wait()
+	return nil
+}
+
+// consume reads as many entries as there are free workers and executes each of them in a worker.
+func (q *QueueWorker) consume(ctx context.Context, wg *sync.WaitGroup) {
+	slots := make(chan struct{}, q.concurrency)
+	for ctx.Err() == nil {
+		select {
+		case slots <- struct{}{}:
+			<-slots
+		case <-ctx.Done():
+			return
+		}
+		// only consume takes slots, so at least one stays free until the entries are dispatched.
+		entries := q.next(ctx, int64(cap(slots)-len(slots)))
+		if len(entries) == 0 {
+			continue
+		}
+		// delivered requests are executed even if the worker is stopped meanwhile.
+		q.dispatch(withoutCancel(ctx), entries, slots, wg)
+	}
+}
+
+// next returns up to count entries to execute, ordered by priority. Stale entries of dead workers go first,
+// then new entries of the highest priority which has some.
+func (q *QueueWorker) next(ctx context.Context, count int64) []responsecache.QueueEntry {
+	logger := logging.FromContext(ctx)
+	for _, priority := range q.priorities {
+		entries, err := responsecache.ClaimStaleEntries(ctx, q.cacheConn, priority, q.consumer, q.claimIdle, count)
+		if err != nil {
+			q.readFailed(ctx, err)
+			return nil
+		}
+		for _, entry := range entries {
+			logger.WithField("entry_id", entry.ID).Warn("stale queue entry claimed")
+		}
+		if len(entries) > 0 {
+			return entries
+		}
+	}
+	entries, err := responsecache.ReadQueue(ctx, q.cacheConn, q.consumer, q.priorities, count, queueBlock)
+	if err != nil {
+		q.readFailed(ctx, err)
+		return nil
+	}
+	return entries
+}
+
+func (q *QueueWorker) readFailed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	logging.FromContext(ctx).WithError(err).Error("read queue failed")
+	waitRetry(ctx, queueErrorBackoff)
+}
+
+// dispatch executes each entry once a slot is free, the entries are all kept claimed by the worker until
+// they are executed. Entries beyond the free slots, which a blocking read may deliver, wait in order.
+func (q *QueueWorker) dispatch(ctx context.Context, entries []responsecache.QueueEntry, slots chan struct{},
+	wg *sync.WaitGroup,
+) {
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	var batch sync.WaitGroup
+	batch.Add(len(entries))
+	go q.heartbeat(heartbeatCtx, entries)
+	go func() {
+		batch.Wait()
+		stopHeartbeat()
+	}()
+	for _, entry := range entries {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(entry responsecache.QueueEntry) {
+			defer wg.Done()
+			defer batch.Done()
+			defer func() { <-slots }()
+			q.process(ctx, entry)
+		}(entry)
+	}
+}
+
+// process executes the entry and removes it from the queue. An entry whose job can not be loaded is left
+// pending, it is claimed again later.
+func (q *QueueWorker) process(ctx context.Context, entry responsecache.QueueEntry) {
+	logger := logging.FromContext(ctx).WithField("entry_id", entry.ID)
+	if entry.Request == nil {
+		logger.Error("malformed queue entry is dropped")
+		q.ack(ctx, entry)
+		return
+	}
+	stored := entry.Request
+	logger = logger.WithField("bg_id", stored.ID)
+	ctx = logging.WithContext(ctx, logger)
+	job, err := storedJob(ctx, q.cacheConn, stored)
+	if err != nil {
+		logger.WithError(err).Error("get queued job failed")
+		return
+	}
+	switch {
+	case job.Status.Finished():
+		logger.Info("queued request is finished already")
+	case q.cancelRequested(ctx, stored.ID):
+		logger.Info("queued request is cancelled before start")
+		finishStored(ctx, q.cacheConn, stored, job, &responsecache.HTTPResponse{
+			Code: StatusClientClosedRequest,
+			Body: []byte("Request cancelled before start"),
+		}, responsecache.JobCancelled)
+	case entry.Deliveries > q.maxDeliveries:
+		logger.WithField("deliveries", entry.Deliveries).Error("queued request is abandoned")
+		finishStored(ctx, q.cacheConn, stored, job, &responsecache.HTTPResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte("Request abandoned, its workers did not finish it"),
+		}, responsecache.JobFailed)
+	default:
+		q.execute(ctx, stored, job)
+	}
+	q.ack(ctx, entry)
+}
+
+// cancelRequested reports whether the job was cancelled while its request was queued. The request is executed
+// if that can not be checked, the job is then cancelled between its attempts.
+func (q *QueueWorker) cancelRequested(ctx context.Context, id string) bool {
+	requested, err := responsecache.CancelRequested(ctx, q.cacheConn, id)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("check cancel request failed")
+		return false
+	}
+	return requested
+}
+
+// execute replays the request and records its outcome if it was not executed.
+func (q *QueueWorker) execute(ctx context.Context, stored *responsecache.StoredRequest, job *responsecache.Job) {
+	logger := logging.FromContext(ctx)
+	if err := responsecache.OpenStoredRequest(q.cacheConn, stored); err != nil {
+		logger.WithError(err).Error("decrypt queued request failed")
+		finishStored(ctx, q.cacheConn, stored, job, &responsecache.HTTPResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte("queued request can not be decrypted"),
+		}, responsecache.JobFailed)
+		return
+	}
+	logger.Trace("queued request started")
+	resp, err := replayStored(ctx, q.handler, &storedRun{job: job, request: stored, sync: true})
+	if err != nil {
+		logger.WithError(err).Error("restore queued request failed")
+		finishStored(ctx, q.cacheConn, stored, job, &responsecache.HTTPResponse{
+			Code: http.StatusBadRequest,
+			Body: []byte("queued request can not be restored"),
+		}, responsecache.JobFailed)
+		return
+	}
+	if resp.code != http.StatusOK {
+		// the route does not exist anymore or rejected the request
+		logger.WithField("code", resp.code).Error("queued request was not executed")
+		finishStored(ctx, q.cacheConn, stored, job, rejectedResponse(resp), responsecache.JobFailed)
+	}
+}
+
+// heartbeat keeps the entries claimed by the worker until ctx is done. Entries which are acknowledged
+// already are not claimed again.
+func (q *QueueWorker) heartbeat(ctx context.Context, entries []responsecache.QueueEntry) {
+	ticker := time.NewTicker(q.claimIdle / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, entry := range entries {
+				if err := responsecache.TouchQueueEntry(ctx, q.cacheConn, q.consumer, entry); err != nil {
+					logging.FromContext(ctx).WithError(err).Warn("touch queue entry failed")
+				}
+			}
+		}
+	}
+}
+
+func (q *QueueWorker) ack(ctx context.Context, entry responsecache.QueueEntry) {
+	if err := responsecache.AckQueueEntry(ctx, q.cacheConn, entry); err != nil {
+		logging.FromContext(ctx).WithError(err).WithField("entry_id", entry.ID).Error("ack queue entry failed")
+	}
+}
@@ -0,0 +1,294 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestParseBackgroundMode(t *testing.T) {
+	mode, err := ParseBackgroundMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, BackgroundLocal, mode)
+	mode, err = ParseBackgroundMode("queue")
+	assert.NoError(t, err)
+	assert.Equal(t, BackgroundQueue, mode)
+	_, err = ParseBackgroundMode("cluster")
+	assert.ErrorIs(t, err, ErrInvalidBackgroundMode)
+}
+
+func TestAsyncMw_Queue(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		job, ok := actual[2].(*responsecache.Job)
+		if !ok || job.Status != responsecache.JobQueued || job.Path != "/send" {
+			return fmt.Errorf("unexpected job %+v", actual[2])
+		}
+		return nil
+	}).ExpectSet("job", nil, 0).SetVal("OK")
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		stored, ok := actual[len(actual)-1].(*responsecache.StoredRequest)
+		if actual[0] != "xadd" || !ok || string(stored.Body) != `{"name":"John"}` {
+			return fmt.Errorf("unexpected command %v", actual)
+		}
+		return nil
+	}).ExpectXAdd(&redis.XAddArgs{
+		Stream: responsecache.QueueStream("normal"),
+		Values: map[string]interface{}{"request": nil},
+	}).SetVal("1-0")
+	handler := &storedRunRecorder{code: http.StatusOK}
+	handlerFn := AsyncMw(cacheConn, WithQueue())(handler)
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{"name":"John"}`))
+	testRequest.Header.Set(HTTPHeaderXBackground, "true")
+	handlerFn.ServeHTTP(testRecorder, testRequest.WithContext(ctx))
+
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+	assert.Empty(t, handler.caller, "the request is executed by a worker")
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+}
+
+func TestAsyncMw_Queue_Failed(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	var jobKey string
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		jobKey, _ = actual[1].(string)
+		return nil
+	}).ExpectSet("job", nil, 0).SetVal("OK")
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		return nil
+	}).ExpectXAdd(&redis.XAddArgs{
+		Stream: responsecache.QueueStream("normal"),
+		Values: map[string]interface{}{"request": nil},
+	}).SetErr(errors.New("connection refused"))
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		if actual[1] != jobKey {
+			return fmt.Errorf("deleted %v instead of the job %s", actual[1], jobKey)
+		}
+		return nil
+	}).ExpectDel("job").SetVal(1)
+	handlerFn := AsyncMw(cacheConn, WithQueue())(&storedRunRecorder{code: http.StatusOK})
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(`{"name":"John"}`))
+	testRequest.Header.Set(HTTPHeaderXBackground, "true")
+	handlerFn.ServeHTTP(testRecorder, testRequest.WithContext(ctx))
+
+	assert.Equal(t, http.StatusInternalServerError, testRecorder.Code)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the job of the request which was not queued is removed")
+}
+
+func TestQueueWorker_Process(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	bgID := "uniq_id"
+	entry := responsecache.QueueEntry{
+		ID:       "1-0",
+		Priority: "normal",
+		Request: &responsecache.StoredRequest{
+			ID:     bgID,
+			Method: http.MethodPost,
+			URL:    "/send",
+			Body:   []byte(`{"name":"John"}`),
+			Owner:  "jwt:user",
+		},
+		Deliveries: 1,
+	}
+	expectAck := func(mockedCacheConn redismock.ClientMock) {
+		mockedCacheConn.ExpectXAck(responsecache.QueueStream("normal"), "bg-workers", entry.ID).SetVal(1)
+		mockedCacheConn.ExpectXDel(responsecache.QueueStream("normal"), entry.ID).SetVal(1)
+	}
+	testCases := []struct {
+		name     string
+		status   responsecache.JobStatus
+		executed bool
+	}{
+		{name: "queued", status: responsecache.JobQueued, executed: true},
+		{name: "finished", status: responsecache.JobCancelled},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			redisClient, mockedCacheConn := redismock.NewClientMock()
+			cacheConn := &responsecache.Cache{
+				Client: redisClient,
+			}
+			rawJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: tc.status})
+			if err != nil {
+				t.Fatal(err)
+			}
+			mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(rawJob))
+			if tc.executed {
+				mockedCacheConn.ExpectExists(responsecache.CancelKey(bgID)).SetVal(0)
+			}
+			expectAck(mockedCacheConn)
+			handler := &storedRunRecorder{code: http.StatusOK}
+
+			NewQueueWorker(cacheConn, handler, DefaultPriorityClasses, "worker-1", 1, time.Minute).process(ctx, entry)
+
+			assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the entry is acknowledged")
+			if !tc.executed {
+				assert.Nil(t, handler.run)
+				return
+			}
+			assert.Equal(t, "jwt:user", handler.caller)
+			assert.Equal(t, `{"name":"John"}`, handler.body)
+			if assert.NotNil(t, handler.run) {
+				assert.True(t, handler.run.sync, "the worker waits for the execution")
+			}
+		})
+	}
+}
+
+// cancelOnFirstCall fails the first attempt after its job was cancelled through the API.
+type cancelOnFirstCall struct {
+	calls  int32
+	cancel func()
+}
+
+func (c *cancelOnFirstCall) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		c.cancel()
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func TestQueueWorker_Cancel(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	bgID := "uniq_id"
+	entry := responsecache.QueueEntry{
+		ID:       "1-0",
+		Priority: "normal",
+		Request: &responsecache.StoredRequest{
+			ID:     bgID,
+			Method: http.MethodPost,
+			URL:    "/send",
+			Owner:  "jwt:user",
+		},
+		Deliveries: 1,
+	}
+	policy := BackgroundPolicy{
+		Allowed:    true,
+		DefaultTTL: time.Second,
+		Retry:      RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, RetryableCodes: []int{http.StatusBadGateway}},
+	}
+	// the API instance has none of the jobs of the workers in its registry
+	cancel := func(cacheConn *responsecache.Cache) int {
+		testRecorder := httptest.NewRecorder()
+		testRequest := httptest.NewRequest(http.MethodDelete, "/bg-responses/{bg_id}", nil)
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("bg_id", bgID)
+		testRequest = testRequest.WithContext(context.WithValue(WithCaller(ctx, "jwt:user"), chi.RouteCtxKey, chiCtx))
+		CancelBackground(cacheConn, NewJobRegistry(), CallerOwns).ServeHTTP(testRecorder, testRequest)
+		return testRecorder.Code
+	}
+
+	t.Run("before start", func(t *testing.T) {
+		cacheConn := &responsecache.Cache{Store: responsecache.NewMemoryStore(0)}
+		err := responsecache.SaveJob(ctx, cacheConn, &responsecache.Job{
+			ID:     bgID,
+			Status: responsecache.JobQueued,
+			Owner:  "jwt:user",
+		}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusAccepted, cancel(cacheConn))
+		handler := &storedRunRecorder{code: http.StatusOK}
+
+		NewQueueWorker(cacheConn, handler, DefaultPriorityClasses, "worker-1", 1, time.Minute).process(ctx, entry)
+
+		assert.Nil(t, handler.run, "the cancelled request is not executed")
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, responsecache.JobCancelled, job.Status)
+			assert.Equal(t, StatusClientClosedRequest, job.Code)
+		}
+	})
+
+	t.Run("between attempts", func(t *testing.T) {
+		cacheConn := &responsecache.Cache{Store: responsecache.NewMemoryStore(0)}
+		err := responsecache.SaveJob(ctx, cacheConn, &responsecache.Job{
+			ID:     bgID,
+			Status: responsecache.JobQueued,
+			Owner:  "jwt:user",
+		}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := &cancelOnFirstCall{cancel: func() {
+			assert.Equal(t, http.StatusAccepted, cancel(cacheConn))
+		}}
+		router := AsyncMw(cacheConn, WithPolicy(policy))(handler)
+
+		NewQueueWorker(cacheConn, router, DefaultPriorityClasses, "worker-1", 1, time.Minute).process(ctx, entry)
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&handler.calls), "the request is not retried once cancelled")
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, responsecache.JobCancelled, job.Status)
+			assert.Equal(t, StatusClientClosedRequest, job.Code)
+		}
+	})
+}
+
+func TestQueueWorker_Next(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	var streams []string
+	for _, priority := range DefaultPriorityClasses.Names() {
+		streams = append(streams, responsecache.QueueStream(priority))
+		mockedCacheConn.ExpectXPendingExt(&redis.XPendingExtArgs{
+			Stream: responsecache.QueueStream(priority),
+			Group:  "bg-workers",
+			Start:  "-",
+			End:    "+",
+			Count:  100,
+		}).SetVal(nil)
+	}
+	// the hash of the script is not checked
+	mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+		if count := actual[len(actual)-1]; count != int64(3) {
+			return fmt.Errorf("read %v entries, want 3", count)
+		}
+		return nil
+	}).ExpectEvalSha("", streams, "bg-workers", "worker-1", int64(3)).SetVal([]interface{}{
+		responsecache.QueueStream("normal"),
+		[]interface{}{
+			[]interface{}{"1-0", []interface{}{"request", `{"id":"a"}`}},
+			[]interface{}{"2-0", []interface{}{"request", `{"id":"b"}`}},
+		},
+	})
+	worker := NewQueueWorker(cacheConn, http.NotFoundHandler(), DefaultPriorityClasses, "worker-1", 3, time.Minute)
+
+	entries := worker.next(ctx, 3)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the free workers are filled with one read")
+	assert.Len(t, entries, 2)
+}
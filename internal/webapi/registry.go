@@ -0,0 +1,125 @@
+package webapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+type runningJob struct {
+	cancel    context.CancelFunc
+	done      chan struct{}
+	retention time.Duration
+	// reason is the final status of a job whose context was cancelled.
+	reason responsecache.JobStatus
+}
+
+// JobRegistry keeps track of background jobs running in this process.
+type JobRegistry struct {
+	mu   sync.Mutex
+	jobs map[string]*runningJob
+}
+
+func NewJobRegistry() *JobRegistry {
+	return &JobRegistry{
+		jobs: make(map[string]*runningJob),
+	}
+}
+
+func (j *JobRegistry) register(id string, cancel context.CancelFunc, retention time.Duration) *runningJob {
+	job := &runningJob{
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		retention: retention,
+	}
+	j.mu.Lock()
+	j.jobs[id] = job
+	j.mu.Unlock()
+	return job
+}
+
+func (j *JobRegistry) finish(id string) {
+	j.mu.Lock()
+	job, ok := j.jobs[id]
+	delete(j.jobs, id)
+	j.mu.Unlock()
+	if ok {
+		close(job.done)
+	}
+}
+
+// cancelReason returns the reason the job was cancelled with, empty if it was not cancelled.
+func (j *JobRegistry) cancelReason(id string) responsecache.JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if job, ok := j.jobs[id]; ok {
+		return job.reason
+	}
+	return ""
+}
+
+func (j *JobRegistry) cancelJob(id string, reason responsecache.JobStatus) (*runningJob, bool) {
+	j.mu.Lock()
+	job, ok := j.jobs[id]
+	if ok && job.reason == "" {
+		job.reason = reason
+	}
+	j.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	job.cancel()
+	return job, true
+}
+
+// Cancel cancels the context of a running job. It returns a channel which is closed once the job is
+// finished, and false if the job is not running in this process.
+func (j *JobRegistry) Cancel(id string) (<-chan struct{}, bool) {
+	job, ok := j.cancelJob(id, responsecache.JobCancelled)
+	if !ok {
+		return nil, false
+	}
+	return job.done, true
+}
+
+// Wait blocks until all registered jobs are finished or ctx is done.
+func (j *JobRegistry) Wait(ctx context.Context) error {
+	for {
+		j.mu.Lock()
+		pending := make([]chan struct{}, 0, len(j.jobs))
+		for _, job := range j.jobs {
+			pending = append(pending, job.done)
+		}
+		j.mu.Unlock()
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, done := range pending {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return ctx.Err() //nolint:wrapcheck // caller checks for deadline
+			}
+		}
+	}
+}
+
+// Interrupt cancels all registered jobs, they are finished with the interrupted status.
+func (j *JobRegistry) Interrupt() {
+	for id := range j.Remaining() {
+		j.cancelJob(id, responsecache.JobInterrupted)
+	}
+}
+
+// Remaining returns ids of the registered jobs with their retention.
+func (j *JobRegistry) Remaining() map[string]time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	remaining := make(map[string]time.Duration, len(j.jobs))
+	for id, job := range j.jobs {
+		remaining[id] = job.retention
+	}
+	return remaining
+}
@@ -0,0 +1,66 @@
+package webapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultMaxBodySize limits the body of background requests, it is buffered in memory.
+const DefaultMaxBodySize = 1 << 20
+
+var ErrBodyTooLarge = errors.New("request body is too large")
+
+// snapshotRequest returns a copy of r which stays valid after the server finished the original request:
+// the body is buffered up to maxBodySize bytes and the route context is copied.
+func snapshotRequest(r *http.Request, maxBodySize int64) (*http.Request, error) {
+	body, err := readBody(r, maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := r.Context()
+	if routeCtx := chi.RouteContext(ctx); routeCtx != nil {
+		// chi resets its route context once the request is served.
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, copyRouteContext(routeCtx))
+	}
+	snapshot := r.Clone(ctx)
+	snapshot.ContentLength = int64(len(body))
+	snapshot.Body = ioutil.NopCloser(bytes.NewReader(body))
+	snapshot.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return snapshot, nil
+}
+
+// readBody reads the body of r up to maxBodySize bytes.
+func readBody(r *http.Request, maxBodySize int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read request body: %w", err)
+	}
+	if int64(len(body)) > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
+
+func copyRouteContext(routeCtx *chi.Context) *chi.Context {
+	routeCopy := chi.NewRouteContext()
+	routeCopy.Routes = routeCtx.Routes
+	routeCopy.RoutePath = routeCtx.RoutePath
+	routeCopy.RouteMethod = routeCtx.RouteMethod
+	routeCopy.URLParams.Keys = append([]string(nil), routeCtx.URLParams.Keys...)
+	routeCopy.URLParams.Values = append([]string(nil), routeCtx.URLParams.Values...)
+	routeCopy.RoutePatterns = append([]string(nil), routeCtx.RoutePatterns...)
+	return routeCopy
+}
@@ -0,0 +1,73 @@
+package webapi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestSnapshotRequest(t *testing.T) {
+	routeCtx := chi.NewRouteContext()
+	routeCtx.URLParams.Add("bg_id", "uniq_id")
+	testRequest := httptest.NewRequest(http.MethodPost, "/send?name=John", strings.NewReader("payload"))
+	testRequest = testRequest.WithContext(context.WithValue(context.Background(), chi.RouteCtxKey, routeCtx))
+	testRequest.Header.Set("X-Custom", "value")
+
+	snapshot, err := snapshotRequest(testRequest, DefaultMaxBodySize)
+	assert.NoError(t, err)
+
+	// the server finishes the original request
+	routeCtx.Reset()
+	testRequest.Header.Del("X-Custom")
+	testRequest.URL.RawQuery = ""
+	_, _ = ioutil.ReadAll(testRequest.Body)
+
+	body, err := ioutil.ReadAll(snapshot.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(body))
+	assert.Equal(t, int64(len("payload")), snapshot.ContentLength)
+	assert.Equal(t, "value", snapshot.Header.Get("X-Custom"))
+	assert.Equal(t, "John", snapshot.URL.Query().Get("name"))
+	assert.Equal(t, "uniq_id", chi.URLParam(snapshot, "bg_id"))
+}
+
+func TestSnapshotRequest_TooLarge(t *testing.T) {
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader("payload"))
+
+	_, err := snapshotRequest(testRequest, 4)
+
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestAsyncMw_BodyTooLarge(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+
+	handlerFn := AsyncMw(cacheConn, WithMaxBodySize(4))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler must not be called for a rejected request")
+	}))
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader("payload"))
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header.Add(HTTPHeaderXBackground, "true")
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, testRecorder.Code)
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
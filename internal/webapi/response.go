@@ -3,13 +3,22 @@ package webapi
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sugar-pack/users-manager/pkg/logging"
 )
 
-const ErrMsgWritingResponse = "Error while writing response"
+const (
+	ErrMsgWritingResponse = "Error while writing response"
+	// StatusClientClosedRequest is the nginx status for requests cancelled before completion.
+	StatusClientClosedRequest = 499
+)
 
 func BadRequest(ctx context.Context, writer http.ResponseWriter, msg string) {
 	logger := logging.FromContext(ctx)
@@ -29,6 +38,15 @@ func InternalError(ctx context.Context, writer http.ResponseWriter, s string) {
 	}
 }
 
+func RequestCancelled(ctx context.Context, writer http.ResponseWriter, s string) {
+	logger := logging.FromContext(ctx)
+	writer.WriteHeader(StatusClientClosedRequest)
+	_, wErr := writer.Write([]byte(s))
+	if wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+	}
+}
+
 func StatusOk(ctx context.Context, writer http.ResponseWriter, s string) {
 	logger := logging.FromContext(ctx)
 	writer.WriteHeader(http.StatusOK)
@@ -38,9 +56,56 @@ func StatusOk(ctx context.Context, writer http.ResponseWriter, s string) {
 	}
 }
 
-func StatusAccepted(ctx context.Context, writer http.ResponseWriter, s, backgroundID string) {
+func StatusOkJSON(ctx context.Context, writer http.ResponseWriter, v interface{}) {
+	jsonResponse(ctx, writer, http.StatusOK, v)
+}
+
+func StatusAcceptedJSON(ctx context.Context, writer http.ResponseWriter, v interface{}) {
+	jsonResponse(ctx, writer, http.StatusAccepted, v)
+}
+
+func Forbidden(ctx context.Context, writer http.ResponseWriter, msg string) {
+	logger := logging.FromContext(ctx)
+	writer.WriteHeader(http.StatusForbidden)
+	_, wErr := writer.Write([]byte(msg))
+	if wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+	}
+}
+
+func Conflict(ctx context.Context, writer http.ResponseWriter, msg string) {
+	logger := logging.FromContext(ctx)
+	writer.WriteHeader(http.StatusConflict)
+	_, wErr := writer.Write([]byte(msg))
+	if wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+	}
+}
+
+func RequestEntityTooLarge(ctx context.Context, writer http.ResponseWriter, msg string) {
+	logger := logging.FromContext(ctx)
+	writer.WriteHeader(http.StatusRequestEntityTooLarge)
+	_, wErr := writer.Write([]byte(msg))
+	if wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+	}
+}
+
+func NotImplemented(ctx context.Context, writer http.ResponseWriter, msg string) {
 	logger := logging.FromContext(ctx)
-	writer.Header().Add("x-background-id", backgroundID)
+	writer.WriteHeader(http.StatusNotImplemented)
+	_, wErr := writer.Write([]byte(msg))
+	if wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+	}
+}
+
+func StatusAccepted(ctx context.Context, writer http.ResponseWriter, s, backgroundID string, retention time.Duration) {
+	logger := logging.FromContext(ctx)
+	writer.Header().Add(HTTPHeaderXBackgroundID, backgroundID)
+	if retention > 0 {
+		writer.Header().Add(HTTPHeaderXBackgroundRetention, retention.String())
+	}
 	writer.WriteHeader(http.StatusAccepted)
 	_, wErr := writer.Write([]byte(s))
 	if wErr != nil {
@@ -48,6 +113,20 @@ func StatusAccepted(ctx context.Context, writer http.ResponseWriter, s, backgrou
 	}
 }
 
+func ServiceUnavailable(ctx context.Context, writer http.ResponseWriter, msg string, retryAfter time.Duration) {
+	logger := logging.FromContext(ctx)
+	retryAfterSeconds := int64(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	writer.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds, 10))
+	writer.WriteHeader(http.StatusServiceUnavailable)
+	_, wErr := writer.Write([]byte(msg))
+	if wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+	}
+}
+
 func NotFound(ctx context.Context, w http.ResponseWriter, msg string) {
 	logger := logging.FromContext(ctx)
 	body := strings.NewReader(msg)
@@ -71,3 +150,34 @@ func rawResponse(ctx context.Context, w http.ResponseWriter, httpCode int, httpH
 		logger.WithError(wErr).Error(ErrMsgWritingResponse)
 	}
 }
+
+// streamResponse copies the body to the client, it reports whether the whole body was written.
+func streamResponse(ctx context.Context, w http.ResponseWriter, httpCode int, httpHeaders http.Header,
+	body io.Reader,
+) bool {
+	logger := logging.FromContext(ctx)
+	for k, vs := range httpHeaders {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(httpCode)
+	if _, wErr := io.Copy(w, body); wErr != nil {
+		logger.WithError(wErr).Error(ErrMsgWritingResponse)
+		return false
+	}
+	return true
+}
+
+func jsonResponse(ctx context.Context, w http.ResponseWriter, httpCode int, v interface{}) {
+	logger := logging.FromContext(ctx)
+	body, err := json.Marshal(v)
+	if err != nil {
+		logger.WithError(err).Error("Error while encoding response")
+		InternalError(ctx, w, "Error while encoding response")
+		return
+	}
+	httpHeaders := make(http.Header)
+	httpHeaders.Set("Content-Type", "application/json")
+	rawResponse(ctx, w, httpCode, httpHeaders, body)
+}
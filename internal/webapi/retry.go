@@ -0,0 +1,79 @@
+package webapi
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// HTTPHeaderXBackgroundAttempts is set on stored results of requests which were executed more than once.
+const HTTPHeaderXBackgroundAttempts = "x-background-attempts"
+
+// RetryPolicy defines how failed background executions of a route are retried. Only responses which
+// were not sent to the client yet are retried, so the client gets the response of the last attempt.
+type RetryPolicy struct {
+	// MaxAttempts limits the executions of a request, values below 2 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the second attempt, it doubles with every attempt up to MaxBackoff.
+	// Zero MaxBackoff means no limit.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// RetryableCodes are the HTTP status codes of responses which are retried.
+	RetryableCodes []int
+	// RetryableGRPCCodes are the codes of upstream errors, reported with ReportError, which are retried.
+	RetryableGRPCCodes []codes.Code
+}
+
+// DefaultRetryPolicy retries requests which failed because an upstream service was not reachable.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:        3,
+	Backoff:            200 * time.Millisecond,
+	MaxBackoff:         2 * time.Second,
+	RetryableGRPCCodes: []codes.Code{codes.Unavailable, codes.DeadlineExceeded},
+}
+
+// retryable reports whether an attempt which ended with the status code and upstream gRPC code is retried.
+func (p RetryPolicy) retryable(statusCode int, grpcCode string) bool {
+	for _, code := range p.RetryableCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	if grpcCode == "" {
+		return false
+	}
+	for _, code := range p.RetryableGRPCCodes {
+		if code.String() == grpcCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay after the given attempt, attempts are counted from one.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return backoff
+}
+
+// waitRetry waits for the backoff, it reports false if ctx was cancelled meanwhile.
+func waitRetry(ctx context.Context, backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(2))
+	assert.Equal(t, 300*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, 300*time.Millisecond, policy.backoff(10))
+}
+
+func TestRetryPolicy_Retryable(t *testing.T) {
+	policy := RetryPolicy{
+		RetryableCodes:     []int{http.StatusServiceUnavailable},
+		RetryableGRPCCodes: []codes.Code{codes.Unavailable},
+	}
+	assert.True(t, policy.retryable(http.StatusServiceUnavailable, ""))
+	assert.True(t, policy.retryable(http.StatusInternalServerError, codes.Unavailable.String()))
+	assert.False(t, policy.retryable(http.StatusInternalServerError, codes.InvalidArgument.String()))
+	assert.False(t, policy.retryable(http.StatusInternalServerError, ""))
+}
+
+// flakyHandler fails with an unavailable upstream until it is called for the given attempt.
+type flakyHandler struct {
+	calls     int32
+	succeedAt int32
+}
+
+func (f *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if atomic.AddInt32(&f.calls, 1) < f.succeedAt {
+		ReportError(ctx, status.Error(codes.Unavailable, "connection refused"))
+		InternalError(ctx, w, "upstream failed")
+		return
+	}
+	StatusOk(ctx, w, "finally")
+}
+
+func TestAsyncMw_RetryBeforeDetach(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	retry := RetryPolicy{
+		MaxAttempts:        3,
+		Backoff:            time.Millisecond,
+		RetryableGRPCCodes: []codes.Code{codes.Unavailable},
+	}
+	testCases := []struct {
+		name         string
+		succeedAt    int32
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "succeeds", succeedAt: 3, expectedCode: http.StatusOK, expectedBody: "finally"},
+		{name: "attempts exhausted", succeedAt: 4, expectedCode: http.StatusInternalServerError,
+			expectedBody: "upstream failed"},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			handler := &flakyHandler{succeedAt: tc.succeedAt}
+			policy := BackgroundPolicy{Allowed: true, DefaultTTL: time.Second, Retry: retry}
+			handlerFn := AsyncMw(cacheConn, WithPolicy(policy))(handler)
+
+			testRecorder := httptest.NewRecorder()
+			testRequest := httptest.NewRequest(http.MethodPost, "/send", nil)
+			testRequest.Header.Set(HTTPHeaderXBackground, "true")
+			handlerFn.ServeHTTP(testRecorder, testRequest.WithContext(ctx))
+
+			assert.Equal(t, tc.expectedCode, testRecorder.Code)
+			assert.Equal(t, tc.expectedBody, testRecorder.Body.String())
+			assert.Equal(t, int32(3), atomic.LoadInt32(&handler.calls))
+		})
+	}
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "requests which were not detached use no cache")
+}
+
+func TestBackgroundRun_FinishAttempt(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	bgID := "uniq_id"
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobQueued, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventAccepted)
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobQueued, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventRetrying)
+
+	bgRun := newBackgroundRun(cacheConn, nil, RetryPolicy{MaxAttempts: 2, RetryableCodes: []int{http.StatusBadGateway}})
+	job := bgRun.detach(ctx, &responsecache.Job{ID: bgID})
+	bgRun.startAttempt()
+	bgRun.failure(status.Error(codes.Unavailable, "connection refused"))
+	assert.True(t, bgRun.retryable(http.StatusBadGateway))
+	bgRun.finishAttempt(ctx, http.StatusBadGateway, true)
+	bgRun.startAttempt()
+	assert.False(t, bgRun.retryable(http.StatusBadGateway), "attempts are exhausted")
+	bgRun.finishAttempt(ctx, http.StatusBadGateway, false)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+	if assert.Len(t, job.Attempts, 2) {
+		assert.Equal(t, http.StatusBadGateway, job.Attempts[0].Code)
+		assert.Equal(t, codes.Unavailable.String(), job.Attempts[0].GRPCCode)
+		assert.Equal(t, "rpc error: code = Unavailable desc = connection refused", job.Attempts[0].Error)
+		assert.Empty(t, job.Attempts[1].GRPCCode)
+	}
+}
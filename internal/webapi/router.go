@@ -3,6 +3,7 @@ package webapi
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Sugar-pack/users-manager/pkg/logging"
 	"github.com/go-chi/chi/v5"
@@ -15,25 +16,176 @@ import (
 
 const TracerNameServer = "public-api"
 
-func CreateRouter(logger logging.Logger, handler *Handler, cacheConn *responsecache.Cache) *chi.Mux {
+type routerConfig struct {
+	asyncOpts      []AsyncOption
+	idempotencyTTL time.Duration
+	identity       CallerIdentity
+	owns           OwnershipCheck
+	readMode       ResultReadMode
+	isAdmin        AdminCheck
+	// policies override the background policies of routes, keys are "METHOD pattern".
+	policies map[string]BackgroundPolicy
+}
+
+type RouterOption func(cfg *routerConfig)
+
+// WithAsyncOptions configures the AsyncMw of every route.
+func WithAsyncOptions(opts ...AsyncOption) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.asyncOpts = append(cfg.asyncOpts, opts...)
+	}
+}
+
+// WithIdempotencyTTL sets how long responses of requests with an Idempotency-Key are replayed.
+func WithIdempotencyTTL(ttl time.Duration) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.idempotencyTTL = ttl
+	}
+}
+
+// WithCallerIdentity sets how callers are identified, background results are bound to them.
+func WithCallerIdentity(identity CallerIdentity) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.identity = identity
+	}
+}
+
+// WithOwnershipCheck sets who may access background results.
+func WithOwnershipCheck(owns OwnershipCheck) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.owns = owns
+	}
+}
+
+// WithResultReadMode sets whether background results are removed once read, clients may override it.
+func WithResultReadMode(mode ResultReadMode) RouterOption {
+	return func(cfg *routerConfig) {
+		if mode != "" {
+			cfg.readMode = mode
+		}
+	}
+}
+
+// WithAdminCheck sets who may use the operator endpoints.
+func WithAdminCheck(isAdmin AdminCheck) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.isAdmin = isAdmin
+	}
+}
+
+// WithRoutePolicy overrides the background policy of the route.
+func WithRoutePolicy(method, pattern string, policy BackgroundPolicy) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.policies[method+" "+pattern] = policy
+	}
+}
+
+func CreateRouter(logger logging.Logger, handler *Handler, cacheConn *responsecache.Cache, registry *JobRegistry,
+	pool *WorkerPool, opts ...RouterOption,
+) *chi.Mux {
 	err := trace.InitJaegerTracing(logger)
 	if err != nil {
 		logger.WithError(err).Error("failed to init Jaeger Tracing")
 
 		return nil
 	}
+	cfg := &routerConfig{
+		idempotencyTTL: DefaultIdempotencyTTL,
+		identity:       DefaultCallerIdentity,
+		owns:           CallerOwns,
+		readMode:       ResultConsume,
+		isAdmin:        AdminCallers(nil),
+		policies:       make(map[string]BackgroundPolicy),
+	}
+	for i := range opts {
+		opt := opts[i]
+		opt(cfg)
+	}
 	router := chi.NewRouter()
 	router.Use(
 		LoggingMiddleware(logger),
 		WithLogRequestBoundaries(),
-		AsyncMw(cacheConn),
+		CallerMw(cfg.identity),
 	)
-
-	router.Post("/send", handler.SendMessage)
-	router.Get("/swagger/*", httpSwagger.Handler(
-		httpSwagger.URL("/swagger/doc.json"),
-	))
-	router.Get("/bg-responses/{bg_id}", CachedResponse(cacheConn))
+	// copied, so that routers created from the same options do not share the registry
+	asyncOpts := append(append([]AsyncOption(nil), cfg.asyncOpts...), WithJobRegistry(registry))
+	routes := []Route{
+		{
+			Method:  http.MethodPost,
+			Pattern: "/send",
+			Handler: http.HandlerFunc(handler.SendMessage),
+			Policy: BackgroundPolicy{
+				Allowed:    true,
+				DefaultTTL: DefaultTimeout,
+				MaxTTL:     DefaultMaxTTL,
+				Retry:      DefaultRetryPolicy,
+				MaxDelay:   DefaultMaxDelay,
+			},
+			// idempotent replays are answered before AsyncMw, so they never start another background job.
+			// The body is read there first, it is limited like the ones of background requests.
+			Middlewares: []func(http.Handler) http.Handler{
+				IdempotencyMw(cacheConn, cfg.idempotencyTTL, newAsyncConfig(asyncOpts...).maxBodySize),
+			},
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/swagger/*",
+			Handler: httpSwagger.Handler(httpSwagger.URL("/swagger/doc.json")),
+			Policy:  NoBackground,
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/bg-responses/{bg_id}",
+			Handler: CachedResponse(cacheConn, cfg.owns, cfg.readMode),
+			Policy:  NoBackground,
+		},
+		{
+			Method:  http.MethodGet,
+			Pattern: "/bg-responses/{bg_id}/status",
+			Handler: BackgroundStatus(cacheConn, cfg.owns),
+			Policy:  NoBackground,
+		},
+		{
+			// event streams are written as they come, AsyncMw passes NoBackground routes through unbuffered.
+			Method:  http.MethodGet,
+			Pattern: "/bg-responses/{bg_id}/events",
+			Handler: BackgroundEvents(cacheConn, cfg.owns),
+			Policy:  NoBackground,
+		},
+		{
+			Method:  http.MethodDelete,
+			Pattern: "/bg-responses/{bg_id}",
+			Handler: CancelBackground(cacheConn, registry, cfg.owns),
+			Policy:  NoBackground,
+		},
+		{
+			Method:      http.MethodGet,
+			Pattern:     "/bg-responses",
+			Handler:     ListJobs(cacheConn),
+			Policy:      NoBackground,
+			Middlewares: []func(http.Handler) http.Handler{AdminMw(cfg.isAdmin)},
+		},
+		{
+			Method:      http.MethodGet,
+			Pattern:     "/bg-responses/{bg_id}/detail",
+			Handler:     JobDetails(cacheConn),
+			Policy:      NoBackground,
+			Middlewares: []func(http.Handler) http.Handler{AdminMw(cfg.isAdmin)},
+		},
+		{
+			Method:      http.MethodGet,
+			Pattern:     "/bg-workers",
+			Handler:     BackgroundWorkers(pool),
+			Policy:      NoBackground,
+			Middlewares: []func(http.Handler) http.Handler{AdminMw(cfg.isAdmin)},
+		},
+	}
+	for i := range routes {
+		if policy, ok := cfg.policies[routes[i].Method+" "+routes[i].Pattern]; ok {
+			routes[i].Policy = policy
+		}
+	}
+	registerRoutes(router, cacheConn, routes, asyncOpts)
 
 	return router
 }
@@ -0,0 +1,296 @@
+package webapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+const (
+	HTTPHeaderXBackgroundAt    = "x-background-at"
+	HTTPHeaderXBackgroundDelay = "x-background-delay"
+	// DefaultMaxDelay limits how far ahead requests of routes which may be scheduled are scheduled.
+	DefaultMaxDelay = 24 * time.Hour
+	// DefaultSchedulerInterval is how often the Scheduler looks for due requests.
+	DefaultSchedulerInterval = time.Second
+	// DefaultSchedulerLease is how long a claimed request is leased to the instance which claimed it. Leases
+	// are renewed until the request is finished, requests whose lease ended are claimed by another instance.
+	DefaultSchedulerLease = time.Minute
+	// DefaultScheduleRepairInterval is how often the Scheduler adds the stored requests which were not
+	// scheduled to the schedule.
+	DefaultScheduleRepairInterval = 10 * time.Minute
+	schedulerBatchSize            = 100
+)
+
+var ErrInvalidSchedule = errors.New("x-background-at must be a RFC 3339 time and x-background-delay " +
+	"a non-negative duration, only one of them may be set")
+
+// backgroundSchedule returns the time a scheduled request is due at, false if the request is not scheduled.
+func backgroundSchedule(httpHeader http.Header, now time.Time) (time.Time, bool, error) {
+	rawAt := httpHeader.Get(HTTPHeaderXBackgroundAt)
+	rawDelay := httpHeader.Get(HTTPHeaderXBackgroundDelay)
+	switch {
+	case rawAt != "" && rawDelay != "":
+		return time.Time{}, false, ErrInvalidSchedule
+	case rawAt != "":
+		runAt, err := time.Parse(time.RFC3339, rawAt)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("%w: %q", ErrInvalidSchedule, rawAt)
+		}
+		return runAt.UTC(), true, nil
+	case rawDelay != "":
+		delay, err := time.ParseDuration(rawDelay)
+		if err != nil || delay < 0 {
+			return time.Time{}, false, fmt.Errorf("%w: %q", ErrInvalidSchedule, rawDelay)
+		}
+		return now.Add(delay), true, nil
+	default:
+		return time.Time{}, false, nil
+	}
+}
+
+// Scheduler executes scheduled requests once they are due. The requests are persisted in the cache,
+// any instance sharing the cache executes them, also after the instance which accepted them restarted.
+// A due request is leased to the instance which claimed it until it is finished, the requests of an instance
+// which stopped meanwhile are claimed again once their lease ended.
+type Scheduler struct {
+	cacheConn  *responsecache.Cache
+	handler    http.Handler
+	interval   time.Duration
+	retryAfter time.Duration
+	lease      time.Duration
+	// renewedAt is when the leases of the requests started by the scheduler were renewed last.
+	renewedAt map[string]time.Time
+	// repairedAt is when the schedule was repaired last.
+	repairedAt time.Time
+}
+
+// NewScheduler returns a scheduler which replays due requests through handler, which is usually the router.
+func NewScheduler(cacheConn *responsecache.Cache, handler http.Handler, interval time.Duration) *Scheduler {
+	if interval <= 0 {
+		interval = DefaultSchedulerInterval
+	}
+	return &Scheduler{
+		cacheConn:  cacheConn,
+		handler:    handler,
+		interval:   interval,
+		retryAfter: DefaultRetryAfter,
+		lease:      DefaultSchedulerLease,
+		renewedAt:  make(map[string]time.Time),
+	}
+}
+
+// Run executes due requests until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.runDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scheduler) runDue(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	s.renewLeases(ctx)
+	s.repair(ctx)
+	now := time.Now().UTC()
+	expired, err := responsecache.ExpiredScheduledLeases(ctx, s.cacheConn, now, schedulerBatchSize)
+	if err != nil {
+		logger.WithError(err).Error("get expired scheduled leases failed")
+		return
+	}
+	for _, bgID := range expired {
+		if ctx.Err() != nil {
+			return
+		}
+		reclaimed, err := responsecache.ReclaimScheduledRequest(ctx, s.cacheConn, bgID, now, s.lease)
+		if err != nil {
+			logger.WithError(err).WithField("bg_id", bgID).Error("reclaim scheduled request failed")
+			continue
+		}
+		if reclaimed {
+			logger.WithField("bg_id", bgID).Warn("scheduled request of a stopped instance reclaimed")
+			s.dispatch(withoutCancel(ctx), bgID)
+		}
+	}
+	ids, err := responsecache.DueScheduledRequests(ctx, s.cacheConn, now, schedulerBatchSize)
+	if err != nil {
+		logger.WithError(err).Error("get due scheduled requests failed")
+		return
+	}
+	for _, bgID := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		claimed, err := responsecache.ClaimScheduledRequest(ctx, s.cacheConn, bgID, s.lease)
+		if err != nil {
+			logger.WithError(err).WithField("bg_id", bgID).Error("claim scheduled request failed")
+			continue
+		}
+		if claimed {
+			// a claimed request must be handed over even if the scheduler is stopped meanwhile.
+			s.dispatch(withoutCancel(ctx), bgID)
+		}
+	}
+}
+
+// repair schedules the stored requests which were not scheduled, when the scheduler starts and then every
+// DefaultScheduleRepairInterval.
+func (s *Scheduler) repair(ctx context.Context) {
+	if time.Since(s.repairedAt) < DefaultScheduleRepairInterval {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	repaired, err := responsecache.RepairSchedule(ctx, s.cacheConn)
+	if err != nil {
+		logger.WithError(err).Error("repair schedule failed")
+		return
+	}
+	s.repairedAt = time.Now()
+	if repaired > 0 {
+		logger.WithField("requests", repaired).Warn("stored requests which were not scheduled are scheduled")
+	}
+}
+
+// renewLeases renews the leases of the requests started by the scheduler, a third of the lease after they
+// were renewed last. The leases of finished requests are gone, they are not renewed anymore.
+func (s *Scheduler) renewLeases(ctx context.Context) {
+	for bgID, renewedAt := range s.renewedAt {
+		if time.Since(renewedAt) < s.lease/3 {
+			continue
+		}
+		renewed, err := responsecache.RenewScheduledLease(ctx, s.cacheConn, bgID, s.lease)
+		if err != nil {
+			logging.FromContext(ctx).WithError(err).WithField("bg_id", bgID).Warn("renew scheduled lease failed")
+			continue
+		}
+		if !renewed {
+			delete(s.renewedAt, bgID)
+			continue
+		}
+		s.renewedAt[bgID] = time.Now()
+	}
+}
+
+// dispatch replays a claimed request. Requests rejected because the workers are busy are rescheduled, the
+// started ones stay leased until they are finished.
+func (s *Scheduler) dispatch(ctx context.Context, bgID string) {
+	logger := logging.FromContext(ctx).WithField("bg_id", bgID)
+	scheduled, err := responsecache.GetScheduledRequest(ctx, s.cacheConn, bgID)
+	if errors.Is(err, responsecache.ErrNotFound) {
+		logger.Error("scheduled request not found")
+		s.lost(ctx, bgID)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("get scheduled request failed")
+		s.reschedule(ctx, bgID)
+		return
+	}
+	job, err := storedJob(ctx, s.cacheConn, scheduled)
+	if err != nil {
+		logger.WithError(err).Error("get scheduled job failed")
+		s.reschedule(ctx, bgID)
+		return
+	}
+	if job.Status.Finished() {
+		// the instance which executed it stopped before the request was deleted
+		logger.Info("scheduled request is finished already")
+		releaseScheduled(ctx, s.cacheConn, bgID)
+		return
+	}
+	if err = responsecache.OpenStoredRequest(s.cacheConn, scheduled); err != nil {
+		logger.WithError(err).Error("decrypt scheduled request failed")
+		s.finish(ctx, scheduled, job, &responsecache.HTTPResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte("scheduled request can not be decrypted"),
+		}, responsecache.JobFailed)
+		return
+	}
+	resp, err := replayStored(ctx, s.handler, &storedRun{job: job, request: scheduled, scheduled: true})
+	if err != nil {
+		logger.WithError(err).Error("restore scheduled request failed")
+		s.finish(ctx, scheduled, job, &responsecache.HTTPResponse{
+			Code: http.StatusBadRequest,
+			Body: []byte("scheduled request can not be restored"),
+		}, responsecache.JobFailed)
+		return
+	}
+	switch resp.code {
+	case http.StatusAccepted:
+		logger.Trace("scheduled request started")
+		s.renewedAt[bgID] = time.Now()
+	case http.StatusServiceUnavailable:
+		logger.Warn("workers are busy, reschedule request")
+		s.reschedule(ctx, bgID)
+	default:
+		// the route does not exist anymore or rejected the request
+		logger.WithField("code", resp.code).Error("scheduled request was not started")
+		s.finish(ctx, scheduled, job, rejectedResponse(resp), responsecache.JobFailed)
+	}
+}
+
+// lost fails the job of a claimed request whose stored request is missing, so that it is not reported as
+// scheduled forever, and releases its lease.
+func (s *Scheduler) lost(ctx context.Context, bgID string) {
+	job, err := responsecache.GetJob(ctx, s.cacheConn, bgID)
+	if err == nil && !job.Status.Finished() {
+		finishStored(ctx, s.cacheConn, &responsecache.StoredRequest{ID: bgID}, job, &responsecache.HTTPResponse{
+			Code: http.StatusInternalServerError,
+			Body: []byte("scheduled request was lost"),
+		}, responsecache.JobFailed)
+	}
+	releaseScheduled(ctx, s.cacheConn, bgID)
+}
+
+func (s *Scheduler) reschedule(ctx context.Context, bgID string) {
+	runAt := time.Now().UTC().Add(s.retryAfter)
+	if err := responsecache.RescheduleRequest(ctx, s.cacheConn, bgID, runAt); err != nil {
+		logging.FromContext(ctx).WithError(err).WithField("bg_id", bgID).Error("reschedule request failed")
+	}
+}
+
+func (s *Scheduler) finish(ctx context.Context, scheduled *responsecache.StoredRequest, job *responsecache.Job,
+	httpResp *responsecache.HTTPResponse, status responsecache.JobStatus,
+) {
+	finishStored(ctx, s.cacheConn, scheduled, job, httpResp, status)
+	releaseScheduled(ctx, s.cacheConn, job.ID)
+}
+
+// releaseScheduled deletes a scheduled request once it is finished or handed over to the durable queue.
+func releaseScheduled(ctx context.Context, cacheConn *responsecache.Cache, bgID string) {
+	if err := responsecache.DeleteScheduledRequest(ctx, cacheConn, bgID); err != nil {
+		logging.FromContext(ctx).WithError(err).WithField("bg_id", bgID).Warn("delete scheduled request failed")
+	}
+}
+
+// cancelScheduled cancels a scheduled request which has not been started. It reports false if the request
+// is being started already.
+func cancelScheduled(ctx context.Context, cacheConn *responsecache.Cache, job *responsecache.Job) (bool, error) {
+	claimed, err := responsecache.ClaimScheduledRequest(ctx, cacheConn, job.ID, DefaultSchedulerLease)
+	if err != nil || !claimed {
+		return false, err //nolint:wrapcheck // redis error is logged by the caller
+	}
+	scheduled, err := responsecache.GetScheduledRequest(ctx, cacheConn, job.ID)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("get scheduled request failed")
+		scheduled = &responsecache.StoredRequest{ID: job.ID}
+	}
+	finishStored(ctx, cacheConn, scheduled, job, &responsecache.HTTPResponse{
+		Code: StatusClientClosedRequest,
+		Body: []byte("Request cancelled before start"),
+	}, responsecache.JobCancelled)
+	releaseScheduled(ctx, cacheConn, job.ID)
+	return true, nil
+}
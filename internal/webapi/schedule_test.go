@@ -0,0 +1,212 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-redis/redis/v8"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestBackgroundSchedule(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name      string
+		headers   map[string]string
+		runAt     time.Time
+		scheduled bool
+		err       bool
+	}{
+		{name: "not scheduled", headers: map[string]string{}},
+		{name: "delay", headers: map[string]string{HTTPHeaderXBackgroundDelay: "1m"}, runAt: now.Add(time.Minute),
+			scheduled: true},
+		{name: "at", headers: map[string]string{HTTPHeaderXBackgroundAt: "2022-01-01T14:00:00+02:00"}, runAt: now,
+			scheduled: true},
+		{name: "negative delay", headers: map[string]string{HTTPHeaderXBackgroundDelay: "-1m"}, err: true},
+		{name: "invalid at", headers: map[string]string{HTTPHeaderXBackgroundAt: "tomorrow"}, err: true},
+		{name: "both", headers: map[string]string{
+			HTTPHeaderXBackgroundDelay: "1m",
+			HTTPHeaderXBackgroundAt:    "2022-01-01T14:00:00+02:00",
+		}, err: true},
+	}
+	for _, testCase := range testCases {
+		tc := testCase
+		t.Run(tc.name, func(t *testing.T) {
+			httpHeader := make(http.Header)
+			for k, v := range tc.headers {
+				httpHeader.Set(k, v)
+			}
+			runAt, scheduled, err := backgroundSchedule(httpHeader, now)
+			if tc.err {
+				assert.ErrorIs(t, err, ErrInvalidSchedule)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.scheduled, scheduled)
+			assert.True(t, tc.runAt.Equal(runAt), runAt)
+		})
+	}
+}
+
+func TestPersistedHeader(t *testing.T) {
+	httpHeader := make(http.Header)
+	httpHeader.Set("Content-Type", "application/json")
+	httpHeader.Set("Authorization", "Bearer token")
+	httpHeader.Set(HTTPHeaderAPIKey, "secret")
+	httpHeader.Set(HTTPHeaderIdempotencyKey, "key")
+	httpHeader.Set(HTTPHeaderXBackgroundDelay, "1m")
+
+	persisted := persistedHeader(httpHeader)
+
+	assert.Equal(t, http.Header{"Content-Type": []string{"application/json"}}, persisted)
+	assert.Equal(t, "secret", httpHeader.Get(HTTPHeaderAPIKey), "the request headers are left as they are")
+}
+
+func TestAsyncMw_ScheduleNotAllowed(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+	handlerFn := AsyncMw(cacheConn)(new(handlerResponse))
+
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/send", nil)
+	testRequest.Header.Set(HTTPHeaderXBackgroundDelay, "1m")
+	handlerFn.ServeHTTP(testRecorder, testRequest.WithContext(ctx))
+
+	assert.Equal(t, http.StatusBadRequest, testRecorder.Code)
+	assert.Equal(t, ErrScheduleNotAllowed.Error(), testRecorder.Body.String())
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet())
+}
+
+// storedRunRecorder answers replayed requests with code and keeps the last one.
+type storedRunRecorder struct {
+	code   int
+	caller string
+	run    *storedRun
+	body   string
+}
+
+func (s *storedRunRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.caller = CallerFromContext(r.Context())
+	s.run = storedRunFromContext(r.Context())
+	body, _ := ioutil.ReadAll(r.Body)
+	s.body = string(body)
+	w.WriteHeader(s.code)
+}
+
+func TestScheduler_Dispatch(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	bgID := "uniq_id"
+	scheduled := &responsecache.StoredRequest{
+		ID:     bgID,
+		Method: http.MethodPost,
+		URL:    "/send",
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   []byte(`{"name":"John"}`),
+		Owner:  "jwt:user",
+		RunAt:  time.Now().UTC(),
+	}
+	rawScheduled, err := json.Marshal(scheduled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawJob, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobScheduled})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("started", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cacheConn := &responsecache.Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectGet(responsecache.ScheduledRequestKey(bgID)).SetVal(string(rawScheduled))
+		mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(rawJob))
+		handler := &storedRunRecorder{code: http.StatusAccepted}
+		scheduler := NewScheduler(cacheConn, handler, time.Second)
+
+		scheduler.dispatch(ctx, bgID)
+
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the request is kept until it is finished")
+		assert.Contains(t, scheduler.renewedAt, bgID, "the lease is renewed")
+		assert.Equal(t, "jwt:user", handler.caller)
+		assert.Equal(t, `{"name":"John"}`, handler.body)
+		if assert.NotNil(t, handler.run) {
+			assert.Equal(t, responsecache.JobScheduled, handler.run.job.Status)
+		}
+	})
+
+	t.Run("workers are busy", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cacheConn := &responsecache.Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectGet(responsecache.ScheduledRequestKey(bgID)).SetVal(string(rawScheduled))
+		mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(rawJob))
+		mockedCacheConn.ExpectTxPipeline()
+		mockedCacheConn.ExpectZRem("{schedule}:leases", bgID).SetVal(1)
+		mockedCacheConn.CustomMatch(func(expected, actual []interface{}) error {
+			if actual[0] != "zadd" || actual[1] != "{schedule}" || actual[len(actual)-1] != bgID {
+				return fmt.Errorf("unexpected command %v", actual)
+			}
+			return nil
+		}).ExpectZAdd("{schedule}", &redis.Z{Member: bgID}).SetVal(1)
+		mockedCacheConn.ExpectTxPipelineExec()
+		handler := &storedRunRecorder{code: http.StatusServiceUnavailable}
+
+		NewScheduler(cacheConn, handler, time.Second).dispatch(ctx, bgID)
+
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the request is rescheduled and kept")
+	})
+
+	t.Run("finished already", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cacheConn := &responsecache.Cache{
+			Client: redisClient,
+		}
+		rawFinished, err := json.Marshal(&responsecache.Job{ID: bgID, Status: responsecache.JobSucceeded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockedCacheConn.ExpectGet(responsecache.ScheduledRequestKey(bgID)).SetVal(string(rawScheduled))
+		mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).SetVal(string(rawFinished))
+		expectScheduledDeleted(mockedCacheConn, bgID)
+		handler := &storedRunRecorder{code: http.StatusAccepted}
+
+		NewScheduler(cacheConn, handler, time.Second).dispatch(ctx, bgID)
+
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the request is deleted")
+		assert.Nil(t, handler.run, "the request is not executed again")
+	})
+
+	t.Run("lost", func(t *testing.T) {
+		redisClient, mockedCacheConn := redismock.NewClientMock()
+		cacheConn := &responsecache.Cache{
+			Client: redisClient,
+		}
+		mockedCacheConn.ExpectGet(responsecache.ScheduledRequestKey(bgID)).RedisNil()
+		mockedCacheConn.ExpectGet(responsecache.JobKey(bgID)).RedisNil()
+		expectScheduledDeleted(mockedCacheConn, bgID)
+
+		NewScheduler(cacheConn, &storedRunRecorder{}, time.Second).dispatch(ctx, bgID)
+
+		assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "the lease is released")
+	})
+}
+
+func expectScheduledDeleted(mockedCacheConn redismock.ClientMock, bgID string) {
+	mockedCacheConn.ExpectDel(responsecache.ScheduledRequestKey(bgID)).SetVal(1)
+	mockedCacheConn.ExpectZRem("{schedule}:leases", bgID).SetVal(1)
+}
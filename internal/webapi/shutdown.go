@@ -0,0 +1,77 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+// DefaultInterruptGrace is how long interrupted jobs get to roll back and to be recorded in the cache.
+const DefaultInterruptGrace = 2 * time.Second
+
+// DrainBackground stops accepting background requests and waits for the running ones until ctx is done.
+// Jobs which are still running after that are cancelled and recorded as interrupted. The callbacks of the
+// finished jobs are drained next, the ones still pending are recorded as not delivered.
+func DrainBackground(ctx context.Context, cacheConn *responsecache.Cache, registry *JobRegistry, pool *WorkerPool,
+	callbacks *CallbackSender,
+) {
+	drainJobs(ctx, cacheConn, registry, pool)
+	if callbacks != nil {
+		callbacks.drain(ctx)
+	}
+}
+
+func drainJobs(ctx context.Context, cacheConn *responsecache.Cache, registry *JobRegistry, pool *WorkerPool) {
+	logger := logging.FromContext(ctx)
+	pool.Close()
+	if err := registry.Wait(ctx); err == nil {
+		logger.Info("background jobs drained")
+		return
+	}
+
+	remaining := registry.Remaining()
+	logger.WithField("jobs", len(remaining)).Warn("interrupt background jobs")
+	registry.Interrupt()
+	graceCtx, cancel := context.WithTimeout(withoutCancel(ctx), DefaultInterruptGrace)
+	defer cancel()
+	if err := registry.Wait(graceCtx); err == nil {
+		return
+	}
+	for bgID, retention := range registry.Remaining() {
+		markInterrupted(graceCtx, cacheConn, bgID, retention)
+	}
+}
+
+// markInterrupted records the outcome of a job which did not stop in time.
+func markInterrupted(ctx context.Context, cacheConn *responsecache.Cache, bgID string, retention time.Duration) {
+	logger := logging.FromContext(ctx).WithField("bg_id", bgID)
+	job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+	if err != nil {
+		logger.WithError(err).Warn("get job failed")
+		job = &responsecache.Job{ID: bgID}
+	}
+	httpResp := &responsecache.HTTPResponse{
+		Code:  http.StatusServiceUnavailable,
+		Body:  []byte("Request interrupted by server shutdown"),
+		Owner: job.Owner,
+	}
+	if err = responsecache.SaveResponse(ctx, cacheConn, bgID, httpResp, retention); err != nil {
+		logger.WithError(err).Error("save response in cache failed")
+	}
+	finishedAt := time.Now().UTC()
+	job.Status = responsecache.JobInterrupted
+	job.Code = httpResp.Code
+	job.FinishedAt = &finishedAt
+	if retention > 0 {
+		expiresAt := finishedAt.Add(retention)
+		job.ExpiresAt = &expiresAt
+	}
+	if err = responsecache.SaveJob(ctx, cacheConn, job, retention); err != nil {
+		logger.WithError(err).Error("save job in cache failed")
+	}
+	publishCompleted(ctx, cacheConn, job, httpResp)
+}
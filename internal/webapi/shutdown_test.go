@@ -0,0 +1,105 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/agiledragon/gomonkey/v2"
+	"github.com/go-redis/redismock/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestDrainBackground_Interrupt(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+	httpHeaders := make(http.Header)
+	httpHeaders.Add(HTTPHeaderXBackground, "true")
+	httpHeaders.Add(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+
+	mockedUUID := uuid.MustParse("ef24471b-e968-40f0-b4d4-c9d0410565c8")
+	bgID := mockedUUID.String()
+	patches := gomonkey.ApplyFunc(uuid.New, func() uuid.UUID {
+		return mockedUUID
+	})
+	defer patches.Reset()
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+		Format: responsecache.FormatBinary,
+	}
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobRunning, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventAccepted)
+	mockedCacheConn.ExpectSet(bgID, &responsecache.HTTPResponse{
+		Code:    StatusClientClosedRequest,
+		Headers: make(map[string][]string),
+		Body:    []byte("cancelled"),
+	}, time.Duration(0)).SetVal("OK")
+	expectJobSet(mockedCacheConn, bgID, responsecache.JobInterrupted, 0)
+	expectEvent(mockedCacheConn, bgID, responsecache.EventCompleted)
+
+	registry := NewJobRegistry()
+	pool := NewWorkerPool(1, 1)
+	handlerFn := AsyncMw(cacheConn, WithJobRegistry(registry), WithWorkerPool(pool, time.Second))(
+		new(cancellableResponse))
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header = httpHeaders
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+	assert.Equal(t, http.StatusAccepted, testRecorder.Code)
+
+	drainCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	DrainBackground(drainCtx, cacheConn, registry, pool, nil)
+
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+	assert.Empty(t, registry.Remaining())
+	assert.ErrorIs(t, pool.TrySubmit(func() {}), ErrPoolClosed)
+}
+
+func TestDrainBackground_Callbacks(t *testing.T) {
+	ctx := logging.WithContext(context.Background(), logging.GetLogger())
+	cacheConn := &responsecache.Cache{Store: responsecache.NewMemoryStore(0)}
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	callbacks := NewCallbackSender(1, 1)
+	cfg := defaultCallbackConfig()
+	cfg.secret = "shared secret"
+	cfg.client = newCallbackClient(true)
+	cfg.sender = callbacks
+	// the first callback is being delivered, the second one waits in the queue
+	for _, bgID := range []string{"delivering", "queued"} {
+		job := responsecache.Job{ID: bgID, Status: responsecache.JobSucceeded}
+		sendCallback(ctx, cacheConn, cfg, job, receiver.URL, 0, &responsecache.HTTPResponse{Code: http.StatusOK})
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	DrainBackground(drainCtx, cacheConn, NewJobRegistry(), NewWorkerPool(1, 1), callbacks)
+
+	for _, bgID := range []string{"delivering", "queued"} {
+		job, err := responsecache.GetJob(ctx, cacheConn, bgID)
+		if assert.NoError(t, err, bgID) && assert.NotNil(t, job.Callback, bgID) {
+			assert.False(t, job.Callback.Delivered, bgID)
+			assert.Equal(t, ErrCallbackInterrupted.Error(), job.Callback.Error, bgID)
+		}
+	}
+	assert.ErrorIs(t, callbacks.pool.TrySubmit(func() {}), ErrPoolClosed)
+}
@@ -0,0 +1,302 @@
+package webapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+// unpersistedHeaders are not persisted with stored requests. Credentials are not stored at rest,
+// the caller is restored from the owner of the request.
+var unpersistedHeaders = []string{
+	"Authorization",
+	"Cookie",
+	HTTPHeaderAPIKey,
+	HTTPHeaderIdempotencyKey,
+	HTTPHeaderXBackground,
+	HTTPHeaderXBackgroundTTL,
+	HTTPHeaderXBackgroundRetention,
+	HTTPHeaderXBackgroundCallback,
+	HTTPHeaderXBackgroundAt,
+	HTTPHeaderXBackgroundDelay,
+	HTTPHeaderXBackgroundPriority,
+}
+
+func persistedHeader(httpHeader http.Header) http.Header {
+	persisted := httpHeader.Clone()
+	for _, name := range unpersistedHeaders {
+		persisted.Del(name)
+	}
+	return persisted
+}
+
+// persistRequest stores a background request with its job record and answers it with 202. A request
+// with runAt is scheduled, otherwise it is queued for the workers.
+func persistRequest(w http.ResponseWriter, r *http.Request, cacheConn *responsecache.Cache, cfg *asyncConfig,
+	runAt *time.Time, callbackURL string, priority Priority,
+) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+	body, err := readBody(r, cfg.maxBodySize)
+	if err != nil {
+		logger.WithError(err).Warn("read background request body failed")
+		if errors.Is(err, ErrBodyTooLarge) {
+			RequestEntityTooLarge(ctx, w, err.Error())
+			return
+		}
+		BadRequest(ctx, w, "read request body failed")
+		return
+	}
+	bgID := uuid.New().String()
+	logger = logger.WithField("bg_id", bgID)
+	retention := backgroundRetention(ctx, r.Header, cfg.routeRetention(), cfg.retentionLimit())
+	idem := idempotentRequestFromContext(ctx)
+	job := &responsecache.Job{
+		ID:        bgID,
+		Status:    responsecache.JobQueued,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		CreatedAt: time.Now().UTC(),
+		Owner:     CallerFromContext(ctx),
+		TraceID:   requestTraceID(ctx),
+		Priority:  priority.Name,
+	}
+	stored := &responsecache.StoredRequest{
+		ID:          bgID,
+		Method:      r.Method,
+		URL:         r.URL.RequestURI(),
+		Header:      persistedHeader(r.Header),
+		Body:        body,
+		Owner:       job.Owner,
+		Retention:   retention,
+		CallbackURL: callbackURL,
+		Idempotency: idem.ref(),
+		Priority:    priority.Name,
+	}
+	if runAt != nil {
+		job.Status = responsecache.JobScheduled
+		job.ScheduledAt = runAt
+		stored.RunAt = *runAt
+		err = responsecache.ScheduleRequest(ctx, cacheConn, job, stored)
+	} else if err = responsecache.EnqueueRequest(ctx, cacheConn, job, stored); err != nil {
+		// the job record is written first, it is not answered with 202
+		if errDel := responsecache.DeleteJob(ctx, cacheConn, bgID); errDel != nil {
+			logger.WithError(errDel).Warn("remove job of the request which was not queued failed")
+		}
+	}
+	if errors.Is(err, responsecache.ErrNotSupported) {
+		logger.WithError(err).Warn("background request can not be persisted")
+		NotImplemented(ctx, w, "persisted requests are not supported by the cache store")
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Error("persist background request failed")
+		InternalError(ctx, w, "persist background request failed")
+		return
+	}
+	idem.detach(ctx, cacheConn, bgID, retention)
+	if runAt == nil {
+		logger.Info("background request queued")
+		StatusAccepted(ctx, w, "request is queued", bgID, retention)
+		return
+	}
+	logger.WithField("run_at", *runAt).Info("background request scheduled")
+	w.Header().Set(HTTPHeaderXBackgroundAt, runAt.Format(time.RFC3339))
+	StatusAccepted(ctx, w, "request is scheduled", bgID, retention)
+}
+
+type storedRunKey struct{}
+
+// storedRun is a stored request replayed through the router by the Scheduler or the QueueWorker.
+type storedRun struct {
+	job     *responsecache.Job
+	request *responsecache.StoredRequest
+	// sync runs are executed before the replayed request is answered.
+	sync bool
+	// scheduled runs are started by the Scheduler, the scheduled request is deleted once it is finished.
+	scheduled bool
+}
+
+func withStoredRun(ctx context.Context, run *storedRun) context.Context {
+	return context.WithValue(ctx, storedRunKey{}, run)
+}
+
+func storedRunFromContext(ctx context.Context) *storedRun {
+	run, _ := ctx.Value(storedRunKey{}).(*storedRun)
+	return run
+}
+
+// runStored executes a replayed stored request. A sync run is answered with the job once it is finished.
+// Otherwise the request is queued for the workers in queue mode, or submitted to the worker pool and answered
+// with 202, or with 503 if the pool is full.
+func runStored(w http.ResponseWriter, r *http.Request, next http.Handler, cacheConn *responsecache.Cache,
+	cfg *asyncConfig, run *storedRun,
+) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+	job := run.job
+	if cfg.queue && !run.sync {
+		job.Status = responsecache.JobQueued
+		if err := responsecache.EnqueueRequest(ctx, cacheConn, job, run.request); err != nil {
+			logger.WithError(err).Error("queue stored request failed")
+			ServiceUnavailable(ctx, w, "queue stored request failed", cfg.retryAfter)
+			return
+		}
+		if run.scheduled {
+			releaseScheduled(ctx, cacheConn, job.ID)
+		}
+		StatusAccepted(ctx, w, "stored request is queued", job.ID, run.request.Retention)
+		return
+	}
+	task, abort, err := storedTask(r, next, cacheConn, cfg, run)
+	if err != nil {
+		logger.WithError(err).Warn("snapshot stored request failed")
+		BadRequest(ctx, w, "read request body failed")
+		return
+	}
+	if run.sync {
+		task()
+		StatusOkJSON(ctx, w, job)
+		return
+	}
+	if err = cfg.submit(task, cfg.priorities.stored(run.request.Priority)); err != nil {
+		abort()
+		logger.WithError(err).Warn("stored request rejected")
+		ServiceUnavailable(ctx, w, err.Error(), cfg.retryAfter)
+		return
+	}
+	StatusAccepted(ctx, w, "stored request is executed in the background", job.ID, run.request.Retention)
+}
+
+// storedTask prepares the execution of a stored request whose job is already recorded. The task executes
+// the request and stores its result, abort releases the execution if the task is never run.
+func storedTask(r *http.Request, next http.Handler, cacheConn *responsecache.Cache, cfg *asyncConfig,
+	run *storedRun,
+) (func(), func(), error) {
+	ctx := r.Context()
+	job := run.job
+	handlerReq, err := snapshotRequest(r, cfg.maxBodySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	asyncRespWriter := NewAsyncResponseWriter()
+	bgWriter := newBackgroundWriter(nil, asyncRespWriter)
+	bgWriter.detach()
+	detachedCtx := logging.WithContext(context.Background(), logging.FromContext(ctx))
+	asyncCtx, cancel := context.WithCancel(detachedCtx)
+	bgRun := newBackgroundRun(cacheConn, cfg.registry, cfg.policy.Retry)
+	bgRun.job = job
+	detached := &detachedJob{
+		job:         job,
+		retention:   run.request.Retention,
+		callbackURL: run.request.CallbackURL,
+		idempotency: idempotentRequestFromRef(run.request.Idempotency, job.ID),
+	}
+	cfg.registry.register(job.ID, cancel, detached.retention)
+	task := func() {
+		defer cancel()
+		bgRun.start(detachedCtx)
+		handlerCtx, span := backgroundContext(ctx, asyncCtx, handlerReq, bgRun)
+		defer span.End()
+		runAttempts(handlerCtx, asyncCtx, next, bgWriter, handlerReq, bgRun)
+		if asyncCtx.Err() != nil {
+			detached.cancelReason = cfg.registry.cancelReason(job.ID)
+		}
+		saveBackgroundResult(trace.ContextWithSpan(detachedCtx, span), cacheConn, cfg, detached, asyncRespWriter)
+		if run.scheduled {
+			releaseScheduled(detachedCtx, cacheConn, job.ID)
+		}
+		cfg.registry.finish(job.ID)
+	}
+	abort := func() {
+		cancel()
+		cfg.registry.finish(job.ID)
+	}
+	return task, abort, nil
+}
+
+// storedJob returns the job record of a stored request, it is restored from the request if it is missing.
+func storedJob(ctx context.Context, cacheConn *responsecache.Cache, stored *responsecache.StoredRequest,
+) (*responsecache.Job, error) {
+	job, err := responsecache.GetJob(ctx, cacheConn, stored.ID)
+	if err == nil {
+		return job, nil
+	}
+	if !errors.Is(err, responsecache.ErrNotFound) {
+		return nil, fmt.Errorf("get job: %w", err)
+	}
+	logging.FromContext(ctx).WithField("bg_id", stored.ID).Warn("job of stored request not found")
+	job = &responsecache.Job{
+		ID:        stored.ID,
+		Status:    responsecache.JobQueued,
+		Method:    stored.Method,
+		CreatedAt: time.Now().UTC(),
+		Owner:     stored.Owner,
+		Priority:  stored.Priority,
+	}
+	if !stored.RunAt.IsZero() {
+		job.Status = responsecache.JobScheduled
+		job.ScheduledAt = &stored.RunAt
+	}
+	return job, nil
+}
+
+// replayStored serves the stored request with handler on behalf of its owner and returns the response.
+func replayStored(ctx context.Context, handler http.Handler, run *storedRun) (*asyncResponseWriter, error) {
+	stored := run.request
+	runCtx := withStoredRun(WithCaller(ctx, stored.Owner), run)
+	httpReq, err := http.NewRequestWithContext(runCtx, stored.Method, stored.URL, bytes.NewReader(stored.Body))
+	if err != nil {
+		return nil, fmt.Errorf("restore stored request: %w", err)
+	}
+	httpReq.Header = stored.Header.Clone()
+	httpReq.RequestURI = stored.URL
+	resp := NewAsyncResponseWriter()
+	handler.ServeHTTP(resp, httpReq)
+	if resp.code == 0 {
+		resp.code = http.StatusOK
+	}
+	return resp, nil
+}
+
+// finishStored records the outcome of a stored request which was not executed.
+func finishStored(ctx context.Context, cacheConn *responsecache.Cache, stored *responsecache.StoredRequest,
+	job *responsecache.Job, httpResp *responsecache.HTTPResponse, status responsecache.JobStatus,
+) {
+	logger := logging.FromContext(ctx).WithField("bg_id", job.ID)
+	httpResp.Owner = job.Owner
+	if err := responsecache.SaveResponse(ctx, cacheConn, job.ID, httpResp, stored.Retention); err != nil {
+		logger.WithError(err).Error("save response in cache failed")
+	}
+	finishedAt := time.Now().UTC()
+	job.Status = status
+	job.Code = httpResp.Code
+	job.FinishedAt = &finishedAt
+	if stored.Retention > 0 {
+		expiresAt := finishedAt.Add(stored.Retention)
+		job.ExpiresAt = &expiresAt
+	}
+	if err := responsecache.SaveJob(ctx, cacheConn, job, stored.Retention); err != nil {
+		logger.WithError(err).Error("save job in cache failed")
+	}
+	idempotentRequestFromRef(stored.Idempotency, job.ID).complete(ctx, cacheConn, httpResp)
+	publishCompleted(ctx, cacheConn, job, httpResp)
+}
+
+// rejectedResponse is the result of a stored request which the router did not accept.
+func rejectedResponse(resp *asyncResponseWriter) *responsecache.HTTPResponse {
+	return &responsecache.HTTPResponse{
+		Code:    resp.code,
+		Headers: resp.headers,
+		Body:    resp.buf.Bytes(),
+	}
+}
@@ -0,0 +1,163 @@
+package webapi
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var ErrResponseDetached = errors.New("response is detached into the background")
+
+// backgroundWriter writes the response of a background request through to the client until the request
+// is detached, from then on the response is buffered. A request whose response has been started
+// is not detached anymore. Responses which are going to be retried are held in the buffer as well.
+type backgroundWriter struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	buffer *asyncResponseWriter
+	// hold reports whether a response with the status code is held back for a retry, nil holds nothing.
+	hold      func(statusCode int) bool
+	committed bool
+	detached  bool
+	held      bool
+}
+
+func newBackgroundWriter(w http.ResponseWriter, buffer *asyncResponseWriter) *backgroundWriter {
+	return &backgroundWriter{
+		w:      w,
+		buffer: buffer,
+	}
+}
+
+// Header returns the headers of the buffer, they are copied to the client when the response is started,
+// so that headers of a detached response never reach the 202.
+func (b *backgroundWriter) Header() http.Header {
+	return b.buffer.Header()
+}
+
+func (b *backgroundWriter) WriteHeader(statusCode int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buffering(statusCode)
+}
+
+func (b *backgroundWriter) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buffering(http.StatusOK) {
+		return b.buffer.Write(data)
+	}
+	return b.w.Write(data) //nolint:wrapcheck // passthrough writer
+}
+
+func (b *backgroundWriter) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buffering(http.StatusOK) {
+		return
+	}
+	if flusher, ok := b.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (b *backgroundWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.detached || b.held {
+		return nil, nil, ErrResponseDetached
+	}
+	hijacker, ok := b.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	b.committed = true
+	return hijacker.Hijack() //nolint:wrapcheck // passthrough writer
+}
+
+// buffering reports whether the response goes to the buffer. Otherwise the response is started with
+// statusCode unless it has been started already. It must be called with mu held.
+func (b *backgroundWriter) buffering(statusCode int) bool {
+	if !b.detached && !b.held && !b.committed && b.hold != nil && b.hold(statusCode) {
+		b.held = true
+	}
+	if b.detached || b.held {
+		if b.buffer.code == 0 {
+			b.buffer.code = statusCode
+		}
+		return true
+	}
+	b.commit(statusCode)
+	return false
+}
+
+// commit starts the response on the client writer, it must be called with mu held.
+func (b *backgroundWriter) commit(statusCode int) {
+	if b.committed {
+		return
+	}
+	b.committed = true
+	b.buffer.code = statusCode
+	for k, vs := range b.buffer.headers {
+		for _, v := range vs {
+			b.w.Header().Add(k, v)
+		}
+	}
+	b.w.WriteHeader(statusCode)
+}
+
+// finish starts an empty response if the handler wrote nothing, as net/http does. A held response
+// of a request which is not detached is sent to the client.
+func (b *backgroundWriter) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.detached {
+		return
+	}
+	if !b.held {
+		b.commit(http.StatusOK)
+		return
+	}
+	b.held = false
+	b.commit(b.buffer.code)
+	_, _ = b.w.Write(b.buffer.buf.Bytes())
+}
+
+// result returns the status code of the response and whether it is still buffered.
+func (b *backgroundWriter) result() (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	code := b.buffer.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	return code, !b.committed
+}
+
+// reset drops the buffered response of a failed attempt before the request is retried.
+// It reports false if the response has been started.
+func (b *backgroundWriter) reset() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.committed {
+		return false
+	}
+	b.held = false
+	b.buffer.code = 0
+	b.buffer.headers = make(http.Header)
+	b.buffer.buf.Reset()
+	return true
+}
+
+// detach switches the writer to buffering. It reports false if the response has already been started.
+func (b *backgroundWriter) detach() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.committed {
+		return false
+	}
+	b.detached = true
+	return true
+}
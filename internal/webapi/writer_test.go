@@ -0,0 +1,112 @@
+package webapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sugar-pack/users-manager/pkg/logging"
+	"github.com/go-redis/redismock/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Sugar-pack/rest-server/internal/responsecache"
+)
+
+func TestBackgroundWriter_Passthrough(t *testing.T) {
+	testRecorder := httptest.NewRecorder()
+	buffer := NewAsyncResponseWriter()
+	bgWriter := newBackgroundWriter(testRecorder, buffer)
+
+	bgWriter.Header().Set("X-Custom", "value")
+	_, err := bgWriter.Write([]byte("first chunk"))
+	assert.NoError(t, err)
+	bgWriter.Flush()
+
+	assert.False(t, bgWriter.detach(), "started response must not be detached")
+	assert.True(t, testRecorder.Flushed)
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.Equal(t, "value", testRecorder.Header().Get("X-Custom"))
+	assert.Equal(t, "first chunk", testRecorder.Body.String())
+	assert.Zero(t, buffer.buf.Len())
+}
+
+func TestBackgroundWriter_Detached(t *testing.T) {
+	testRecorder := httptest.NewRecorder()
+	buffer := NewAsyncResponseWriter()
+	bgWriter := newBackgroundWriter(testRecorder, buffer)
+
+	bgWriter.Header().Set("X-Custom", "value")
+	assert.True(t, bgWriter.detach())
+	bgWriter.WriteHeader(http.StatusCreated)
+	_, err := bgWriter.Write([]byte("buffered"))
+	assert.NoError(t, err)
+	bgWriter.Flush()
+	_, _, err = bgWriter.Hijack()
+
+	assert.ErrorIs(t, err, ErrResponseDetached)
+	assert.False(t, testRecorder.Flushed)
+	assert.Empty(t, testRecorder.Header().Get("X-Custom"))
+	assert.Zero(t, testRecorder.Body.Len())
+	assert.Equal(t, http.StatusCreated, buffer.code)
+	assert.Equal(t, "value", buffer.headers.Get("X-Custom"))
+	assert.Equal(t, "buffered", buffer.buf.String())
+}
+
+type streamingResponse struct{}
+
+func (s *streamingResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	StatusOk(ctx, w, "first chunk;")
+	w.(http.Flusher).Flush()
+	time.Sleep(30 * time.Millisecond) //nolint:revive,gomnd // outlive the background ttl
+	_, _ = w.Write([]byte("second chunk"))
+}
+
+func TestAsyncMw_StartedResponseIsNotDetached(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	redisClient, mockedCacheConn := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+
+	handlerFn := AsyncMw(cacheConn)(new(streamingResponse))
+	testRecorder := httptest.NewRecorder()
+	testRequest := httptest.NewRequest(http.MethodPost, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	testRequest.Header.Set(HTTPHeaderXBackground, "true")
+	testRequest.Header.Set(HTTPHeaderXBackgroundTTL, (10 * time.Millisecond).String())
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.True(t, testRecorder.Flushed)
+	assert.Equal(t, "first chunk;second chunk", testRecorder.Body.String())
+	assert.NoError(t, mockedCacheConn.ExpectationsWereMet(), "all redis expectations should be met")
+}
+
+func TestAsyncMw_SyncRequestWritesDirectly(t *testing.T) {
+	logger := logging.GetLogger()
+	ctx := context.Background()
+	ctx = logging.WithContext(ctx, logger)
+
+	redisClient, _ := redismock.NewClientMock()
+	cacheConn := &responsecache.Cache{
+		Client: redisClient,
+	}
+
+	testRecorder := httptest.NewRecorder()
+	handlerFn := AsyncMw(cacheConn)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Same(t, testRecorder, w)
+		StatusOk(r.Context(), w, "fast and furious")
+	}))
+	testRequest := httptest.NewRequest(http.MethodPost, "/any", nil)
+	testRequest = testRequest.WithContext(ctx)
+	handlerFn.ServeHTTP(testRecorder, testRequest)
+
+	assert.Equal(t, http.StatusOK, testRecorder.Code)
+	assert.Equal(t, "fast and furious", testRecorder.Body.String())
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -67,14 +69,99 @@ func main() {
 		}
 	}(orderConn)
 
-	cacheConn, err := responsecache.NewCache(ctx, responsecache.WithAddr(appConfig.App.CacheAddr))
+	cacheConn, err := newCache(ctx, appConfig)
 	if err != nil {
 		logger.WithError(err).Error("cache connect failed")
 		return
 	}
+	cacheConn.Storage = responsecache.Storage{
+		CompressThreshold: appConfig.App.ResultCompressThreshold,
+		ChunkSize:         appConfig.App.ResultChunkSize,
+		MaxSize:           appConfig.App.ResultMaxSize,
+	}
+	cacheConn.Format, err = responsecache.ParseResponseFormat(appConfig.App.ResultFormat)
+	if err != nil {
+		logger.WithError(err).Error("invalid result format")
+		return
+	}
+	cacheConn.Keys, err = newKeyring(appConfig.App.ResultEncryptionKeys)
+	if err != nil {
+		logger.WithError(err).Error("invalid result encryption keys")
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-results" {
+		migrateResults(ctx, cacheConn)
+		return
+	}
+
+	readMode, err := webapi.ParseResultReadMode(appConfig.App.ResultReadMode, webapi.ResultConsume)
+	if err != nil {
+		logger.WithError(err).Error("invalid result read mode")
+		return
+	}
+
+	backgroundMode, err := webapi.ParseBackgroundMode(appConfig.App.BackgroundMode)
+	if err != nil {
+		logger.WithError(err).Error("invalid background mode")
+		return
+	}
+
+	priorityCaps := make(map[string]string, len(appConfig.App.BackgroundPriorityCaps))
+	for _, priorityCap := range appConfig.App.BackgroundPriorityCaps {
+		priorityCaps[priorityCap.Caller] = priorityCap.Priority
+	}
+	priorities, err := webapi.NewPriorityClasses(appConfig.App.BackgroundPriorities,
+		appConfig.App.BackgroundDefaultPriority, priorityCaps)
+	if err != nil {
+		logger.WithError(err).Error("invalid background priorities")
+		return
+	}
 
 	handler := webapi.NewHandler(userConn, orderConn)
-	router := webapi.CreateRouter(logger, handler, cacheConn)
+	registry := webapi.NewJobRegistry()
+	pool := webapi.NewWorkerPool(appConfig.App.BackgroundWorkers, appConfig.App.BackgroundQueueSize,
+		webapi.WithPriorityLevels(len(priorities.Names())))
+	callbacks := webapi.NewCallbackSender(appConfig.App.CallbackWorkers, appConfig.App.CallbackQueueSize)
+	asyncOpts := []webapi.AsyncOption{
+		webapi.WithRetention(appConfig.App.ResultRetention),
+		webapi.WithMaxRetention(appConfig.App.ResultMaxRetention),
+		webapi.WithPriorities(priorities),
+		webapi.WithWorkerPool(pool, appConfig.App.BackgroundRetryAfter),
+		webapi.WithMaxBodySize(appConfig.App.BackgroundMaxBodySize),
+		webapi.WithCallback(appConfig.App.CallbackSecret, appConfig.App.CallbackMaxAttempts,
+			appConfig.App.CallbackBackoff),
+		webapi.WithCallbackDestinations(appConfig.App.CallbackAllowedHosts, appConfig.App.CallbackAllowPrivate),
+		webapi.WithCallbackSender(callbacks),
+	}
+	if backgroundMode == webapi.BackgroundQueue {
+		if cacheConn.Client == nil {
+			logger.Error("the queue background mode needs the redis cache store")
+			return
+		}
+		asyncOpts = append(asyncOpts, webapi.WithQueue())
+	}
+	routerOpts := []webapi.RouterOption{
+		webapi.WithIdempotencyTTL(appConfig.App.IdempotencyTTL),
+		webapi.WithResultReadMode(readMode),
+		webapi.WithAdminCheck(webapi.AdminCallers(appConfig.App.AdminCallers)),
+		webapi.WithAsyncOptions(asyncOpts...),
+	}
+	if appConfig.App.JWTSecret != "" {
+		routerOpts = append(routerOpts, webapi.WithCallerIdentity(
+			webapi.NewCallerIdentity(webapi.HS256Verifier([]byte(appConfig.App.JWTSecret)))))
+	}
+	router := webapi.CreateRouter(logger, handler, cacheConn, registry, pool, routerOpts...)
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker(ctx, appConfig, cacheConn, router, priorities, registry, pool, callbacks)
+		return
+	}
+	schedulerCtx, stopScheduler := context.WithCancel(ctx)
+	defer stopScheduler()
+	if cacheConn.Client != nil {
+		scheduler := webapi.NewScheduler(cacheConn, router, appConfig.App.SchedulerInterval)
+		go scheduler.Run(schedulerCtx)
+	}
+
 	server := http.Server{
 		Addr:    appConfig.App.Bind,
 		Handler: webapi.TraceWrapRouter(router),
@@ -87,7 +174,7 @@ func main() {
 	go func() {
 		logger.Info("Server is listening on ", appConfig.App.Bind)
 		errLaS := server.ListenAndServe()
-		if errLaS != nil && errors.Is(errLaS, http.ErrServerClosed) {
+		if errLaS != nil && !errors.Is(errLaS, http.ErrServerClosed) {
 			logger.Fatal(errLaS)
 		}
 	}()
@@ -96,14 +183,157 @@ func main() {
 
 	logger.Info("Shutdown signal received")
 
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownTime)
+	ctx, cancel := context.WithTimeout(ctx, shutdownTime)
 	defer func() {
 		cancel()
 	}()
 
 	if errShutdown := server.Shutdown(ctx); errShutdown != nil {
-		logger.WithError(errShutdown).Fatal("Server shutdown error")
+		logger.WithError(errShutdown).Error("Server shutdown error")
 	}
+	webapi.DrainBackground(ctx, cacheConn, registry, pool, callbacks)
+	// the scheduler renews the leases of the scheduled requests until they are drained, due requests are
+	// rescheduled meanwhile since the pool is closed.
+	stopScheduler()
 
 	logger.Info("Server stopped gracefully")
 }
+
+// newCache returns the cache with the configured store.
+func newCache(ctx context.Context, appConfig *config.Config) (*responsecache.Cache, error) {
+	switch appConfig.App.CacheStore {
+	case "", "redis":
+		cacheOpts := []responsecache.CacheOption{
+			cacheDeployment(appConfig.App),
+			responsecache.WithCredentials(appConfig.App.CacheUsername, appConfig.App.CachePassword),
+			responsecache.WithDB(appConfig.App.CacheDB),
+			responsecache.WithPool(appConfig.App.CachePoolSize, appConfig.App.CacheMinIdleConns),
+			responsecache.WithTimeouts(appConfig.App.CacheDialTimeout, appConfig.App.CacheReadTimeout,
+				appConfig.App.CacheWriteTimeout),
+		}
+		if appConfig.App.CacheTLS {
+			tlsConfig, err := responsecache.NewTLSConfig(appConfig.App.CacheTLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("%w: app_api.cache_tls_ca_file %s", config.ErrInvalidConfig, err.Error())
+			}
+			cacheOpts = append(cacheOpts, responsecache.WithTLS(tlsConfig))
+		}
+		return responsecache.NewCache(ctx, cacheOpts...)
+	case "memory":
+		return &responsecache.Cache{Store: responsecache.NewMemoryStore(appConfig.App.CacheMemoryMaxSize)}, nil
+	case "disk":
+		store, err := responsecache.NewDiskStore(appConfig.App.CacheDir)
+		if err != nil {
+			return nil, err
+		}
+		return &responsecache.Cache{Store: store}, nil
+	default:
+		return nil, fmt.Errorf("%w: app_api.cache_store %q is unknown", config.ErrInvalidConfig,
+			appConfig.App.CacheStore)
+	}
+}
+
+// cacheDeployment returns the option connecting to the configured Redis deployment.
+func cacheDeployment(appConfig *config.API) responsecache.CacheOption {
+	switch appConfig.CacheMode {
+	case config.CacheSentinel:
+		return responsecache.WithSentinel(appConfig.CacheMasterName, appConfig.CacheAddrs)
+	case config.CacheCluster:
+		return responsecache.WithCluster(appConfig.CacheAddrs)
+	default:
+		return responsecache.WithAddr(appConfig.CacheAddr)
+	}
+}
+
+// newKeyring returns the keyring of the configured encryption keys, nil if there are none.
+func newKeyring(encryptionKeys []config.EncryptionKey) (*responsecache.Keyring, error) {
+	if len(encryptionKeys) == 0 {
+		return nil, nil
+	}
+	keys := make([]responsecache.Key, 0, len(encryptionKeys))
+	for i, encryptionKey := range encryptionKeys {
+		secret, err := base64.StdEncoding.DecodeString(encryptionKey.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: app_api.result_encryption_keys[%d] is not base64: %s",
+				config.ErrInvalidConfig, i, err.Error())
+		}
+		keys = append(keys, responsecache.Key{ID: encryptionKey.ID, Secret: secret})
+	}
+	keyring, err := responsecache.NewKeyring(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: app_api.result_encryption_keys: %s", config.ErrInvalidConfig, err.Error())
+	}
+	return keyring, nil
+}
+
+// migrateResults rewrites results stored as plain JSON in the binary envelope, and encrypts results and
+// scheduled requests stored in clear when encryption keys are configured.
+func migrateResults(ctx context.Context, cacheConn *responsecache.Cache) {
+	logger := logging.FromContext(ctx)
+	if cacheConn.Format != responsecache.FormatBinary {
+		logger.Error("results are not migrated while app_api.result_format is json")
+		return
+	}
+	// the records stored in clear are only read here, the server refuses them once it has keys
+	cacheConn.AllowPlaintext = true
+	migrated, err := responsecache.MigrateResponses(ctx, cacheConn)
+	logger = logger.WithField("migrated", migrated)
+	if err != nil {
+		logger.WithError(err).Error("migrate results failed")
+		return
+	}
+	scheduled, err := responsecache.MigrateScheduledRequests(ctx, cacheConn)
+	logger = logger.WithField("scheduled", scheduled)
+	if err != nil {
+		logger.WithError(err).Error("migrate scheduled requests failed")
+		return
+	}
+	logger.Info("results migrated")
+}
+
+// runWorker executes queued background requests with the router until the shutdown signal.
+func runWorker(ctx context.Context, appConfig *config.Config, cacheConn *responsecache.Cache, router http.Handler,
+	priorities *webapi.PriorityClasses, registry *webapi.JobRegistry, pool *webapi.WorkerPool,
+	callbacks *webapi.CallbackSender,
+) {
+	logger := logging.FromContext(ctx)
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.WithError(err).Error("get hostname failed")
+		return
+	}
+	consumer := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	worker := webapi.NewQueueWorker(cacheConn, router, priorities, consumer, appConfig.App.BackgroundWorkers,
+		appConfig.App.QueueClaimIdle)
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(shutdown)
+
+	workerCtx, stopWorker := context.WithCancel(ctx)
+	defer stopWorker()
+	workerDone := make(chan error, 1)
+	go func() {
+		workerDone <- worker.Run(workerCtx)
+	}()
+
+	select {
+	case <-shutdown:
+		logger.Info("Shutdown signal received")
+	case errRun := <-workerDone:
+		logger.WithError(errRun).Error("worker stopped")
+		return
+	}
+	stopWorker()
+
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Server.ShutdownTimeout)
+	defer cancel()
+
+	webapi.DrainBackground(ctx, cacheConn, registry, pool, callbacks)
+	select {
+	case <-workerDone:
+	case <-ctx.Done():
+	}
+
+	logger.Info("Worker stopped gracefully")
+}